@@ -0,0 +1,253 @@
+/*
+Package attract takes over the controls when nobody has touched the MIDI controller for a while.
+
+While attract mode is on, it switches patterns every so often and slowly animates
+the hue, morph, and speed controls by writing to the MidiState.  As soon as someone
+presses a pad or moves a knob (or changes a control some other way), the controls
+glide back to wherever the inputs really left them, so there's no sudden jump.
+MIDI clock, start, stop and other SYSTEM messages don't count as someone touching
+the controller, since sequencers send them all the time.
+
+Patterns are picked from opc.MIDI_SWITCHER_PATTERNS.  If the source is midi-switcher,
+attract mode picks them with the switch control.  It doesn't glide, since that would
+flash through every pattern in between: it's set straight to its new value when attract
+mode starts, when it picks a new pattern, and when it hands back control.  With any other
+source (a pattern, playlist, layers file and so on) attract mode switches the source with
+the pipeline's opc.SourceSwitcher instead, leaves the switch control alone, and switches
+back to the original source when it hands back control, unless something else (like the
+remote control API) has switched the source in the meantime.  Either way the switcher's
+transition (see the opc package) blends from one pattern to the next.  Without a
+SourceSwitcher, or if the source is an OPC server (which can't be switched back to),
+attract mode only turns the knobs.
+
+The rest of the time it leaves the controls alone, so knob smoothing and the other
+inputs work as usual; it only remembers where they are, to glide back to them later.
+
+Example
+
+	attractMode := attract.New(300) // start after 5 minutes of silence
+	attractMode.Switcher = pipeline.Switcher
+	for {
+	    changed := controls.Update(&midiState, midi.GetAvailableMidiMessages(midiMessageChan), nil)
+	    controls.Smooth(&midiState, clock.Now())
+	    attractMode.Update(&midiState, changed, clock.Now())
+	    // ... render a frame ...
+	}
+*/
+package attract
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/longears/pixelslinger/colorutils"
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+	"github.com/longears/pixelslinger/opc"
+)
+
+//================================================================================
+// CONSTANTS
+
+// Seconds to glide between the controller's values and the automated ones
+const GLIDE_TIME = 3.0
+
+// Seconds between pattern switches
+const SWITCH_TIME = 45.0
+
+// The controls which attract mode animates.  The rest keep the inputs' values,
+// so attract mode never turns up the brightness or opens the eyelid by itself.
+var AUTOMATED_CONTROLS = []*controls.Control{
+	controls.SWITCH,
+	controls.HUE,
+	controls.MORPH,
+	controls.SPEED,
+}
+
+//================================================================================
+// ATTRACTMODE TYPE
+
+type AttractMode struct {
+	IdleTime  float64             // seconds without human MIDI input before taking over.  0 means never.
+	GlideTime float64             // seconds to glide between the controller's values and the automated ones
+	Switcher  *opc.SourceSwitcher // may be nil, in which case only the switch control changes patterns
+
+	active         bool
+	initialized    bool
+	lastTouchTime  float64
+	driving        map[*controls.Control]bool    // controls we're writing, while active or gliding back
+	realValues     map[*controls.Control]float64 // where the inputs really left the controls
+	glideFrom      map[*controls.Control]float64 // control values when the last glide started
+	glideStartTime float64
+	switchValue    float64
+	realSource     string // the source to switch back to, or "" if we're using the switch control
+	attractSource  string // the source we last switched to
+	lastSwitchTime float64
+	rng            *rand.Rand
+}
+
+// Make an AttractMode which starts after idleTime seconds without human input.
+func New(idleTime float64) *AttractMode {
+	return &AttractMode{
+		IdleTime:   idleTime,
+		GlideTime:  GLIDE_TIME,
+		driving:    make(map[*controls.Control]bool),
+		realValues: make(map[*controls.Control]float64),
+		glideFrom:  make(map[*controls.Control]float64),
+		rng:        rand.New(rand.NewSource(99)),
+	}
+}
+
+// Is attract mode in control right now?
+func (a *AttractMode) Active() bool {
+	return a.active
+}
+
+// Call this once per frame after controls.Update and controls.Smooth, with the controls
+// Update changed.  t is the current frame time in seconds.
+// While attract mode is on, or gliding back after it, writes the automated control values
+// into midiState.  Otherwise it doesn't write anything.
+func (a *AttractMode) Update(midiState *midi.MidiState, changed []*controls.Control, t float64) {
+	if !a.initialized {
+		a.initialized = true
+		a.lastTouchTime = t
+	}
+
+	// the controls we aren't writing belong to the inputs, so keep track of where they are,
+	// including where smoothing has moved them to
+	for _, c := range AUTOMATED_CONTROLS {
+		if !a.driving[c] {
+			a.realValues[c] = c.Get(midiState)
+		}
+	}
+
+	// keep track of whether a human is here.
+	// any channel message counts, even if it isn't mapped to a control.
+	touched := len(changed) > 0
+	for _, m := range midiState.RecentMidiMessages {
+		if m.IsChannelMessage() {
+			touched = true
+		}
+	}
+	for _, c := range changed {
+		a.realValues[c] = c.Get(midiState)
+		// this control is in the human's hands now, so stop writing it
+		delete(a.driving, c)
+	}
+	if touched {
+		a.lastTouchTime = t
+	}
+
+	// switch modes
+	if a.active && touched {
+		fmt.Println("[attract] controller touched.  handing control back.")
+		a.active = false
+		a.startGlide(midiState, t)
+		// switch straight back to the real pattern and let the switcher's transition blend to it
+		if a.driving[controls.SWITCH] {
+			controls.SWITCH.Set(midiState, a.realValues[controls.SWITCH])
+			delete(a.driving, controls.SWITCH)
+		}
+		if a.realSource != "" && a.Switcher.Current() == a.attractSource {
+			a.switchSource(a.realSource)
+		}
+		a.realSource, a.attractSource = "", ""
+	} else if !a.active && a.IdleTime > 0 && t-a.lastTouchTime > a.IdleTime {
+		fmt.Println("[attract] controller is idle.  starting attract mode.")
+		a.active = true
+		a.realSource = a.switchableSource()
+		for _, c := range AUTOMATED_CONTROLS {
+			a.driving[c] = true
+		}
+		if a.realSource != "" {
+			delete(a.driving, controls.SWITCH)
+		}
+		a.startGlide(midiState, t)
+		a.lastSwitchTime = t - SWITCH_TIME // switch right away
+	}
+
+	// choose a new pattern now and then
+	if a.active && t-a.lastSwitchTime >= SWITCH_TIME {
+		a.lastSwitchTime = t
+		a.switchValue = a.rng.Float64()
+		if a.realSource != "" {
+			a.switchSource(opc.MidiSwitcherPattern(a.switchValue))
+		}
+	}
+
+	// write control values, gliding from the old values if we changed modes recently
+	glide := 1.0
+	if a.GlideTime > 0 {
+		glide = colorutils.Clamp((t-a.glideStartTime)/a.GlideTime, 0, 1)
+	}
+	for _, c := range AUTOMATED_CONTROLS {
+		if !a.driving[c] {
+			continue
+		}
+		target := a.realValues[c]
+		if a.active {
+			target = a.automatedValue(c, t)
+		}
+		if c == controls.SWITCH {
+			// don't sweep through every pattern on the way (see the package doc)
+			c.Set(midiState, target)
+			continue
+		}
+		c.Set(midiState, a.glideFrom[c]*(1-glide)+target*glide)
+	}
+	if !a.active && glide >= 1 {
+		// we're all the way back, so hand the controls over
+		for c := range a.driving {
+			delete(a.driving, c)
+		}
+	}
+}
+
+// Return the current source if we should change patterns by switching sources,
+// or "" if we should use the switch control (or can't change patterns at all).
+func (a *AttractMode) switchableSource() string {
+	if a.Switcher == nil {
+		return ""
+	}
+	source := a.Switcher.Current()
+	if source == opc.MIDI_SWITCHER {
+		return ""
+	}
+	if err := a.Switcher.Check(source); err != nil {
+		fmt.Printf("[attract] can't switch back to %s later (%v), so only turning the knobs\n", source, err)
+		return ""
+	}
+	return source
+}
+
+// Switch to the named source, remembering it so we can tell later whether anyone else has switched since.
+func (a *AttractMode) switchSource(name string) {
+	if err := a.Switcher.SwitchTo(name); err != nil {
+		fmt.Println("[attract] couldn't switch source:", err)
+		return
+	}
+	a.attractSource = name
+}
+
+// Remember the current control values so we can glide away from them.
+func (a *AttractMode) startGlide(midiState *midi.MidiState, t float64) {
+	for _, c := range AUTOMATED_CONTROLS {
+		a.glideFrom[c] = c.Get(midiState)
+	}
+	a.glideStartTime = t
+}
+
+// Value for one of the AUTOMATED_CONTROLS at time t.
+func (a *AttractMode) automatedValue(c *controls.Control, t float64) float64 {
+	switch c {
+	case controls.SWITCH:
+		return a.switchValue
+	case controls.HUE:
+		return colorutils.PosMod(t/120, 1) // slowly go all the way around the color wheel
+	case controls.MORPH:
+		return colorutils.Cos(t, 0, 37, 0, 1)
+	case controls.SPEED:
+		return colorutils.Cos(t, 0, 53, 45.0/127, 80.0/127) // stay near the default speed
+	}
+	return a.realValues[c]
+}
@@ -0,0 +1,289 @@
+package attract
+
+import (
+	"math"
+	"testing"
+
+	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+	"github.com/longears/pixelslinger/opc"
+)
+
+// Step the attract mode forward with no input, one frame every dt seconds, until time t.
+func runUntil(a *AttractMode, midiState *midi.MidiState, now *float64, t, dt float64) {
+	midiState.UpdateStateFromSlice(nil)
+	for *now < t {
+		*now += dt
+		a.Update(midiState, nil, *now)
+	}
+}
+
+//================================================================================
+func TestAttractMode(t *testing.T) {
+	midiState := &midi.MidiState{}
+	controls.HUE.Set(midiState, 0.1)
+	a := New(60)
+	now := 0.0
+	dt := 0.1
+
+	runUntil(a, midiState, &now, 59, dt)
+	if a.Active() {
+		t.Fatalf("attract mode started before the idle time was up")
+	}
+	if controls.HUE.Get(midiState) != 0.1 {
+		t.Errorf("hue moved before attract mode started: %v", controls.HUE.Get(midiState))
+	}
+
+	runUntil(a, midiState, &now, 100, dt)
+	if !a.Active() {
+		t.Fatalf("attract mode didn't start after the idle time")
+	}
+
+	// touch a different control and make sure hue glides back to 0.1 without jumping
+	changed := controls.Update(midiState, nil, []controls.Event{{Control: controls.GAIN, Value: 0.8}})
+	before := controls.HUE.Get(midiState)
+	now += dt
+	a.Update(midiState, changed, now)
+	if a.Active() {
+		t.Fatalf("attract mode didn't stop when a control was changed")
+	}
+	midiState.UpdateStateFromSlice(nil)
+	for ii := 0; ii < int(GLIDE_TIME/dt)+2; ii++ {
+		after := controls.HUE.Get(midiState)
+		if math.Abs(after-before) > 0.08 {
+			t.Errorf("hue jumped from %v to %v", before, after)
+		}
+		before = after
+		now += dt
+		a.Update(midiState, nil, now)
+	}
+	if math.Abs(controls.HUE.Get(midiState)-0.1) > 1e-9 {
+		t.Errorf("hue didn't go back to its real value: %v", controls.HUE.Get(midiState))
+	}
+	if controls.GAIN.Get(midiState) != 0.8 {
+		t.Errorf("touched control was changed: %v", controls.GAIN.Get(midiState))
+	}
+
+	// any MIDI counts as a touch, even if it isn't mapped to a control
+	runUntil(a, midiState, &now, 200, dt)
+	if !a.Active() {
+		t.Fatalf("attract mode didn't start again")
+	}
+	midiState.UpdateStateFromSlice([]*midi.MidiMessage{{Kind: midi.NOTE_ON, Key: 100, Value: 1}})
+	a.Update(midiState, nil, now+dt)
+	if a.Active() {
+		t.Errorf("attract mode didn't stop for an unmapped key")
+	}
+}
+
+func TestSystemMessagesAreNotTouches(t *testing.T) {
+	midiState := &midi.MidiState{}
+	a := New(60)
+	now := 0.0
+	sequencer := []*midi.MidiMessage{
+		{Kind: midi.SYSTEM, Channel: midi.CLOCK},
+		{Kind: midi.SYSTEM, Channel: midi.START},
+		{Kind: midi.SYSTEM, Channel: midi.MTC_QUARTER_FRAME, Key: 3},
+		{Kind: midi.SYSTEM, Channel: midi.STOP},
+	}
+	for now < 100 {
+		now += 0.1
+		midiState.UpdateStateFromSlice(sequencer)
+		a.Update(midiState, nil, now)
+	}
+	if !a.Active() {
+		t.Errorf("a sequencer's clock kept attract mode from starting")
+	}
+}
+
+func TestSwitchHandback(t *testing.T) {
+	midiState := &midi.MidiState{}
+	controls.SWITCH.Set(midiState, 0.25)
+	a := New(60)
+	now := 0.0
+	runUntil(a, midiState, &now, 100, 0.1)
+	if !a.Active() {
+		t.Fatalf("attract mode didn't start")
+	}
+	if controls.SWITCH.Get(midiState) != a.switchValue {
+		t.Fatalf("switch should go straight to attract mode's pattern, got %v", controls.SWITCH.Get(midiState))
+	}
+
+	// the switch goes straight back on the first frame, while the other controls glide
+	hue := controls.HUE.Get(midiState)
+	changed := controls.Update(midiState, nil, []controls.Event{{Control: controls.GAIN, Value: 0.5}})
+	now += 0.1
+	a.Update(midiState, changed, now)
+	if controls.SWITCH.Get(midiState) != 0.25 {
+		t.Errorf("switch should go straight back to 0.25, got %v", controls.SWITCH.Get(midiState))
+	}
+	if controls.HUE.Get(midiState) != hue {
+		t.Errorf("hue should start gliding from %v, got %v", hue, controls.HUE.Get(midiState))
+	}
+
+	// after that the switch is the inputs' again
+	controls.SWITCH.Set(midiState, 0.75)
+	runUntil(a, midiState, &now, now+0.5, 0.1)
+	if controls.SWITCH.Get(midiState) != 0.75 {
+		t.Errorf("attract mode wrote over the switch after handing it back: %v", controls.SWITCH.Get(midiState))
+	}
+}
+
+// Build a pipeline with the given source and return its switcher.
+func makeSwitcher(t *testing.T, source string) *opc.SourceSwitcher {
+	pc := &opc.PipelineConfig{Source: opc.StageConfig{Name: source}, Dests: []opc.StageConfig{{Name: opc.DEVNULL_MAGIC_WORD}}}
+	pipeline, err := pc.Build(opc.ReadLocations("../layouts/circle_r1_160x.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pipeline.Switcher
+}
+
+func TestSourceSwitching(t *testing.T) {
+	midiState := &midi.MidiState{}
+	controls.SWITCH.Set(midiState, 0.25)
+	a := New(60)
+	a.Switcher = makeSwitcher(t, "moire")
+	now := 0.0
+	runUntil(a, midiState, &now, 100, 0.1)
+	if !a.Active() {
+		t.Fatalf("attract mode didn't start")
+	}
+
+	// a source other than midi-switcher is switched, and the switch control is left alone
+	seen := map[string]bool{}
+	for ii := 0; ii < 5; ii++ {
+		if got, want := a.Switcher.Current(), opc.MidiSwitcherPattern(a.switchValue); got != want {
+			t.Errorf("expected attract mode to switch the source to %s, got %s", want, got)
+		}
+		seen[a.Switcher.Current()] = true
+		if controls.SWITCH.Get(midiState) != 0.25 {
+			t.Errorf("the switch control should be left alone, got %v", controls.SWITCH.Get(midiState))
+		}
+		runUntil(a, midiState, &now, now+SWITCH_TIME, 0.1)
+	}
+	if len(seen) < 2 {
+		t.Errorf("expected a few different patterns, got %v", seen)
+	}
+
+	// touching the controller switches back to the original source
+	changed := controls.Update(midiState, nil, []controls.Event{{Control: controls.GAIN, Value: 0.5}})
+	now += 0.1
+	a.Update(midiState, changed, now)
+	if a.Switcher.Current() != "moire" {
+		t.Errorf("expected to switch back to moire, got %s", a.Switcher.Current())
+	}
+
+	// unless someone else has switched the source in the meantime
+	runUntil(a, midiState, &now, now+100, 0.1)
+	if !a.Active() {
+		t.Fatalf("attract mode didn't start again")
+	}
+	if err := a.Switcher.SwitchTo("eye"); err != nil {
+		t.Fatal(err)
+	}
+	changed = controls.Update(midiState, nil, []controls.Event{{Control: controls.GAIN, Value: 0.6}})
+	now += 0.1
+	a.Update(midiState, changed, now)
+	if a.Switcher.Current() != "eye" {
+		t.Errorf("attract mode shouldn't undo someone else's switch, got %s", a.Switcher.Current())
+	}
+}
+
+func TestMidiSwitcherSourceUsesSwitchControl(t *testing.T) {
+	midiState := &midi.MidiState{}
+	controls.SWITCH.Set(midiState, 0.25)
+	a := New(60)
+	a.Switcher = makeSwitcher(t, opc.MIDI_SWITCHER)
+	now := 0.0
+	runUntil(a, midiState, &now, 100, 0.1)
+	if !a.Active() {
+		t.Fatalf("attract mode didn't start")
+	}
+	if a.Switcher.Current() != opc.MIDI_SWITCHER {
+		t.Errorf("the midi-switcher source shouldn't be switched, got %s", a.Switcher.Current())
+	}
+	if controls.SWITCH.Get(midiState) != a.switchValue {
+		t.Errorf("expected the switch control to pick the pattern, got %v", controls.SWITCH.Get(midiState))
+	}
+}
+
+// Run one frame the way the main loop does.
+func mainLoopFrame(a *AttractMode, midiState *midi.MidiState, messages []*midi.MidiMessage, t float64) {
+	changed := controls.Update(midiState, messages, nil)
+	controls.Smooth(midiState, t)
+	a.Update(midiState, changed, t)
+}
+
+func TestAttractModeWithSmoothing(t *testing.T) {
+	mc := controls.LPD8_MAPPING.MidiMappingConfig
+	mc.Knobs = map[string]controls.KnobSettings{"hue": {Smoothing: 0.2}}
+	mm, err := controls.NewMidiMapping(&mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old *controls.MidiMapping) { controls.MIDI_MAPPING = old }(controls.MIDI_MAPPING)
+	controls.MIDI_MAPPING = mm
+
+	midiState := &midi.MidiState{}
+	controls.Reset(midiState)
+	controls.HUE.Set(midiState, 0)
+	a := New(60)
+	now := 0.0
+	dt := 0.025
+	hueKnob := func(value byte) []*midi.MidiMessage {
+		return []*midi.MidiMessage{{Kind: midi.CONTROLLER, Key: config.HUE_KNOB, Value: value}}
+	}
+
+	// while attract mode is off, a smoothed knob should get all the way to where it's turned
+	mainLoopFrame(a, midiState, hueKnob(127), now)
+	for ii := 0; ii < 100; ii++ {
+		now += dt
+		mainLoopFrame(a, midiState, nil, now)
+	}
+	if controls.HUE.Get(midiState) != 1 {
+		t.Fatalf("attract mode got in the way of smoothing: hue is %v", controls.HUE.Get(midiState))
+	}
+
+	// start attract mode, then hand back control by turning the hue knob
+	for now < 100 {
+		now += dt
+		mainLoopFrame(a, midiState, nil, now)
+	}
+	if !a.Active() {
+		t.Fatalf("attract mode didn't start")
+	}
+	now += dt
+	mainLoopFrame(a, midiState, hueKnob(0), now)
+	if a.Active() {
+		t.Fatalf("attract mode didn't stop when the knob was turned")
+	}
+	before := controls.HUE.Get(midiState)
+	for ii := 0; ii < int(GLIDE_TIME/dt)+2; ii++ {
+		now += dt
+		mainLoopFrame(a, midiState, nil, now)
+		after := controls.HUE.Get(midiState)
+		if after > before {
+			t.Fatalf("hue should only move toward the knob, went from %v to %v", before, after)
+		}
+		before = after
+	}
+	if controls.HUE.Get(midiState) != 0 {
+		t.Errorf("hue should end up where the knob is, got %v", controls.HUE.Get(midiState))
+	}
+	if controls.MORPH.Get(midiState) != a.realValues[controls.MORPH] {
+		t.Errorf("morph should have glided back to %v, got %v", a.realValues[controls.MORPH], controls.MORPH.Get(midiState))
+	}
+
+	// and once it's back, other inputs can change the controls
+	now += dt
+	mainLoopFrame(a, midiState, nil, now)
+	controls.Update(midiState, nil, []controls.Event{{Control: controls.MORPH, Value: 0.3}})
+	now += dt
+	controls.Smooth(midiState, now)
+	a.Update(midiState, nil, now)
+	if controls.MORPH.Get(midiState) != 0.3 {
+		t.Errorf("attract mode wrote over morph after handing it back: %v", controls.MORPH.Get(midiState))
+	}
+}
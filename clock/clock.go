@@ -0,0 +1,198 @@
+/*
+Package clock decides what time it is for patterns and effects.
+
+The main loop owns the clock and calls Tick once per frame before any stage starts
+working on that frame, then passes the frame's time and delta to the stages in
+opc.Frame's Time and Delta.  Stages which get Frames read those.  Patterns only get
+bytes, so they call Now and Delta instead, which give the same numbers: like the
+MidiState, the clock is only changed while no stage is holding a frame.  Nothing
+should read the wall clock.
+
+The one exception is a stage which runs its own goroutine out of step with the main
+loop, like the interpolator.  Now and Delta are safe to call from any goroutine, so
+such a stage sees the latest frame's time.
+
+For output to be reproducible with a fixed step clock, stages shouldn't use the
+global random number generator in math/rand either.  Give each stage its own
+rand.Rand with a fixed seed, or seed it from Now (which is the same every run for
+fixed step clocks, and different every run for the realtime clock).
+
+There are three kinds of clocks:
+
+ realtime: follows the wall clock (the default)
+ fixed:    advances by exactly 1/fps each frame, so output is reproducible
+ offline:  like fixed, but the main loop doesn't sleep between frames, so a minute
+           of animation can be rendered as fast as the CPU allows
+
+Example
+
+ clock.Set(clock.NewFixedStepClock(1.0 / 40))
+ for {
+     clock.Tick()
+     t := clock.Now()    // 1000.0, 1000.025, 1000.05, ...
+     dt := clock.Delta() // 0.025 every time
+ }
+*/
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+//================================================================================
+// CONSTANTS
+
+// Names of the kinds of clocks, for use on the command line
+const (
+	REALTIME = "realtime"
+	FIXED    = "fixed"
+	OFFLINE  = "offline"
+)
+
+// Subtracted from the unix time by the realtime clock.  Patterns have always used
+// times of this size, so some of their constants are tuned for it.
+const REALTIME_OFFSET = 9.4e8
+
+// Time of the first frame for fixed step clocks.  Not zero because some
+// patterns treat a previous time of zero as "never".
+const FIXED_START_TIME = 1000.0
+
+//================================================================================
+// CLOCK TYPES
+
+// A Clock reports the time of the current frame in seconds.
+type Clock interface {
+	// Advance to the next frame.
+	Tick()
+	// Time of the current frame in seconds.
+	Now() float64
+	// Seconds between the previous frame and the current one.  Zero before the second Tick.
+	Delta() float64
+}
+
+// Follows the wall clock.
+type RealTimeClock struct {
+	now   float64
+	delta float64
+	ticks int
+}
+
+func NewRealTimeClock() *RealTimeClock {
+	c := &RealTimeClock{}
+	c.now = wallTime()
+	return c
+}
+
+func (c *RealTimeClock) Tick() {
+	now := wallTime()
+	if c.ticks > 0 {
+		c.delta = now - c.now
+	}
+	c.now = now
+	c.ticks += 1
+}
+
+func (c *RealTimeClock) Now() float64   { return c.now }
+func (c *RealTimeClock) Delta() float64 { return c.delta }
+
+// Advances by the same amount every frame, no matter how long the frames actually take.
+type FixedStepClock struct {
+	Step  float64 // seconds per frame
+	now   float64
+	ticks int
+}
+
+func NewFixedStepClock(step float64) *FixedStepClock {
+	return &FixedStepClock{Step: step, now: FIXED_START_TIME}
+}
+
+func (c *FixedStepClock) Tick() {
+	if c.ticks > 0 {
+		c.now += c.Step
+	}
+	c.ticks += 1
+}
+
+func (c *FixedStepClock) Now() float64 { return c.now }
+
+func (c *FixedStepClock) Delta() float64 {
+	if c.ticks < 2 {
+		return 0
+	}
+	return c.Step
+}
+
+//================================================================================
+// THE CURRENT CLOCK
+
+var current Clock = NewRealTimeClock()
+var mutex sync.RWMutex // guards current
+
+// Replace the clock used by Tick, Now, and Delta.
+// Call this before launching any threads that read the time.
+func Set(c Clock) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	current = c
+}
+
+// Is the current clock following the wall clock?
+func IsRealtime() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	_, ok := current.(*RealTimeClock)
+	return ok
+}
+
+// Make a clock by name (REALTIME, FIXED or OFFLINE) for the given frame rate.
+// The fixed step clocks fall back to 40 fps if fps is 0.
+// Returns nil if the name is unknown.
+func MakeClock(name string, fps float64) Clock {
+	if fps <= 0 {
+		fps = 40
+	}
+	switch name {
+	case REALTIME:
+		return NewRealTimeClock()
+	case FIXED, OFFLINE:
+		return NewFixedStepClock(1 / fps)
+	}
+	return nil
+}
+
+// Advance the current clock to the next frame.  Only the main loop should call this.
+func Tick() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	current.Tick()
+}
+
+// Time of the current frame in seconds.
+func Now() float64 {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return current.Now()
+}
+
+// Seconds between the previous frame and the current one.
+func Delta() float64 {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return current.Delta()
+}
+
+// The local date and time a frame time stands for, for things like weekly schedules.
+// For the realtime clock that's the wall clock time of the frame.  Fixed step clocks
+// start at FIXED_START_TIME, which stands for a moment in October 1999, so they see
+// the same dates every run.
+func Date(t float64) time.Time {
+	return time.Unix(0, int64((t+REALTIME_OFFSET)*1e9))
+}
+
+//================================================================================
+// HELPERS
+
+func wallTime() float64 {
+	return float64(time.Now().UnixNano())/1.0e9 - REALTIME_OFFSET
+}
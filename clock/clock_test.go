@@ -0,0 +1,59 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+//================================================================================
+func TestFixedStepClock(t *testing.T) {
+	c := NewFixedStepClock(0.25)
+	c.Tick()
+	if c.Now() != FIXED_START_TIME || c.Delta() != 0 {
+		t.Errorf("first tick: Now() = %v, Delta() = %v, want %v, 0", c.Now(), c.Delta(), FIXED_START_TIME)
+	}
+	for ii := 0; ii < 4; ii++ {
+		c.Tick()
+	}
+	if c.Now() != FIXED_START_TIME+1 || c.Delta() != 0.25 {
+		t.Errorf("fifth tick: Now() = %v, Delta() = %v, want %v, 0.25", c.Now(), c.Delta(), FIXED_START_TIME+1)
+	}
+}
+
+//================================================================================
+func TestRealTimeClock(t *testing.T) {
+	c := NewRealTimeClock()
+	c.Tick()
+	if c.Delta() != 0 {
+		t.Errorf("first tick: Delta() = %v, want 0", c.Delta())
+	}
+	before := c.Now()
+	c.Tick()
+	if c.Now() < before || c.Delta() < 0 {
+		t.Errorf("clock went backwards: %v then %v", before, c.Now())
+	}
+}
+
+//================================================================================
+func TestMakeClock(t *testing.T) {
+	if _, ok := MakeClock(REALTIME, 40).(*RealTimeClock); !ok {
+		t.Errorf("MakeClock(%v) should make a RealTimeClock", REALTIME)
+	}
+	if c, ok := MakeClock(OFFLINE, 50).(*FixedStepClock); !ok || c.Step != 0.02 {
+		t.Errorf("MakeClock(%v, 50) should make a FixedStepClock with step 0.02", OFFLINE)
+	}
+	if MakeClock("sundial", 40) != nil {
+		t.Errorf("MakeClock should return nil for unknown names")
+	}
+}
+
+//================================================================================
+func TestDate(t *testing.T) {
+	if Date(FIXED_START_TIME).Unix() != int64(REALTIME_OFFSET+FIXED_START_TIME) {
+		t.Errorf("Date(%v) = %v", FIXED_START_TIME, Date(FIXED_START_TIME))
+	}
+	wall := wallTime()
+	if d := Date(wall).Sub(time.Now()); d < -time.Second || d > time.Second {
+		t.Errorf("Date of the realtime clock's time should be now, but it's off by %v", d)
+	}
+}
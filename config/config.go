@@ -4,6 +4,8 @@ import (
 	"github.com/longears/pixelslinger/midi"
 )
 
+// which LPD8 pad and knob sets each control (see controls.LPD8_MAPPING)
+
 // midi pads
 const (
 	FLASH_PAD         = midi.LPD8_PAD1
@@ -27,18 +29,9 @@ const (
 	DESAT_KNOB  = midi.LPD8_KNOB7 // effect
 )
 
-// knob starting values before they have been moved
-//  (because the midi hardware only sends us values when the knobs move)
-var DEFAULT_KNOB_VALUES map[byte]byte
-
-func init() {
-	DEFAULT_KNOB_VALUES = map[byte]byte{
-		GAIN_KNOB:   127,
-		EYELID_KNOB: 127,
-		SPEED_KNOB:  63,
-		SWITCH_KNOB: 0,
-		MORPH_KNOB:  0,
-		HUE_KNOB:    0,
-		DESAT_KNOB:  0,
-	}
-}
+// hold both of these pads for a couple of seconds to start MIDI learn mode (see the learn package).
+// they're momentary, so they let go of their controls while the combo is held.
+const (
+	LEARN_PAD_A = midi.LPD8_PAD1
+	LEARN_PAD_B = midi.LPD8_PAD8
+)
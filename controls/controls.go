@@ -0,0 +1,244 @@
+/*
+Package controls gives the knobs and pads names and types, so patterns don't need to
+know which MIDI controller they're plugged into.
+
+Each Control is a float with a range, a boolean, or a trigger.  Their values live in
+MidiState.Controls, which is handed to every thread along with the raw MIDI state.
+Patterns read them by name:
+
+	speed := controls.SPEED.Get(midiState)      // float from SPEED.Min to SPEED.Max
+	if controls.SLOWMO.On(midiState) { ... }     // boolean
+	if controls.BLINK_CIRCLE.Fired(midiState, &seen) {  // trigger; seen is the pattern's own TriggerState
+	    ...
+	}
+
+Inputs write to them through mappings: MIDI_MAPPING says which MIDI controllers and
+keys set which controls, and other inputs (OSC, the remote API, attract mode) send
+Events naming the control directly.  The main loop calls Update once per frame.
+
+To use a different controller, load a mapping file with ReadMidiMapping (see
+mapping.go).  To add a new control, add it to the list below, and to LPD8_MAPPING
+if a knob or pad should set it.
+*/
+package controls
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/longears/pixelslinger/colorutils"
+	"github.com/longears/pixelslinger/midi"
+)
+
+//================================================================================
+// CONTROL TYPE
+
+// Kinds of controls
+const (
+	FLOAT   = "float"   // a value from Min to Max
+	BOOL    = "bool"    // on or off
+	TRIGGER = "trigger" // something that happens at a moment, like a button press
+)
+
+// A named control.
+type Control struct {
+	Name    string
+	Kind    string  // FLOAT, BOOL, or TRIGGER
+	Min     float64 // range of FLOAT controls.  BOOL and TRIGGER controls go from 0 to 1.
+	Max     float64
+	Default float64 // starting value before any input arrives
+	Help    string
+	index   int // into MidiState.Controls
+}
+
+// All the controls in the order they were added
+var CONTROLS = []*Control{}
+
+var controlsByName = map[string]*Control{}
+
+func add(c *Control) *Control {
+	if len(CONTROLS) >= midi.MAX_CONTROLS {
+		panic(fmt.Sprintf("[controls] too many controls; raise midi.MAX_CONTROLS to add %s", c.Name))
+	}
+	c.index = len(CONTROLS)
+	CONTROLS = append(CONTROLS, c)
+	controlsByName[c.Name] = c
+	return c
+}
+
+func newFloat(name string, defaultValue float64, help string) *Control {
+	return add(&Control{Name: name, Kind: FLOAT, Min: 0, Max: 1, Default: defaultValue, Help: help})
+}
+
+func newBool(name string, help string) *Control {
+	return add(&Control{Name: name, Kind: BOOL, Min: 0, Max: 1, Help: help})
+}
+
+func newTrigger(name string, help string) *Control {
+	return add(&Control{Name: name, Kind: TRIGGER, Min: 0, Max: 1, Help: help})
+}
+
+// The controls
+var (
+	// knobs
+	GAIN   = newFloat("gain", 1, "overall brightness (effect)")
+	EYELID = newFloat("eyelid", 1, "how far open the eye is (effect)")
+	SPEED  = newFloat("speed", 63.0/127, "animation speed (diamond, fire, raver-plaid, shield, sunset)")
+	SWITCH = newFloat("switch", 0, "which pattern midi-switcher plays")
+	MORPH  = newFloat("morph", 0, "changes the look of the pattern (diamond, white)")
+	HUE    = newFloat("hue", 0, "color (diamond, fire, white)")
+	DESAT  = newFloat("desat", 0, "desaturation (effect)")
+
+	// pads
+	FLASH         = newFloat("flash", 0, "flash pad, by how hard it's pressed")
+	TWINKLE       = newFloat("twinkle", 0, "strobe twinkle, by how hard the pad is pressed (effect)")
+	FLUSH         = newBool("flush", "flush the potty while held")
+	SLOWMO        = newBool("slowmo", "slow motion while held")
+	BLINK_CIRCLE  = newTrigger("blink-circle", "start a circle of color in the potty")
+	BLINK_ARCH    = newFloat("blink-arch", 0, "light up the arch, by how hard the pad is pressed (effect)")
+	BLINK_BACK    = newFloat("blink-back", 0, "light up the back, by how hard the pad is pressed (effect)")
+	FADE_TO_BLACK = newBool("fade-to-black", "fade to black while held (effect)")
+)
+
+// Find a control by name.  Returns nil if there's no such control.
+func Lookup(name string) *Control {
+	return controlsByName[name]
+}
+
+// The names of the controls of the given kinds (or all of them if none are given), sorted.
+func Names(kinds ...string) []string {
+	names := []string{}
+	for _, c := range CONTROLS {
+		if len(kinds) == 0 || c.isKind(kinds...) {
+			names = append(names, c.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Control) isKind(kinds ...string) bool {
+	for _, kind := range kinds {
+		if c.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+//--------------------------------------------------------------------------------
+// READING
+
+// The value of a FLOAT control, or 0 or 1 for a BOOL.
+// For a TRIGGER this is how many times it has fired.
+func (c *Control) Get(midiState *midi.MidiState) float64 {
+	return midiState.Controls[c.index]
+}
+
+// Is a BOOL control on, or a FLOAT control above its minimum?
+func (c *Control) On(midiState *midi.MidiState) bool {
+	return midiState.Controls[c.index] > c.Min
+}
+
+// What one reader of a TRIGGER has seen so far.  The zero value is ready to use.
+type TriggerState struct {
+	count   float64
+	started bool
+}
+
+// Has a TRIGGER fired since the last time this was called with the same TriggerState?
+// The first call only catches up, so a pattern which starts after a press doesn't see it.
+func (c *Control) Fired(midiState *midi.MidiState, seen *TriggerState) bool {
+	count := midiState.Controls[c.index]
+	fired := seen.started && count != seen.count
+	seen.count, seen.started = count, true
+	return fired
+}
+
+//--------------------------------------------------------------------------------
+// WRITING
+
+// Set a control.  value is clamped to the control's range.
+// For a TRIGGER, any value above 0 fires it.
+func (c *Control) Set(midiState *midi.MidiState, value float64) {
+	switch c.Kind {
+	case TRIGGER:
+		if value > 0 {
+			midiState.Controls[c.index] += 1
+		}
+	case BOOL:
+		if value > 0 {
+			midiState.Controls[c.index] = 1
+		} else {
+			midiState.Controls[c.index] = 0
+		}
+	default:
+		midiState.Controls[c.index] = colorutils.Clamp(value, c.Min, c.Max)
+	}
+}
+
+// Set every control to its default.
+func Reset(midiState *midi.MidiState) {
+	for _, c := range CONTROLS {
+		midiState.Controls[c.index] = c.Default
+	}
+}
+
+// A change to a control from an input other than the MIDI controller.
+// If Midi isn't nil, it's a raw MIDI message instead, which goes through MIDI_MAPPING
+// like one from the controller.
+type Event struct {
+	Control *Control
+	Value   float64 // for FLOAT controls, from Min to Max.  for BOOL and TRIGGER, above 0 is on.
+	Midi    *midi.MidiMessage
+}
+
+// Pull all the available Events out of the channels without blocking.
+// Nil channels are skipped.
+func GetAvailableEvents(eventChans ...chan Event) []Event {
+	var events []Event
+	for _, ch := range eventChans {
+		for len(ch) > 0 {
+			events = append(events, <-ch)
+		}
+	}
+	return events
+}
+
+// Call this once per frame from the main loop.  Applies the MIDI messages and events
+// to midiState: first the raw MIDI state, then the controls through MIDI_MAPPING, then
+// the controls named by events.  Returns the controls which were changed, in order.
+// Buttons in the mapping's learn combo don't set controls while the rest of the combo
+// is held down (see mapping.go).
+func Update(midiState *midi.MidiState, midiMessages []*midi.MidiMessage, events []Event) []*Control {
+	for _, ev := range events {
+		if ev.Midi != nil {
+			midiMessages = append(midiMessages, ev.Midi)
+		}
+	}
+	midiState.UpdateStateFromSlice(midiMessages)
+
+	var changed []*Control
+	for _, m := range midiState.RecentMidiMessages {
+		if MIDI_MAPPING.partOfCombo(midiState, m) {
+			continue
+		}
+		if c, ok := MIDI_MAPPING.apply(midiState, m); ok {
+			changed = append(changed, c)
+		}
+	}
+	changed = append(changed, MIDI_MAPPING.releaseCombo(midiState)...)
+	for _, ev := range events {
+		if ev.Midi == nil && ev.Control != nil {
+			ev.Control.Set(midiState, ev.Value)
+			changed = append(changed, ev.Control)
+		}
+	}
+	return changed
+}
+
+// Call this once per frame from the main loop, right after Update, to move smoothed
+// controls toward their knobs.  t is the frame time.  See knobs.go.
+func Smooth(midiState *midi.MidiState, t float64) {
+	MIDI_MAPPING.smooth(midiState, t)
+}
@@ -0,0 +1,122 @@
+package controls
+
+import (
+	"testing"
+
+	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/midi"
+)
+
+//================================================================================
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		m       *midi.MidiMessage
+		control *Control
+		value   float64
+		ok      bool
+	}{
+		{&midi.MidiMessage{Kind: midi.CONTROLLER, Key: config.HUE_KNOB, Value: 127}, HUE, 1, true},
+		{&midi.MidiMessage{Kind: midi.CONTROLLER, Key: config.HUE_KNOB, Value: 0}, HUE, 0, true},
+		{&midi.MidiMessage{Kind: midi.CONTROLLER, Key: 100, Value: 127}, nil, 0, false},
+		{&midi.MidiMessage{Kind: midi.NOTE_ON, Key: config.TWINKLE_PAD, Value: 127}, TWINKLE, 1, true},
+		{&midi.MidiMessage{Kind: midi.NOTE_OFF, Key: config.TWINKLE_PAD, Value: 64}, TWINKLE, 0, true},
+		{&midi.MidiMessage{Kind: midi.NOTE_ON, Key: config.FLUSH_PAD, Value: 10}, FLUSH, 10.0 / 127, true},
+		{&midi.MidiMessage{Kind: midi.NOTE_OFF, Key: config.FLUSH_PAD, Value: 0}, FLUSH, 0, true},
+		{&midi.MidiMessage{Kind: midi.NOTE_ON, Key: config.BLINK_CIRCLE_PAD, Value: 10}, BLINK_CIRCLE, 10.0 / 127, true},
+		{&midi.MidiMessage{Kind: midi.NOTE_OFF, Key: config.BLINK_CIRCLE_PAD, Value: 0}, nil, 0, false},
+		{&midi.MidiMessage{Kind: midi.PITCH_BEND, Key: config.HUE_KNOB, Value: 10}, nil, 0, false},
+	}
+	for _, test := range tests {
+		c, value, ok := MIDI_MAPPING.Translate(test.m)
+		if c != test.control || value != test.value || ok != test.ok {
+			t.Errorf("%v: expected %v %v %v, got %v %v %v", test.m, test.control, test.value, test.ok, c, value, ok)
+		}
+	}
+}
+
+func TestSetAndRead(t *testing.T) {
+	midiState := &midi.MidiState{}
+	Reset(midiState)
+	if GAIN.Get(midiState) != 1 || HUE.Get(midiState) != 0 {
+		t.Errorf("Reset didn't set the defaults")
+	}
+
+	HUE.Set(midiState, 2)
+	if HUE.Get(midiState) != 1 {
+		t.Errorf("float wasn't clamped: %v", HUE.Get(midiState))
+	}
+	SLOWMO.Set(midiState, 0.3)
+	if !SLOWMO.On(midiState) || SLOWMO.Get(midiState) != 1 {
+		t.Errorf("bool wasn't turned on: %v", SLOWMO.Get(midiState))
+	}
+
+	// each reader of a trigger sees each press once, but not the ones before it started
+	var seen1, seen2 TriggerState
+	BLINK_CIRCLE.Set(midiState, 1)
+	if BLINK_CIRCLE.Fired(midiState, &seen1) {
+		t.Errorf("trigger fired for a press before the reader started")
+	}
+	BLINK_CIRCLE.Set(midiState, 1)
+	BLINK_CIRCLE.Set(midiState, 0)
+	if !BLINK_CIRCLE.Fired(midiState, &seen1) || BLINK_CIRCLE.Fired(midiState, &seen1) {
+		t.Errorf("trigger should fire exactly once per check after a press")
+	}
+	BLINK_CIRCLE.Fired(midiState, &seen2)
+	BLINK_CIRCLE.Set(midiState, 1)
+	if !BLINK_CIRCLE.Fired(midiState, &seen2) || !BLINK_CIRCLE.Fired(midiState, &seen1) {
+		t.Errorf("every reader should see the press")
+	}
+
+	// flush is on only while the pad is held
+	FLUSH.Set(midiState, 1)
+	if !FLUSH.On(midiState) {
+		t.Errorf("flush should be on while held")
+	}
+	FLUSH.Set(midiState, 0)
+	if FLUSH.On(midiState) {
+		t.Errorf("flush should turn off when released")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	midiState := &midi.MidiState{}
+	Reset(midiState)
+	changed := Update(midiState,
+		[]*midi.MidiMessage{{Kind: midi.CONTROLLER, Key: config.SPEED_KNOB, Value: 127}},
+		[]Event{
+			{Control: DESAT, Value: 0.25},
+			{Midi: &midi.MidiMessage{Kind: midi.NOTE_ON, Key: config.SLOWMO_PAD, Value: 100}},
+		})
+	if len(changed) != 3 || changed[0] != SPEED || changed[1] != SLOWMO || changed[2] != DESAT {
+		t.Errorf("unexpected changed controls: %v", changed)
+	}
+	if SPEED.Get(midiState) != 1 || DESAT.Get(midiState) != 0.25 || !SLOWMO.On(midiState) {
+		t.Errorf("controls weren't updated: %v", midiState.Controls)
+	}
+	if midiState.ControllerValues[config.SPEED_KNOB] != 127 || len(midiState.RecentMidiMessages) != 2 {
+		t.Errorf("raw MIDI state wasn't updated")
+	}
+
+	if changed := Update(midiState, nil, nil); len(changed) != 0 {
+		t.Errorf("expected nothing to change, got %v", changed)
+	}
+	if SPEED.Get(midiState) != 1 {
+		t.Errorf("controls should keep their values between messages")
+	}
+}
+
+func TestNames(t *testing.T) {
+	for _, c := range CONTROLS {
+		if Lookup(c.Name) != c {
+			t.Errorf("couldn't look up %s", c.Name)
+		}
+	}
+	if Lookup("nope") != nil {
+		t.Errorf("found a control that doesn't exist")
+	}
+	for _, name := range Names(TRIGGER) {
+		if Lookup(name).Kind != TRIGGER {
+			t.Errorf("%s isn't a trigger", name)
+		}
+	}
+}
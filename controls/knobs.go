@@ -0,0 +1,175 @@
+package controls
+
+// Knobs
+//   A MIDI knob only has 128 positions, so a control which follows it exactly moves in
+//   visible steps.  And after something else changes the control (a restored state
+//   file, attract mode, a scene, the remote control API), the knob is somewhere else,
+//   so touching it would make the control jump.
+//
+//   So float controls set by MIDI controllers can be smoothed, slew limited, and picked
+//   up instead of jumped to, as set by DEFAULT_KNOB_SETTINGS and a mapping file's
+//   "knobs":
+//
+//   "knobs": {
+//       "gain": {"smoothing": 0.1, "takeover": "pickup"},
+//       "hue": {"smoothing": 0.3, "slew": 0.5}
+//   }
+//
+//   "smoothing" is a time constant in seconds: the control gets about 2/3 of the way to
+//   the knob in that time.  "slew" is the most the control can move per second, as a
+//   fraction of its range.  With "takeover": "pickup", a knob does nothing until it
+//   reaches or crosses the control's value; with "jump" the control follows it right
+//   away.  A control listed in "knobs" uses DEFAULT_KNOB_SETTINGS.Takeover if it
+//   doesn't give one, and no smoothing or slew limit unless it gives them.
+//   Pads (keys) are never smoothed.
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/longears/pixelslinger/midi"
+)
+
+// Takeover modes
+const (
+	JUMP   = "jump"   // the control follows the knob as soon as it moves
+	PICKUP = "pickup" // the knob takes over once it reaches or crosses the control's value
+)
+
+var TAKEOVER_MODES = []string{JUMP, PICKUP}
+
+// How close (as a fraction of the control's range) a knob has to come to the control's
+// value to pick it up when nobody has seen where the knob was
+const PICKUP_THRESHOLD = 2.0 / 127
+
+// How a control follows its knob.
+type KnobSettings struct {
+	Smoothing float64 `json:"smoothing,omitempty"` // time constant in seconds, or 0 to follow the knob right away
+	Slew      float64 `json:"slew,omitempty"`      // most the control moves per second as a fraction of its range, or 0 for no limit
+	Takeover  string  `json:"takeover,omitempty"`  // JUMP or PICKUP
+}
+
+// Settings for controls which aren't in the mapping's "knobs".  Set this before the main
+// loop starts (the --knob-smoothing and --takeover flags do).
+var DEFAULT_KNOB_SETTINGS = KnobSettings{Takeover: JUMP}
+
+// What a mapping knows about one control's knob.  Only touched by the main loop.
+type knob struct {
+	position float64 // where the knob was last seen, in the control's range, or NaN
+	target   float64 // where the control is headed
+	written  float64 // the value this last gave the control, or NaN, to notice other inputs changing it
+	moving   bool
+	pickedUp bool
+}
+
+func (s *KnobSettings) check(name string) error {
+	c := Lookup(name)
+	if c == nil || c.Kind != FLOAT {
+		return fmt.Errorf("unknown control \"%s\" in knobs (should be one of %s)", name, strings.Join(Names(FLOAT), ", "))
+	}
+	if s.Smoothing < 0 || s.Slew < 0 {
+		return fmt.Errorf("smoothing and slew for %s can't be negative", name)
+	}
+	if s.Takeover != "" && s.Takeover != JUMP && s.Takeover != PICKUP {
+		return fmt.Errorf("takeover for %s should be %s or %s, got \"%s\"", name, JUMP, PICKUP, s.Takeover)
+	}
+	return nil
+}
+
+// The settings for a control's knob.
+func (mm *MidiMapping) knobSettings(c *Control) KnobSettings {
+	s, ok := mm.Knobs[c.Name]
+	if !ok {
+		return DEFAULT_KNOB_SETTINGS
+	}
+	if s.Takeover == "" {
+		s.Takeover = DEFAULT_KNOB_SETTINGS.Takeover
+	}
+	return s
+}
+
+func (mm *MidiMapping) knob(c *Control) *knob {
+	k := mm.knobs[c]
+	if k == nil {
+		k = &knob{position: math.NaN(), written: math.NaN()}
+		mm.knobs[c] = k
+	}
+	return k
+}
+
+// Apply a MIDI message to the control it's bound to.  Knobs (controllers bound to
+// float controls) go through takeover and smoothing.  Returns the control the message
+// was for, or false if it doesn't set one or the knob hasn't picked up its control yet.
+func (mm *MidiMapping) apply(midiState *midi.MidiState, m *midi.MidiMessage) (*Control, bool) {
+	c, value, ok := mm.Translate(m)
+	if !ok {
+		return nil, false
+	}
+	if m.Kind != midi.CONTROLLER || c.Kind != FLOAT {
+		c.Set(midiState, value)
+		return c, true
+	}
+
+	s := mm.knobSettings(c)
+	k := mm.knob(c)
+	current := c.Get(midiState)
+	if current != k.written {
+		// something else changed the control since this knob did
+		k.moving, k.pickedUp = false, false
+	}
+	lastPosition := k.position
+	k.position = value
+	if s.Takeover == PICKUP && !k.pickedUp {
+		crossed := (lastPosition-current)*(value-current) <= 0 // false if lastPosition is NaN
+		if !crossed && math.Abs(value-current) > PICKUP_THRESHOLD*(c.Max-c.Min) {
+			return nil, false
+		}
+	}
+	k.pickedUp = true
+	if s.Smoothing == 0 && s.Slew == 0 {
+		c.Set(midiState, value)
+		k.written = c.Get(midiState)
+		k.moving = false
+	} else {
+		k.target = value
+		k.written = current
+		k.moving = true
+	}
+	return c, true
+}
+
+// Move smoothed controls toward their knobs.  t is the frame time.
+func (mm *MidiMapping) smooth(midiState *midi.MidiState, t float64) {
+	dt := 0.0
+	if !math.IsNaN(mm.lastTime) {
+		dt = math.Max(0, t-mm.lastTime)
+	}
+	mm.lastTime = t
+	for c, k := range mm.knobs {
+		if !k.moving {
+			continue
+		}
+		current := c.Get(midiState)
+		if current != k.written {
+			k.moving, k.pickedUp = false, false
+			continue
+		}
+		s := mm.knobSettings(c)
+		next := k.target
+		if s.Smoothing > 0 {
+			next = current + (k.target-current)*(1-math.Exp(-dt/s.Smoothing))
+		}
+		if s.Slew > 0 {
+			maxStep := s.Slew * (c.Max - c.Min) * dt
+			next = current + math.Max(-maxStep, math.Min(maxStep, next-current))
+		}
+		// don't creep toward the target forever
+		if math.Abs(k.target-next) < 0.0005*(c.Max-c.Min) {
+			next = k.target
+			k.moving = false
+		}
+		c.Set(midiState, next)
+		k.written = c.Get(midiState)
+	}
+}
@@ -0,0 +1,114 @@
+package controls
+
+import (
+	"math"
+	"testing"
+
+	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/midi"
+)
+
+// Use a fresh LPD8 mapping with the given knob settings.
+func withKnobs(t *testing.T, knobs map[string]KnobSettings) func() {
+	mc := LPD8_MAPPING.MidiMappingConfig
+	mc.Knobs = knobs
+	mm, err := NewMidiMapping(&mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := MIDI_MAPPING
+	MIDI_MAPPING = mm
+	return func() { MIDI_MAPPING = old }
+}
+
+func knobMessage(number, value byte) []*midi.MidiMessage {
+	return []*midi.MidiMessage{{Kind: midi.CONTROLLER, Key: number, Value: value}}
+}
+
+//================================================================================
+func TestSmoothing(t *testing.T) {
+	defer withKnobs(t, map[string]KnobSettings{
+		"hue":  {Smoothing: 0.1},
+		"gain": {Slew: 0.5},
+	})()
+	midiState := &midi.MidiState{}
+	Reset(midiState)
+	Smooth(midiState, 0)
+
+	changed := Update(midiState, append(knobMessage(config.HUE_KNOB, 127), knobMessage(config.GAIN_KNOB, 0)...), nil)
+	if len(changed) != 2 {
+		t.Errorf("turning a smoothed knob should still count as a change, got %v", changed)
+	}
+	Smooth(midiState, 0.1)
+	if math.Abs(HUE.Get(midiState)-(1-math.Exp(-1))) > 1e-9 {
+		t.Errorf("expected hue about 2/3 of the way after one time constant, got %v", HUE.Get(midiState))
+	}
+	if math.Abs(GAIN.Get(midiState)-0.95) > 1e-9 {
+		t.Errorf("expected gain to fall by 0.05 in 0.1 seconds, got %v", GAIN.Get(midiState))
+	}
+	for tm := 0.2; tm < 3; tm += 0.1 {
+		Smooth(midiState, tm)
+	}
+	if HUE.Get(midiState) != 1 || GAIN.Get(midiState) != 0 {
+		t.Errorf("controls should end up at the knobs, got %v %v", HUE.Get(midiState), GAIN.Get(midiState))
+	}
+
+	// something else setting the control stops the smoothing
+	Update(midiState, knobMessage(config.HUE_KNOB, 0), nil)
+	Smooth(midiState, 3.1)
+	Update(midiState, nil, []Event{{Control: HUE, Value: 0.5}})
+	Smooth(midiState, 3.2)
+	if HUE.Get(midiState) != 0.5 {
+		t.Errorf("smoothing should stop when something else sets the control, got %v", HUE.Get(midiState))
+	}
+}
+
+func TestPickup(t *testing.T) {
+	defer withKnobs(t, map[string]KnobSettings{"speed": {Takeover: PICKUP}})()
+	midiState := &midi.MidiState{}
+	Reset(midiState)
+	SPEED.Set(midiState, 0.5)
+	HUE.Set(midiState, 0.5)
+
+	// hue jumps, speed waits for the knob to cross 0.5
+	Update(midiState, append(knobMessage(config.SPEED_KNOB, 10), knobMessage(config.HUE_KNOB, 10)...), nil)
+	if SPEED.Get(midiState) != 0.5 || HUE.Get(midiState) != 10.0/127 {
+		t.Fatalf("expected speed to wait and hue to jump, got %v %v", SPEED.Get(midiState), HUE.Get(midiState))
+	}
+	if changed := Update(midiState, knobMessage(config.SPEED_KNOB, 40), nil); len(changed) != 0 {
+		t.Errorf("a knob which hasn't picked up its control shouldn't change it, got %v", changed)
+	}
+	Update(midiState, knobMessage(config.SPEED_KNOB, 70), nil)
+	if SPEED.Get(midiState) != 70.0/127 {
+		t.Errorf("the knob should take over after crossing, got %v", SPEED.Get(midiState))
+	}
+	Update(midiState, knobMessage(config.SPEED_KNOB, 20), nil)
+	if SPEED.Get(midiState) != 20.0/127 {
+		t.Errorf("the knob should keep control, got %v", SPEED.Get(midiState))
+	}
+
+	// after something else moves the control, the knob has to pick it up again
+	Update(midiState, nil, []Event{{Control: SPEED, Value: 1}})
+	Update(midiState, knobMessage(config.SPEED_KNOB, 30), nil)
+	if SPEED.Get(midiState) != 1 {
+		t.Errorf("the knob shouldn't take over from another input, got %v", SPEED.Get(midiState))
+	}
+	Update(midiState, knobMessage(config.SPEED_KNOB, 126), nil)
+	if SPEED.Get(midiState) != 126.0/127 {
+		t.Errorf("a knob close to the control's value should pick it up, got %v", SPEED.Get(midiState))
+	}
+}
+
+func TestBadKnobs(t *testing.T) {
+	bad := []map[string]KnobSettings{
+		{"nope": {}},
+		{"slowmo": {Smoothing: 1}},
+		{"hue": {Smoothing: -1}},
+		{"hue": {Takeover: "sometimes"}},
+	}
+	for _, knobs := range bad {
+		if _, err := NewMidiMapping(&MidiMappingConfig{Knobs: knobs}); err == nil {
+			t.Errorf("expected an error for %v", knobs)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package controls
+
+// MIDI mappings
+//   A mapping says which MIDI controllers (CCs) and keys (notes) set which controls.
+//   The built-in one is LPD8_MAPPING.  Other controllers get a mapping file:
+//
+//   {
+//       "name": "Korg nanoKONTROL",
+//       "channel": 1,
+//       "bindings": [
+//           {"controller": 2, "control": "gain"},
+//           {"controller": 23, "control": "flush"},
+//           {"key": 36, "control": "flash", "channel": 10}
+//       ],
+//       "learn_combo": [{"controller": 31}, {"controller": 41}]
+//   }
+//
+//   Each binding has exactly one of "controller" or "key", from 0 to 127.  "channel"
+//   is from 1 to 16 like on the controller's display; a binding without one uses the
+//   mapping's channel, and a mapping without one listens on every channel.
+//   Controller values and key velocities are scaled to the control's range.  Bools
+//   are on and triggers fire when the value is above 0, so buttons which send
+//   controllers (127 when pressed, 0 when released) work as pads.
+//   Holding down all the buttons in "learn_combo" at once for a couple of seconds starts
+//   MIDI learn mode (see the learn package), which changes the bindings and saves them
+//   back to the file.  While the rest of the combo is held down, a combo button doesn't
+//   set its control, and when the whole combo goes down its buttons' controls are set as
+//   if they'd been let go, so holding the combo at most flashes whichever button went
+//   down first.
+//   The midimaps directory has mapping files for some common controllers.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+
+	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/midi"
+)
+
+//================================================================================
+// TYPES
+
+// Channels in mapping files go from 1 to 16.  ANY_CHANNEL matches all of them.
+const ANY_CHANNEL = 0
+
+// One line of a mapping file.
+type MidiBinding struct {
+	Controller *int   `json:"controller,omitempty"`
+	Key        *int   `json:"key,omitempty"`
+	Control    string `json:"control,omitempty"` // not used in learn_combo
+	Channel    int    `json:"channel,omitempty"` // 1 to 16, or ANY_CHANNEL for the mapping's channel
+}
+
+// The contents of a mapping file.
+type MidiMappingConfig struct {
+	Name       string                  `json:"name,omitempty"`
+	Channel    int                     `json:"channel,omitempty"` // 1 to 16, or ANY_CHANNEL
+	Bindings   []MidiBinding           `json:"bindings"`
+	LearnCombo []MidiBinding           `json:"learn_combo,omitempty"` // buttons to hold down together to start learn mode
+	Knobs      map[string]KnobSettings `json:"knobs,omitempty"`       // smoothing and takeover by control name (see knobs.go)
+}
+
+// Which MIDI controllers and keys set which controls.  Make one with NewMidiMapping
+// or ReadMidiMapping.
+type MidiMapping struct {
+	MidiMappingConfig
+	Fn string // the file it was read from, or "" for a built-in mapping
+
+	controllers map[byte][]midiTarget // by controller number
+	keys        map[byte][]midiTarget // by key number
+	knobs       map[*Control]*knob
+	lastTime    float64 // of the last smooth, or NaN
+	comboHeld   bool    // at the end of the last Update
+}
+
+// Where one binding goes.
+type midiTarget struct {
+	channel int // 1 to 16, or ANY_CHANNEL
+	control *Control
+}
+
+// The mapping the main loop uses.  Set this before the main loop starts.
+var MIDI_MAPPING = LPD8_MAPPING
+
+// The AKAI LPD8, with the knobs and pads from the config package.
+var LPD8_MAPPING = mustMidiMapping(&MidiMappingConfig{
+	Name:       "AKAI LPD8",
+	LearnCombo: []MidiBinding{keyBinding(config.LEARN_PAD_A, nil), keyBinding(config.LEARN_PAD_B, nil)},
+	Bindings: []MidiBinding{
+		controllerBinding(config.GAIN_KNOB, GAIN),
+		controllerBinding(config.EYELID_KNOB, EYELID),
+		controllerBinding(config.SPEED_KNOB, SPEED),
+		controllerBinding(config.SWITCH_KNOB, SWITCH),
+		controllerBinding(config.MORPH_KNOB, MORPH),
+		controllerBinding(config.HUE_KNOB, HUE),
+		controllerBinding(config.DESAT_KNOB, DESAT),
+		keyBinding(config.FLASH_PAD, FLASH),
+		keyBinding(config.TWINKLE_PAD, TWINKLE),
+		keyBinding(config.FLUSH_PAD, FLUSH),
+		keyBinding(config.SLOWMO_PAD, SLOWMO),
+		keyBinding(config.BLINK_CIRCLE_PAD, BLINK_CIRCLE),
+		keyBinding(config.BLINK_ARCH_PAD, BLINK_ARCH),
+		keyBinding(config.BLINK_BACK_PAD, BLINK_BACK),
+		keyBinding(config.FADE_TO_BLACK_PAD, FADE_TO_BLACK),
+	},
+})
+
+// A binding for a controller or key (and for learn_combo, c is nil).
+func controllerBinding(number byte, c *Control) MidiBinding {
+	n := int(number)
+	b := MidiBinding{Controller: &n}
+	if c != nil {
+		b.Control = c.Name
+	}
+	return b
+}
+
+func keyBinding(number byte, c *Control) MidiBinding {
+	b := controllerBinding(number, c)
+	b.Key, b.Controller = b.Controller, nil
+	return b
+}
+
+func mustMidiMapping(mc *MidiMappingConfig) *MidiMapping {
+	mm, err := NewMidiMapping(mc)
+	if err != nil {
+		panic("[controls] " + err.Error())
+	}
+	return mm
+}
+
+//================================================================================
+// LOADING
+
+// Read a mapping file and validate it.
+func ReadMidiMapping(fn string) (*MidiMapping, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("could not read MIDI mapping file %s: %v", fn, err)
+	}
+	mc := &MidiMappingConfig{}
+	if err := json.Unmarshal(data, mc); err != nil {
+		return nil, fmt.Errorf("could not parse MIDI mapping file %s: %v", fn, err)
+	}
+	mm, err := NewMidiMapping(mc)
+	if err != nil {
+		return nil, fmt.Errorf("bad MIDI mapping file %s: %v", fn, err)
+	}
+	mm.Fn = fn
+	return mm, nil
+}
+
+// Validate a MidiMappingConfig and make a MidiMapping from it.
+func NewMidiMapping(mc *MidiMappingConfig) (*MidiMapping, error) {
+	if mc.Channel < ANY_CHANNEL || mc.Channel > 16 {
+		return nil, fmt.Errorf("channel should be from 1 to 16, got %v", mc.Channel)
+	}
+	mm := &MidiMapping{
+		MidiMappingConfig: *mc,
+		knobs:             make(map[*Control]*knob),
+		lastTime:          math.NaN(),
+	}
+	mm.Bindings = append([]MidiBinding{}, mc.Bindings...)
+	mm.LearnCombo = append([]MidiBinding{}, mc.LearnCombo...)
+	for _, b := range mm.LearnCombo {
+		if _, _, err := b.input(); err != nil {
+			return nil, fmt.Errorf("learn_combo: %v", err)
+		}
+	}
+	if mc.Knobs != nil {
+		mm.Knobs = make(map[string]KnobSettings)
+		for name, settings := range mc.Knobs {
+			if err := settings.check(name); err != nil {
+				return nil, err
+			}
+			mm.Knobs[name] = settings
+		}
+	}
+	if err := mm.index(); err != nil {
+		return nil, err
+	}
+	return mm, nil
+}
+
+// Which controller or key a binding is for.
+func (b *MidiBinding) input() (kind byte, number byte, err error) {
+	var n int
+	switch {
+	case b.Controller != nil && b.Key == nil:
+		kind, n = midi.CONTROLLER, *b.Controller
+	case b.Key != nil && b.Controller == nil:
+		kind, n = midi.NOTE_ON, *b.Key
+	default:
+		return 0, 0, fmt.Errorf("binding for %s should have exactly one of controller or key", b.Control)
+	}
+	if n < 0 || n > 127 {
+		return 0, 0, fmt.Errorf("controller or key for %s should be from 0 to 127, got %v", b.Control, n)
+	}
+	if b.Channel < ANY_CHANNEL || b.Channel > 16 {
+		return 0, 0, fmt.Errorf("channel for %s should be from 1 to 16, got %v", b.Control, b.Channel)
+	}
+	return kind, byte(n), nil
+}
+
+// Check the bindings and build the lookup tables from them.
+func (mm *MidiMapping) index() error {
+	controllers := make(map[byte][]midiTarget)
+	keys := make(map[byte][]midiTarget)
+	for _, b := range mm.Bindings {
+		c := Lookup(b.Control)
+		if c == nil {
+			return fmt.Errorf("unknown control \"%s\" (should be one of %s)", b.Control, strings.Join(Names(), ", "))
+		}
+		kind, number, err := b.input()
+		if err != nil {
+			return err
+		}
+		t := midiTarget{channel: b.Channel, control: c}
+		if t.channel == ANY_CHANNEL {
+			t.channel = mm.Channel
+		}
+		targets := keys
+		if kind == midi.CONTROLLER {
+			targets = controllers
+		}
+		for _, other := range targets[number] {
+			if other.channel == t.channel {
+				return fmt.Errorf("%s and %s are both bound to controller or key %v", other.control.Name, c.Name, number)
+			}
+		}
+		targets[number] = append(targets[number], t)
+	}
+	mm.controllers, mm.keys = controllers, keys
+	return nil
+}
+
+//================================================================================
+// LEARNING
+
+// Make a controller or key (kind is midi.CONTROLLER or midi.NOTE_ON) on a channel (1 to 16, or
+// ANY_CHANNEL for the mapping's channel) the only input for c.  Whatever c and that input
+// were bound to before is dropped.  Only call this from the main loop.
+func (mm *MidiMapping) Bind(c *Control, kind byte, number byte, channel int) error {
+	n := int(number)
+	b := MidiBinding{Control: c.Name, Channel: channel}
+	if kind == midi.CONTROLLER {
+		b.Controller = &n
+	} else {
+		b.Key = &n
+	}
+	if _, _, err := b.input(); err != nil {
+		return err
+	}
+	effective := func(ch int) int {
+		if ch == ANY_CHANNEL {
+			return mm.Channel
+		}
+		return ch
+	}
+	bindings := []MidiBinding{}
+	for _, other := range mm.Bindings {
+		otherKind, otherNumber, _ := other.input()
+		sameInput := otherKind == kind && otherNumber == number && effective(other.Channel) == effective(channel)
+		if other.Control != c.Name && !sameInput {
+			bindings = append(bindings, other)
+		}
+	}
+	mm.Bindings = append(bindings, b)
+	return mm.index()
+}
+
+// Are all the buttons in the learn combo held down?
+func (mm *MidiMapping) ComboHeld(midiState *midi.MidiState) bool {
+	return len(mm.LearnCombo) > 0 && mm.comboHeldExcept(midiState, nil)
+}
+
+// Are all the buttons in the learn combo held down, other than the one m is from?
+// m may be nil.
+func (mm *MidiMapping) comboHeldExcept(midiState *midi.MidiState, m *midi.MidiMessage) bool {
+	for _, b := range mm.LearnCombo {
+		if m != nil && b.matches(m) {
+			continue
+		}
+		kind, number, _ := b.input()
+		if kind == midi.CONTROLLER && midiState.ControllerValues[number] == 0 {
+			return false
+		}
+		if kind == midi.NOTE_ON && midiState.KeyVolumes[number] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Is the message from one of the buttons in the learn combo?
+func (mm *MidiMapping) InCombo(m *midi.MidiMessage) bool {
+	for _, b := range mm.LearnCombo {
+		if b.matches(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Is the message from this binding's controller or key?
+func (b *MidiBinding) matches(m *midi.MidiMessage) bool {
+	kind, number, _ := b.input()
+	return number == m.Key && (kind == m.Kind || kind == midi.NOTE_ON && m.Kind == midi.NOTE_OFF)
+}
+
+// Should this message be kept from the controls because it's part of holding down the combo?
+func (mm *MidiMapping) partOfCombo(midiState *midi.MidiState, m *midi.MidiMessage) bool {
+	return mm.InCombo(m) && len(mm.LearnCombo) > 1 && mm.comboHeldExcept(midiState, m)
+}
+
+// If the whole combo just went down, set its buttons' controls as if they'd been let go,
+// since one of them went down before the rest.  Returns the controls it changed.
+func (mm *MidiMapping) releaseCombo(midiState *midi.MidiState) []*Control {
+	held := mm.ComboHeld(midiState)
+	justHeld := held && !mm.comboHeld
+	mm.comboHeld = held
+	if !justHeld {
+		return nil
+	}
+	var changed []*Control
+	for _, b := range mm.LearnCombo {
+		kind, number, _ := b.input()
+		channel := b.Channel
+		if channel == ANY_CHANNEL {
+			channel = mm.Channel
+		}
+		if channel == ANY_CHANNEL {
+			channel = 1
+		}
+		release := &midi.MidiMessage{Kind: kind, Channel: byte(channel - 1), Key: number}
+		if c, value, ok := mm.Translate(release); ok && c.Get(midiState) != value {
+			c.Set(midiState, value)
+			changed = append(changed, c)
+		}
+	}
+	return changed
+}
+
+//================================================================================
+// TRANSLATING
+
+// Which control a MIDI message sets, and to what.  ok is false if the message
+// doesn't set a control.  Controller values and key velocities from 0 to 127 are
+// scaled to the control's range; a released key is 0.  Releasing a key doesn't
+// fire a TRIGGER.  A binding for the message's channel wins over one for any channel.
+func (mm *MidiMapping) Translate(m *midi.MidiMessage) (c *Control, value float64, ok bool) {
+	var targets []midiTarget
+	switch m.Kind {
+	case midi.CONTROLLER:
+		targets = mm.controllers[m.Key]
+	case midi.NOTE_ON, midi.NOTE_OFF:
+		targets = mm.keys[m.Key]
+	}
+	for _, t := range targets {
+		if t.channel == int(m.Channel)+1 {
+			c = t.control
+			break
+		}
+		if t.channel == ANY_CHANNEL {
+			c = t.control
+		}
+	}
+	if c == nil {
+		return nil, 0, false
+	}
+	amount := float64(m.Value) / 127
+	if m.Kind == midi.NOTE_OFF {
+		amount = 0
+	}
+	if c.Kind == TRIGGER && amount == 0 {
+		return nil, 0, false
+	}
+	return c, c.Min + amount*(c.Max-c.Min), true
+}
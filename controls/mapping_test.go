@@ -0,0 +1,167 @@
+package controls
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/midi"
+)
+
+//================================================================================
+func TestMidiMappingChannels(t *testing.T) {
+	two, twenty := 2, 20
+	mm, err := NewMidiMapping(&MidiMappingConfig{
+		Channel: 2,
+		Bindings: []MidiBinding{
+			{Control: "gain", Controller: &twenty},
+			{Control: "hue", Controller: &twenty, Channel: 10},
+			{Control: "flush", Key: &two},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		m       *midi.MidiMessage
+		control *Control
+	}{
+		{&midi.MidiMessage{Kind: midi.CONTROLLER, Channel: 1, Key: 20, Value: 127}, GAIN},
+		{&midi.MidiMessage{Kind: midi.CONTROLLER, Channel: 9, Key: 20, Value: 127}, HUE},
+		{&midi.MidiMessage{Kind: midi.CONTROLLER, Channel: 0, Key: 20, Value: 127}, nil},
+		{&midi.MidiMessage{Kind: midi.NOTE_ON, Channel: 1, Key: 2, Value: 127}, FLUSH},
+		{&midi.MidiMessage{Kind: midi.CONTROLLER, Channel: 1, Key: 2, Value: 127}, nil},
+	}
+	for _, test := range tests {
+		if c, _, _ := mm.Translate(test.m); c != test.control {
+			t.Errorf("%v: expected %v, got %v", test.m, test.control, c)
+		}
+	}
+
+	anyChannel, err := NewMidiMapping(&MidiMappingConfig{Bindings: []MidiBinding{
+		{Control: "gain", Controller: &twenty},
+		{Control: "hue", Controller: &twenty, Channel: 3},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _, _ := anyChannel.Translate(&midi.MidiMessage{Kind: midi.CONTROLLER, Channel: 2, Key: 20}); c != HUE {
+		t.Errorf("a binding for the message's channel should win, got %v", c)
+	}
+	if c, _, _ := anyChannel.Translate(&midi.MidiMessage{Kind: midi.CONTROLLER, Channel: 15, Key: 20}); c != GAIN {
+		t.Errorf("expected gain on any other channel, got %v", c)
+	}
+}
+
+func TestBadMidiMappings(t *testing.T) {
+	one, big := 1, 128
+	bad := []*MidiMappingConfig{
+		{Channel: 17},
+		{Bindings: []MidiBinding{{Control: "nope", Controller: &one}}},
+		{Bindings: []MidiBinding{{Control: "gain"}}},
+		{Bindings: []MidiBinding{{Control: "gain", Controller: &one, Key: &one}}},
+		{Bindings: []MidiBinding{{Control: "gain", Controller: &big}}},
+		{Bindings: []MidiBinding{{Control: "gain", Controller: &one, Channel: -1}}},
+		{Bindings: []MidiBinding{{Control: "gain", Controller: &one}, {Control: "hue", Controller: &one}}},
+	}
+	for _, mc := range bad {
+		if _, err := NewMidiMapping(mc); err == nil {
+			t.Errorf("expected an error for %+v", mc)
+		}
+	}
+}
+
+// Holding the learn combo shouldn't fire the effects its pads are bound to.
+func TestLearnComboIsKeptFromControls(t *testing.T) {
+	defer func(old *MidiMapping) { MIDI_MAPPING = old }(MIDI_MAPPING)
+	MIDI_MAPPING = mustMidiMapping(&LPD8_MAPPING.MidiMappingConfig)
+	midiState := &midi.MidiState{}
+	Reset(midiState)
+	press := func(key byte) []*midi.MidiMessage {
+		return []*midi.MidiMessage{{Kind: midi.NOTE_ON, Key: key, Value: 127}}
+	}
+	release := func(key byte) []*midi.MidiMessage {
+		return []*midi.MidiMessage{{Kind: midi.NOTE_OFF, Key: key, Value: 127}}
+	}
+	padA, _, _ := MIDI_MAPPING.Translate(press(config.LEARN_PAD_A)[0])
+	padB, _, _ := MIDI_MAPPING.Translate(press(config.LEARN_PAD_B)[0])
+	if padA == nil || padB == nil {
+		t.Fatal("expected both of the combo's pads to set controls")
+	}
+	check := func(step string, a, b float64) {
+		if padA.Get(midiState) != a || padB.Get(midiState) != b {
+			t.Errorf("%s: expected %s %v and %s %v, got %v and %v", step, padA.Name, a, padB.Name, b, padA.Get(midiState), padB.Get(midiState))
+		}
+	}
+
+	// the first pad does its usual thing until the second one goes down
+	Update(midiState, press(config.LEARN_PAD_A), nil)
+	check("first pad", 1, 0)
+	Update(midiState, press(config.LEARN_PAD_B), nil)
+	check("whole combo", 0, 0)
+	Update(midiState, release(config.LEARN_PAD_A), nil)
+	Update(midiState, release(config.LEARN_PAD_B), nil)
+	check("let go", 0, 0)
+
+	// the other way around
+	Update(midiState, press(config.LEARN_PAD_B), nil)
+	check("first pad", 0, 1)
+	if changed := Update(midiState, press(config.LEARN_PAD_A), nil); len(changed) != 1 || changed[0] != padB {
+		t.Errorf("only %s should change when the combo goes down, got %v", padB.Name, changed)
+	}
+	check("whole combo", 0, 0)
+	Update(midiState, release(config.LEARN_PAD_B), nil)
+	Update(midiState, release(config.LEARN_PAD_A), nil)
+	check("let go", 0, 0)
+
+	// one pad by itself still works
+	Update(midiState, press(config.LEARN_PAD_B), nil)
+	check("one pad", 0, 1)
+}
+
+// The mapping files in midimaps should all load, bind every control, and have a learn combo,
+// and lpd8.json should match the built-in mapping.
+func TestMidiMappingFiles(t *testing.T) {
+	fns, _ := filepath.Glob("../midimaps/*.json")
+	if len(fns) == 0 {
+		t.Fatal("no mapping files found")
+	}
+	for _, fn := range fns {
+		mm, err := ReadMidiMapping(fn)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		bound := map[*Control]bool{}
+		for _, kind := range []byte{midi.CONTROLLER, midi.NOTE_ON} {
+			for number := 0; number < 128; number++ {
+				c, _, _ := mm.Translate(&midi.MidiMessage{Kind: kind, Key: byte(number), Value: 100})
+				bound[c] = true
+			}
+		}
+		for _, name := range Names() {
+			if !bound[Lookup(name)] {
+				t.Errorf("%s doesn't bind %s", fn, name)
+			}
+		}
+		if len(mm.LearnCombo) == 0 {
+			t.Errorf("%s has no learn_combo", fn)
+		}
+		if filepath.Base(fn) != "lpd8.json" {
+			continue
+		}
+		for _, kind := range []byte{midi.CONTROLLER, midi.NOTE_ON} {
+			for number := 0; number < 128; number++ {
+				m := &midi.MidiMessage{Kind: kind, Key: byte(number), Value: 100}
+				c1, _, _ := LPD8_MAPPING.Translate(m)
+				c2, _, _ := mm.Translate(m)
+				if c1 != c2 {
+					t.Errorf("lpd8.json doesn't match LPD8_MAPPING for %v: %v vs %v", m, c2, c1)
+				}
+			}
+		}
+	}
+	if _, err := ReadMidiMapping("../midimaps/nope.json"); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
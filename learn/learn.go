@@ -0,0 +1,259 @@
+/*
+Package learn rebinds the MIDI controller's knobs and pads while pixelslinger runs,
+so changing which knob sets which control doesn't need a rebuild.
+
+Learn mode starts either from the controller, by holding down the mapping's learn
+combo (pads 1 and 8 on the LPD8) for COMBO_HOLD_TIME seconds, or from the remote
+control API.  While the combo is held, its pads don't fire their effects (see the
+controls package).  Then:
+
+ 1. Pick the control to rebind.  On the controller, touch the knob or pad which sets
+    it now.  The API names the control, which skips this step.
+ 2. Move the new knob or press the new pad.  It becomes the only input for that
+    control, and whatever it used to set is unbound.
+
+The new binding takes effect right away in controls.MIDI_MAPPING and is written to
+the mapping's file (--midi-map).  Learn mode gives up after TIMEOUT seconds.
+
+Only the main loop changes the mapping: Start and Cancel queue requests which Update
+carries out between frames.
+*/
+package learn
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+	"github.com/longears/pixelslinger/persist"
+)
+
+// How long learn mode waits for a knob or pad, in seconds
+const TIMEOUT = 30.0
+
+// How long the learn combo has to be held down to start learn mode, in seconds
+const COMBO_HOLD_TIME = 2.0
+
+//================================================================================
+// TYPES
+
+// Runs learn mode.  Make one with New.
+type Learner struct {
+	mutex   sync.Mutex
+	active  bool
+	control *controls.Control // nil until one has been picked
+
+	requests  chan request
+	writes    chan fileWrite // holds at most one mapping file which hasn't been written yet
+	done      chan bool
+	startTime float64
+	picked    *input // the input which picked the control, so turning it more isn't learned
+	comboHeld bool
+	comboTime float64 // when the combo went down
+	comboUsed bool    // learn mode has started since the combo went down
+}
+
+type request struct {
+	cancel  bool
+	control *controls.Control // may be nil
+}
+
+type fileWrite struct {
+	fn   string
+	data []byte
+}
+
+// A MIDI controller or key on a channel.
+type input struct {
+	kind    byte // midi.CONTROLLER or midi.NOTE_ON
+	number  byte
+	channel byte
+}
+
+func inputOf(m *midi.MidiMessage) *input {
+	kind := m.Kind
+	if kind == midi.NOTE_OFF {
+		kind = midi.NOTE_ON
+	}
+	return &input{kind: kind, number: m.Key, channel: m.Channel}
+}
+
+// Make a Learner and start its file writer goroutine.
+func New() *Learner {
+	l := &Learner{
+		requests: make(chan request, 100),
+		writes:   make(chan fileWrite, 1),
+		done:     make(chan bool),
+	}
+	go l.writerThread()
+	return l
+}
+
+// Wait for the last mapping file to be written.  Don't use the Learner afterwards.
+func (l *Learner) Close() {
+	close(l.writes)
+	<-l.done
+}
+
+//================================================================================
+// REQUESTS FROM ANY GOROUTINE
+
+// Start learn mode on the next frame.  If c isn't nil, the next knob or pad is bound
+// to it; otherwise the control is picked from the controller.
+func (l *Learner) Start(c *controls.Control) error {
+	return l.queue(request{control: c})
+}
+
+// Leave learn mode on the next frame without changing anything.
+func (l *Learner) Cancel() error {
+	return l.queue(request{cancel: true})
+}
+
+func (l *Learner) queue(req request) error {
+	select {
+	case l.requests <- req:
+		return nil
+	default:
+		return fmt.Errorf("too many learn requests waiting for the main loop")
+	}
+}
+
+// Is learn mode on, and for which control?  c is nil until one has been picked.
+func (l *Learner) Status() (learning bool, c *controls.Control) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.active, l.control
+}
+
+func (l *Learner) set(active bool, c *controls.Control) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.active, l.control = active, c
+}
+
+//================================================================================
+// MAIN LOOP
+
+// Call this once per frame from the main loop, after controls.Update.  Watches
+// midiState.RecentMidiMessages for the learn combo and for the knob or pad to learn.
+// t is the frame time.
+func (l *Learner) Update(midiState *midi.MidiState, t float64) {
+	mm := controls.MIDI_MAPPING
+	messages := midiState.RecentMidiMessages
+
+	for len(l.requests) > 0 {
+		req := <-l.requests
+		if req.cancel {
+			if active, _ := l.Status(); active {
+				fmt.Println("[learn] cancelled")
+			}
+			l.set(false, nil)
+			continue
+		}
+		l.start(req.control, t)
+	}
+
+	held := mm.ComboHeld(midiState)
+	if held && !l.comboHeld {
+		l.comboTime = t
+		l.comboUsed = false
+	}
+	l.comboHeld = held
+	if held && !l.comboUsed && t-l.comboTime >= COMBO_HOLD_TIME {
+		l.comboUsed = true
+		l.start(nil, t)
+	}
+
+	active, c := l.Status()
+	if !active {
+		return
+	}
+	if t-l.startTime > TIMEOUT {
+		fmt.Println("[learn] timed out")
+		l.set(false, nil)
+		return
+	}
+	for _, m := range messages {
+		if m.Kind != midi.CONTROLLER && (m.Kind != midi.NOTE_ON || m.Value == 0) {
+			continue
+		}
+		if mm.InCombo(m) && l.comboHeld {
+			continue
+		}
+		in := inputOf(m)
+		if c == nil {
+			var ok bool
+			c, _, ok = mm.Translate(m)
+			if !ok {
+				fmt.Println("[learn] that isn't bound to a control yet.  touch a knob or pad which is, or pick a control with the remote control API.")
+				continue
+			}
+			fmt.Printf("[learn] learning %s.  now move the new knob or press the new pad.\n", c.Name)
+			l.picked = in
+			l.set(true, c)
+			continue
+		}
+		if l.picked != nil && *in == *l.picked {
+			continue
+		}
+		l.bind(mm, c, in)
+		return
+	}
+}
+
+func (l *Learner) start(c *controls.Control, t float64) {
+	l.startTime = t
+	l.picked = nil
+	l.set(true, c)
+	if c == nil {
+		fmt.Println("[learn] learn mode.  touch the knob or pad for the control to change.")
+	} else {
+		fmt.Printf("[learn] learning %s.  move the new knob or press the new pad.\n", c.Name)
+	}
+}
+
+// Bind the input to c, save the mapping, and leave learn mode.
+func (l *Learner) bind(mm *controls.MidiMapping, c *controls.Control, in *input) {
+	l.set(false, nil)
+	// a binding on the mapping's own channel doesn't need to say so
+	channel := int(in.channel) + 1
+	if mm.Channel == controls.ANY_CHANNEL || mm.Channel == channel {
+		channel = controls.ANY_CHANNEL
+	}
+	if err := mm.Bind(c, in.kind, in.number, channel); err != nil {
+		fmt.Println("[learn]", err)
+		return
+	}
+	what := "controller"
+	if in.kind == midi.NOTE_ON {
+		what = "key"
+	}
+	fmt.Printf("[learn] %s %v (channel %v) now sets %s\n", what, in.number, in.channel+1, c.Name)
+
+	if mm.Fn == "" {
+		fmt.Println("[learn] warning: not saving the binding since there's no --midi-map file")
+		return
+	}
+	data, err := json.MarshalIndent(mm.MidiMappingConfig, "", "    ")
+	if err != nil {
+		fmt.Println("[learn]", err)
+		return
+	}
+	// only the newest version of the file matters, so replace one that hasn't been written yet
+	select {
+	case <-l.writes:
+	default:
+	}
+	l.writes <- fileWrite{mm.Fn, append(data, '\n')}
+}
+
+func (l *Learner) writerThread() {
+	for w := range l.writes {
+		if err := persist.WriteFileAtomic(w.fn, w.data); err != nil {
+			fmt.Println("[learn]", err)
+		}
+	}
+	close(l.done)
+}
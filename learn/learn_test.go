@@ -0,0 +1,128 @@
+package learn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+)
+
+func cc(number, value byte) *midi.MidiMessage {
+	return &midi.MidiMessage{Kind: midi.CONTROLLER, Key: number, Value: value}
+}
+
+func noteOn(number byte) *midi.MidiMessage {
+	return &midi.MidiMessage{Kind: midi.NOTE_ON, Key: number, Value: 100}
+}
+
+// Use a fresh copy of the LPD8 mapping which saves to a temp file.
+func setup(t *testing.T) (fn string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "learn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm, err := controls.NewMidiMapping(&controls.LPD8_MAPPING.MidiMappingConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm.Fn = filepath.Join(dir, "mapping.json")
+	old := controls.MIDI_MAPPING
+	controls.MIDI_MAPPING = mm
+	return mm.Fn, func() {
+		controls.MIDI_MAPPING = old
+		os.RemoveAll(dir)
+	}
+}
+
+func translate(m *midi.MidiMessage) *controls.Control {
+	c, _, _ := controls.MIDI_MAPPING.Translate(m)
+	return c
+}
+
+//================================================================================
+func TestLearnFromController(t *testing.T) {
+	fn, cleanup := setup(t)
+	defer cleanup()
+	l := New()
+	midiState := &midi.MidiState{}
+	update := func(tm float64, messages ...*midi.MidiMessage) {
+		controls.Update(midiState, messages, nil)
+		l.Update(midiState, tm)
+	}
+
+	// hold the combo
+	update(0, noteOn(config.LEARN_PAD_A))
+	if learning, _ := l.Status(); learning {
+		t.Fatalf("one pad isn't the combo")
+	}
+	update(1, noteOn(config.LEARN_PAD_B))
+	if learning, _ := l.Status(); learning {
+		t.Fatalf("learn mode shouldn't start until the combo has been held for a while")
+	}
+	update(1 + COMBO_HOLD_TIME)
+	if learning, c := l.Status(); !learning || c != nil {
+		t.Fatalf("expected learn mode without a control, got %v %v", learning, c)
+	}
+	update(2+COMBO_HOLD_TIME, &midi.MidiMessage{Kind: midi.NOTE_OFF, Key: config.LEARN_PAD_A}, &midi.MidiMessage{Kind: midi.NOTE_OFF, Key: config.LEARN_PAD_B})
+
+	// pick hue by turning its knob, then turn knob 8
+	update(5, cc(config.HUE_KNOB, 10), cc(config.HUE_KNOB, 11))
+	if _, c := l.Status(); c != controls.HUE {
+		t.Fatalf("expected to pick hue, got %v", c)
+	}
+	update(6, cc(config.HUE_KNOB, 12), cc(midi.LPD8_KNOB8, 50))
+	if learning, _ := l.Status(); learning {
+		t.Errorf("learn mode should end after a binding")
+	}
+	if translate(cc(midi.LPD8_KNOB8, 1)) != controls.HUE || translate(cc(config.HUE_KNOB, 1)) != nil {
+		t.Errorf("knob 8 should set hue instead of knob 6")
+	}
+	l.Close()
+
+	mm, err := controls.ReadMidiMapping(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _, _ := mm.Translate(cc(midi.LPD8_KNOB8, 1)); c != controls.HUE {
+		t.Errorf("the binding wasn't saved")
+	}
+}
+
+func TestLearnFromAPI(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+	l := New()
+	defer l.Close()
+	midiState := &midi.MidiState{}
+	update := func(tm float64, messages ...*midi.MidiMessage) {
+		controls.Update(midiState, messages, nil)
+		l.Update(midiState, tm)
+	}
+
+	// a key bound to something else moves to flush
+	l.Start(controls.FLUSH)
+	update(0)
+	if learning, c := l.Status(); !learning || c != controls.FLUSH {
+		t.Fatalf("expected to learn flush, got %v %v", learning, c)
+	}
+	update(1, &midi.MidiMessage{Kind: midi.NOTE_ON, Channel: 3, Key: config.SLOWMO_PAD, Value: 1})
+	if translate(noteOn(config.SLOWMO_PAD)) != controls.FLUSH || translate(noteOn(config.FLUSH_PAD)) != nil {
+		t.Errorf("the slowmo pad should fire flush now")
+	}
+
+	// cancelling and timing out change nothing
+	l.Start(nil)
+	update(2)
+	l.Cancel()
+	update(3, cc(config.GAIN_KNOB, 1))
+	l.Start(controls.GAIN)
+	update(4)
+	update(4+TIMEOUT+1, cc(20, 1))
+	if learning, _ := l.Status(); learning || translate(cc(20, 1)) != nil {
+		t.Errorf("learn mode should have timed out")
+	}
+}
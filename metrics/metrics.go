@@ -0,0 +1,216 @@
+/*
+Package metrics keeps counters and gauges about how pixelslinger is doing and
+serves them over HTTP.
+
+Two views of the same numbers are available once Serve has been called:
+
+	/metrics     Prometheus text format, for graphing
+	/debug/vars  expvar JSON, for poking at with curl
+
+Each metric can have one label (for example "stage" or "dest").  Metrics without a
+label use the empty string as their label value.
+
+Example
+
+	metrics.Serve(":9100")
+	metrics.FRAMES_TOTAL.Add("", 1)
+	metrics.ObserveStage("source", 0.012)
+*/
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//================================================================================
+// METRIC TYPE
+
+// Kinds of metrics, using the Prometheus names
+const (
+	COUNTER = "counter"
+	GAUGE   = "gauge"
+)
+
+// A counter or gauge with at most one label.
+// Safe to use from any goroutine.
+type Metric struct {
+	Name  string
+	Help  string
+	Kind  string // COUNTER or GAUGE
+	Label string // name of the label, or "" for an unlabeled metric
+
+	mutex  sync.Mutex
+	values map[string]float64 // label value -> metric value
+}
+
+var registryMutex sync.Mutex
+var registry = make([]*Metric, 0)
+
+func newMetric(name, help, kind, label string) *Metric {
+	m := &Metric{Name: name, Help: help, Kind: kind, Label: label, values: make(map[string]float64)}
+	registryMutex.Lock()
+	registry = append(registry, m)
+	registryMutex.Unlock()
+	return m
+}
+
+// Make and register a counter, which should only go up.
+func NewCounter(name, help, label string) *Metric {
+	return newMetric(name, help, COUNTER, label)
+}
+
+// Make and register a gauge, which can go up and down.
+func NewGauge(name, help, label string) *Metric {
+	return newMetric(name, help, GAUGE, label)
+}
+
+// Add delta to the value for the given label value.
+func (m *Metric) Add(labelValue string, delta float64) {
+	m.mutex.Lock()
+	m.values[labelValue] += delta
+	m.mutex.Unlock()
+}
+
+// Set the value for the given label value.
+func (m *Metric) Set(labelValue string, value float64) {
+	m.mutex.Lock()
+	m.values[labelValue] = value
+	m.mutex.Unlock()
+}
+
+// Get the value for the given label value.  Returns 0 if it has never been set.
+func (m *Metric) Get(labelValue string) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.values[labelValue]
+}
+
+// Return a copy of all the values, sorted by label value.
+func (m *Metric) snapshot() (labelValues []string, values []float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for labelValue := range m.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+	for _, labelValue := range labelValues {
+		values = append(values, m.values[labelValue])
+	}
+	return
+}
+
+//================================================================================
+// PIXELSLINGER'S METRICS
+
+var (
+	STAGE_SECONDS      = NewCounter("pixelslinger_stage_seconds_total", "Time spent rendering frames in each pipeline stage.", "stage")
+	STAGE_FRAMES       = NewCounter("pixelslinger_stage_frames_total", "Frames rendered by each pipeline stage.", "stage")
+	STAGE_LAST_SECONDS = NewGauge("pixelslinger_stage_last_seconds", "Render time of the most recent frame in each pipeline stage.", "stage")
+	FRAMES_TOTAL       = NewCounter("pixelslinger_frames_total", "Frames produced by the main loop.", "")
+	FRAMES_DROPPED     = NewCounter("pixelslinger_frames_dropped_total", "Frames which were late, rejected, or could not be sent.", "reason")
+	OPC_CLIENTS        = NewGauge("pixelslinger_opc_clients", "OPC clients connected to the OPC server source.", "")
+	MIDI_MESSAGES      = NewCounter("pixelslinger_midi_messages_total", "MIDI messages received.", "")
+	MIDI_RATE          = NewGauge("pixelslinger_midi_messages_per_second", "MIDI messages received during the last second.", "")
+	DEST_RECONNECTS    = NewCounter("pixelslinger_dest_reconnects_total", "Times each destination had to reconnect.", "dest")
+)
+
+// Record how long one frame took in one pipeline stage.
+func ObserveStage(stage string, seconds float64) {
+	STAGE_SECONDS.Add(stage, seconds)
+	STAGE_FRAMES.Add(stage, 1)
+	STAGE_LAST_SECONDS.Set(stage, seconds)
+}
+
+//================================================================================
+// OUTPUT
+
+// Write all the metrics in the Prometheus text exposition format.
+func WritePrometheus(w io.Writer) {
+	registryMutex.Lock()
+	metrics := append([]*Metric{}, registry...)
+	registryMutex.Unlock()
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.Name, m.Help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.Name, m.Kind)
+		labelValues, values := m.snapshot()
+		if m.Label == "" && len(values) == 0 {
+			// unlabeled metrics are always shown, even before they've been touched
+			labelValues, values = []string{""}, []float64{0}
+		}
+		for ii, labelValue := range labelValues {
+			if m.Label == "" {
+				fmt.Fprintf(w, "%s %v\n", m.Name, values[ii])
+			} else {
+				fmt.Fprintf(w, "%s{%s=\"%s\"} %v\n", m.Name, m.Label, escapeLabelValue(labelValue), values[ii])
+			}
+		}
+	}
+}
+
+// Return all the metrics as a map suitable for turning into JSON.
+// Unlabeled metrics map to a number, labeled ones map to a map from label value to number.
+func Snapshot() map[string]interface{} {
+	registryMutex.Lock()
+	metrics := append([]*Metric{}, registry...)
+	registryMutex.Unlock()
+
+	result := make(map[string]interface{})
+	for _, m := range metrics {
+		labelValues, values := m.snapshot()
+		if m.Label == "" {
+			result[m.Name] = m.Get("")
+			continue
+		}
+		byLabel := make(map[string]float64)
+		for ii, labelValue := range labelValues {
+			byLabel[labelValue] = values[ii]
+		}
+		result[m.Name] = byLabel
+	}
+	return result
+}
+
+func escapeLabelValue(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return s
+}
+
+//================================================================================
+// HTTP
+
+func init() {
+	expvar.Publish("pixelslinger", expvar.Func(func() interface{} { return Snapshot() }))
+}
+
+// Make a handler which serves /metrics and /debug/vars, and nothing else.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WritePrometheus(w)
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// Start an HTTP server on addr (such as ":9100") in its own goroutine.
+// It only serves Handler, not http.DefaultServeMux.
+// If the server can't start, print the error and carry on without it.
+func Serve(addr string) {
+	fmt.Println("[metrics] serving /metrics and /debug/vars on", addr)
+	handler := Handler()
+	go func() {
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			fmt.Println("[metrics] HTTP server stopped:", err)
+		}
+	}()
+}
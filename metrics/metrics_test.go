@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// ================================================================================
+func TestMetric(t *testing.T) {
+	m := NewCounter("test_things_total", "Things.", "kind")
+	m.Add("a", 1)
+	m.Add("a", 2)
+	m.Set("b", 5)
+	if m.Get("a") != 3 || m.Get("b") != 5 || m.Get("c") != 0 {
+		t.Errorf("got a=%v b=%v c=%v, want 3 5 0", m.Get("a"), m.Get("b"), m.Get("c"))
+	}
+}
+
+// ================================================================================
+func TestWritePrometheus(t *testing.T) {
+	labeled := NewGauge("test_labeled", "A labeled gauge.", "stage")
+	labeled.Set(`effect:"quoted"`, 0.5)
+	NewCounter("test_unlabeled_total", "An unlabeled counter.", "")
+
+	buf := &bytes.Buffer{}
+	WritePrometheus(buf)
+	out := buf.String()
+
+	for _, want := range []string{
+		"# HELP test_labeled A labeled gauge.\n",
+		"# TYPE test_labeled gauge\n",
+		`test_labeled{stage="effect:\"quoted\""} 0.5` + "\n",
+		"# TYPE test_unlabeled_total counter\n",
+		"test_unlabeled_total 0\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+// ================================================================================
+func TestSnapshot(t *testing.T) {
+	ObserveStage("source", 0.25)
+	ObserveStage("source", 0.5)
+	snap := Snapshot()
+	seconds := snap["pixelslinger_stage_seconds_total"].(map[string]float64)
+	if seconds["source"] != 0.75 {
+		t.Errorf("stage seconds = %v, want 0.75", seconds["source"])
+	}
+	if _, ok := snap["pixelslinger_frames_total"].(float64); !ok {
+		t.Errorf("unlabeled metrics should be plain numbers")
+	}
+}
+
+// ================================================================================
+func TestHandler(t *testing.T) {
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	for path, want := range map[string]int{
+		"/metrics":        http.StatusOK,
+		"/debug/vars":     http.StatusOK,
+		"/debug/pprof/":   http.StatusNotFound,
+		"/api/state":      http.StatusNotFound,
+		"/something/else": http.StatusNotFound,
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: got status %v, want %v", path, resp.StatusCode, want)
+		}
+	}
+}
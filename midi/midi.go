@@ -1,7 +1,9 @@
 /*
 Package midi allows you to listen to incoming MIDI messages.
 
-Warning!  This is not a feature-complete MIDI implementation.  MIDI system messages are ignored with the exception of CLOCK, START, and STOP messages.
+Warning!  This is not a feature-complete MIDI implementation.  System common and realtime messages
+become SYSTEM MidiMessages (except active sensing, which is dropped), and SysEx messages go to
+subscribers (see SubscribeSysEx) instead of the message stream.
 
 Example
 
@@ -39,6 +41,7 @@ package midi
 import (
 	"fmt"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -85,11 +88,26 @@ const (
 
 // special channel numbers for SYSTEM messages
 const (
-	CLOCK byte = 8
-	START byte = 10
-	STOP  byte = 12
+	// system common messages
+	SYSEX             byte = 0 // never sent as a MidiMessage; see SubscribeSysEx
+	MTC_QUARTER_FRAME byte = 1 // Key is the frame piece
+	SONG_POSITION     byte = 2 // Key is the lsb and Value the msb, in sixteenth notes
+	SONG_SELECT       byte = 3 // Key is the song
+	TUNE_REQUEST      byte = 6
+	SYSEX_END         byte = 7
+
+	// system realtime messages, which can arrive in the middle of other messages
+	CLOCK          byte = 8
+	START          byte = 10
+	CONTINUE       byte = 11
+	STOP           byte = 12
+	ACTIVE_SENSING byte = 14 // dropped by the parser
+	RESET          byte = 15
 )
 
+// SysEx messages longer than this many bytes are dropped
+const MAX_SYSEX_LENGTH = 4096
+
 //================================================================================
 // MIDIMESSAGE TYPE
 
@@ -100,6 +118,12 @@ type MidiMessage struct {
 	Value   byte // velocity, touch, controller value, channel pressure, or pitch bend msb
 }
 
+// Is this a channel message (like a note or a controller) instead of a SYSTEM message
+// (like CLOCK, START or STOP)?  Only channel messages come from someone playing.
+func (m *MidiMessage) IsChannelMessage() bool {
+	return m.Kind != SYSTEM
+}
+
 func debug(s string) {
 	//fmt.Println("    [midi]", s)
 }
@@ -116,6 +140,8 @@ func (m *MidiMessage) String() string {
 		kindStr = "AFTERTOUCH"
 	case CONTROLLER:
 		kindStr = "CONTROLLER"
+	case PROGRAM_CHANGE:
+		kindStr = "PROGRAM_CHANGE"
 	case SYSTEM:
 		kindStr = "SYSTEM"
 	}
@@ -131,65 +157,85 @@ func (m *MidiMessage) String() string {
 
 // Read a stream of raw MIDI bytes on inCh, parse them into *MidiMessage structs,
 // and send over outCh.
-// It accepts CLOCK, START, and STOP system messages but other system messages
-// are ignored.
+// Channel messages can use running status: after a message, more data bytes without
+// a new status byte are more messages of the same kind on the same channel.  Keyboards
+// and DAWs send streams of notes and controller changes this way.
+// System realtime bytes (like CLOCK) are sent as soon as they arrive, even in the middle
+// of another message, without disturbing it.  Complete SysEx messages go to the SysEx
+// subscribers.
 func MidiStreamParserThread(inCh chan byte, outCh chan *MidiMessage) {
 	debug("starting thread")
-	message := new(MidiMessage) // pointer
-	ii := 0
+	status := byte(0) // the status byte of the message in progress (the running status), or 0 if there isn't one
+	data := [2]byte{}
+	ii := 0          // how many data bytes of the current message we have
+	var sysex []byte // the SysEx message in progress, or nil
 	for b := range inCh {
 		debug("")
-		debug(fmt.Sprintf("ii = %v, got byte %v", ii, b))
-		debug(fmt.Sprintf("current message = %v", message))
+		debug(fmt.Sprintf("ii = %v, got byte %v, status = %#x", ii, b, status))
 
-		// special handling for control bytes which mark the start of messages
-		if b >= 128 {
+		switch {
+		case b >= 0xf8:
+			debug("     this is a realtime byte")
+			// 9 and 13 are undefined
+			if channel := b & 0x0f; channel != ACTIVE_SENSING && channel != 9 && channel != 13 {
+				debug("sending")
+				outCh <- &MidiMessage{Kind: SYSTEM, Channel: channel}
+			}
+			continue
+		case b == SYSTEM|SYSEX_END:
+			debug("     end of sysex")
+			if sysex != nil {
+				publishSysEx(append(sysex, b))
+			}
+			sysex, status, ii = nil, 0, 0
+			continue
+		case b >= 128:
 			debug("     this is a control byte")
-			message = new(MidiMessage)
-			message.Kind = b & 0xf0
-			message.Channel = b & 0x0f
-			ii = 1
-			if message.Kind == SYSTEM && (message.Channel == CLOCK || message.Channel == START || message.Channel == STOP) {
+			// any other status byte ends an unfinished SysEx message, which gets dropped
+			sysex, status, ii = nil, b, 0
+			switch {
+			case b == SYSTEM|SYSEX:
+				sysex = []byte{b}
+				status = 0
+			case b == SYSTEM|TUNE_REQUEST:
 				debug("sending")
-				outCh <- message
-				ii = 0
+				outCh <- &MidiMessage{Kind: SYSTEM, Channel: TUNE_REQUEST}
+				status = 0
+			case dataLength(b) == 0:
+				// undefined
+				status = 0
 			}
 			continue
 		}
 
-		// handle data bytes differently depending on what number they are in a message
+		// data bytes
 		debug("     this is a data byte")
-		if ii == 0 {
-			// we should never get a data byte at ii = 0.
-			// if it happens it means we're not understanding this part of the stream,
-			// so drop the byte and do nothing until we get another control byte.
-			continue
-		} else if ii == 1 {
-			debug("     1")
-			message.Key = b
-			// these kinds expect 1 data byte, so we might be done:
-			if message.Kind == PROGRAM_CHANGE || message.Kind == CHANNEL_PRESSURE {
-				debug("sending")
-				outCh <- message
-				ii = 0
-				continue
-			}
-		} else if ii == 2 {
-			debug("     2")
-			message.Value = b
-			// these kinds expect 2 data bytes, so we might be done:
-			if message.Kind == NOTE_OFF || message.Kind == NOTE_ON || message.Kind == AFTERTOUCH || message.Kind == CONTROLLER || message.Kind == PITCH_BEND {
-				debug("sending")
-				outCh <- message
-				ii = 0
-				continue
+		if sysex != nil {
+			if len(sysex) < MAX_SYSEX_LENGTH {
+				sysex = append(sysex, b)
+			} else {
+				debug("sysex is too long; dropping it")
+				sysex = nil
 			}
-		} else {
-			// we're ignoring messages with more than 2 data bytes.
-			// do nothing, wait for another control byte
+			continue
 		}
-
+		if status == 0 {
+			// we don't know what message this belongs to, so drop the byte and
+			// do nothing until we get another control byte.
+			continue
+		}
+		data[ii] = b
 		ii += 1
+		if ii == dataLength(status) {
+			debug("sending")
+			outCh <- &MidiMessage{Kind: status & 0xf0, Channel: status & 0x0f, Key: data[0], Value: data[1]}
+			ii = 0
+			data = [2]byte{}
+			if status&0xf0 == SYSTEM {
+				// only channel messages have running status
+				status = 0
+			}
+		}
 	}
 
 	// if we get here, inCh has been closed
@@ -197,6 +243,62 @@ func MidiStreamParserThread(inCh chan byte, outCh chan *MidiMessage) {
 	close(outCh)
 }
 
+// How many data bytes a message has, by its status byte.  0 for system
+// messages which don't have a fixed length.
+func dataLength(status byte) int {
+	switch status & 0xf0 {
+	case PROGRAM_CHANGE, CHANNEL_PRESSURE:
+		return 1
+	case SYSTEM:
+		switch status & 0x0f {
+		case MTC_QUARTER_FRAME, SONG_SELECT:
+			return 1
+		case SONG_POSITION:
+			return 2
+		}
+		return 0
+	}
+	return 2
+}
+
+//================================================================================
+// SYSEX
+
+var sysExMutex sync.Mutex
+var sysExSubscribers = map[chan []byte]bool{}
+
+// Get a channel which receives every complete SysEx message from every parser, from
+// the 0xf0 byte to the 0xf7 byte.  Realtime bytes which arrived in the middle of a
+// message aren't included.  If the channel's buffer is full, messages for it are
+// dropped so a slow subscriber can't hold up the MIDI stream.
+func SubscribeSysEx() chan []byte {
+	ch := make(chan []byte, 100)
+	sysExMutex.Lock()
+	defer sysExMutex.Unlock()
+	sysExSubscribers[ch] = true
+	return ch
+}
+
+// Stop sending SysEx messages to ch.
+func UnsubscribeSysEx(ch chan []byte) {
+	sysExMutex.Lock()
+	defer sysExMutex.Unlock()
+	delete(sysExSubscribers, ch)
+}
+
+func publishSysEx(message []byte) {
+	debug(fmt.Sprintf("sysex: % x", message))
+	sysExMutex.Lock()
+	defer sysExMutex.Unlock()
+	for ch := range sysExSubscribers {
+		select {
+		case ch <- message:
+		default:
+			debug("sysex subscriber is full; dropping a message")
+		}
+	}
+}
+
 //================================================================================
 // HELPERS
 
@@ -246,11 +348,19 @@ func tenaciousFileByteStreamerThread(path string, outCh chan byte) {
 //================================================================================
 // MIDISTATE TYPE
 
+// How many named controls a MidiState has room for
+const MAX_CONTROLS = 64
+
 // Keeps track of the current state of the keys and controllers.
 type MidiState struct {
 	KeyVolumes         [128]byte      // values from 0 to 127
 	ControllerValues   [128]byte      // values from 0 to 127
 	RecentMidiMessages []*MidiMessage // midi messages from the most recent call to UpdateStateXXX()
+	Program            byte           // the most recent PROGRAM_CHANGE number
+
+	// values of the named controls, indexed and kept up to date by the controls package.
+	// patterns should read these instead of the raw key and controller values.
+	Controls [MAX_CONTROLS]float64
 }
 
 // Pull all the available MidiMessages out of the channel without blocking.  Requires a channel
@@ -287,6 +397,8 @@ func (midiState *MidiState) UpdateStateFromSlice(midiMessages []*MidiMessage) {
 			midiState.KeyVolumes[m.Key] = m.Value
 		case CONTROLLER:
 			midiState.ControllerValues[m.Key] = m.Value
+		case PROGRAM_CHANGE:
+			midiState.Program = m.Key
 		}
 	}
 }
@@ -1,10 +1,17 @@
 package midi
 
 import (
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 )
 
+var UPDATE_REPLAYS = flag.Bool("update", false, "rewrite the expected messages for the MIDI streams in testdata")
+
 //================================================================================
 
 func midiBytesToMessages(bytes []byte) []*MidiMessage {
@@ -60,7 +67,7 @@ func TestMidiStreamParser(t *testing.T) {
 	midiTest(t, []byte{0x9f, 60, 0}, []byte{NOTE_ON})
 	midiTest(t, []byte{0x90, 31, 127, 0x90, 31, 0}, []byte{NOTE_ON, NOTE_ON})
 	midiTest(t, []byte{0x90, 31, 127, 7, 0x90, 31, 0}, []byte{NOTE_ON, NOTE_ON})
-	midiTest(t, []byte{0x90, 31, 127, 7, 7, 7, 7, 7, 0x90, 31, 0}, []byte{NOTE_ON, NOTE_ON})
+	midiTest(t, []byte{0x90, 31, 127, 7, 7, 7, 7, 7, 0x90, 31, 0}, []byte{NOTE_ON, NOTE_ON, NOTE_ON, NOTE_ON})
 	midiTest(t, []byte{0xb0, 64, 127, 0x90, 60, 0}, []byte{CONTROLLER, NOTE_ON})
 	midiTest(t, []byte{0x90, 31, 127, 0xf0 + CLOCK, 0x90, 31, 0}, []byte{NOTE_ON, SYSTEM, NOTE_ON})
 	midiTest(t, []byte{0x90, 31, 127, 0xf0 + START, 0x90, 31, 0}, []byte{NOTE_ON, SYSTEM, NOTE_ON})
@@ -68,6 +75,254 @@ func TestMidiStreamParser(t *testing.T) {
 	midiTest(t, []byte{0x90, 31, 127, 0xf0, 0x90, 31, 0}, []byte{NOTE_ON, NOTE_ON})
 }
 
+// Streams which use running status, the way keyboards and DAWs send them.
+func TestRunningStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		bytes    []byte
+		expected []MidiMessage
+	}{
+		{
+			"keyboard chord, released with velocity 0 notes",
+			[]byte{0x90, 60, 100, 64, 90, 67, 80, 60, 0, 64, 0, 67, 0},
+			[]MidiMessage{
+				{NOTE_ON, 0, 60, 100}, {NOTE_ON, 0, 64, 90}, {NOTE_ON, 0, 67, 80},
+				{NOTE_ON, 0, 60, 0}, {NOTE_ON, 0, 64, 0}, {NOTE_ON, 0, 67, 0},
+			},
+		},
+		{
+			"DAW fader automation on channel 2",
+			[]byte{0xb1, 7, 100, 7, 101, 7, 102, 7, 103},
+			[]MidiMessage{{CONTROLLER, 1, 7, 100}, {CONTROLLER, 1, 7, 101}, {CONTROLLER, 1, 7, 102}, {CONTROLLER, 1, 7, 103}},
+		},
+		{
+			"knob sweep, then a pad",
+			[]byte{0xb0, 1, 10, 1, 11, 1, 12, 0x90, 36, 127, 0x80, 36, 127},
+			[]MidiMessage{{CONTROLLER, 0, 1, 10}, {CONTROLLER, 0, 1, 11}, {CONTROLLER, 0, 1, 12}, {NOTE_ON, 0, 36, 127}, {NOTE_OFF, 0, 36, 127}},
+		},
+		{
+			"program changes and channel pressure have one data byte",
+			[]byte{0xc0, 1, 2, 3, 0xd5, 40, 41},
+			[]MidiMessage{{PROGRAM_CHANGE, 0, 1, 0}, {PROGRAM_CHANGE, 0, 2, 0}, {PROGRAM_CHANGE, 0, 3, 0}, {CHANNEL_PRESSURE, 5, 40, 0}, {CHANNEL_PRESSURE, 5, 41, 0}},
+		},
+		{
+			"pitch bend wheel",
+			[]byte{0xe0, 0, 64, 0, 65, 127, 127},
+			[]MidiMessage{{PITCH_BEND, 0, 0, 64}, {PITCH_BEND, 0, 0, 65}, {PITCH_BEND, 0, 127, 127}},
+		},
+		{
+			"an unfinished message is dropped at the next status byte",
+			[]byte{0x90, 60, 100, 62, 0xb0, 1, 2},
+			[]MidiMessage{{NOTE_ON, 0, 60, 100}, {CONTROLLER, 0, 1, 2}},
+		},
+		{
+			"system messages cancel running status",
+			[]byte{0x90, 60, 100, 0xf0, 0x7e, 0x7f, 0xf7, 62, 100, 0x90, 64, 100},
+			[]MidiMessage{{NOTE_ON, 0, 60, 100}, {NOTE_ON, 0, 64, 100}},
+		},
+		{
+			"data bytes before any status byte are dropped",
+			[]byte{60, 100, 0x90, 60, 100},
+			[]MidiMessage{{NOTE_ON, 0, 60, 100}},
+		},
+	}
+	for _, test := range tests {
+		expectMessages(t, test.name, test.bytes, test.expected)
+	}
+}
+
+func expectMessages(t *testing.T, name string, bytes []byte, expected []MidiMessage) {
+	messages := midiBytesToMessages(bytes)
+	if len(messages) != len(expected) {
+		t.Errorf("%s: expected %v messages, got %v", name, len(expected), messages)
+		return
+	}
+	for ii, m := range messages {
+		if *m != expected[ii] {
+			t.Errorf("%s: message %v: expected %v, got %v", name, ii, &expected[ii], m)
+		}
+	}
+}
+
+// DAWs send CLOCK 24 times per beat, so it often lands inside other messages.
+func TestRealtimeAndSystemCommon(t *testing.T) {
+	clock := MidiMessage{SYSTEM, CLOCK, 0, 0}
+	tests := []struct {
+		name     string
+		bytes    []byte
+		expected []MidiMessage
+	}{
+		{
+			"clock between a note's data bytes",
+			[]byte{0x90, 60, 0xf8, 100},
+			[]MidiMessage{clock, {NOTE_ON, 0, 60, 100}},
+		},
+		{
+			"clock between running status messages",
+			[]byte{0xb0, 1, 10, 0xf8, 1, 0xf8, 11, 1, 12},
+			[]MidiMessage{{CONTROLLER, 0, 1, 10}, clock, clock, {CONTROLLER, 0, 1, 11}, {CONTROLLER, 0, 1, 12}},
+		},
+		{
+			"transport, active sensing, and reset",
+			[]byte{0xfa, 0xfe, 0xfb, 0xfc, 0xf9, 0xfd, 0xff},
+			[]MidiMessage{{SYSTEM, START, 0, 0}, {SYSTEM, CONTINUE, 0, 0}, {SYSTEM, STOP, 0, 0}, {SYSTEM, RESET, 0, 0}},
+		},
+		{
+			"MIDI time code quarter frames",
+			[]byte{0xf1, 0x01, 0xf1, 0x12, 0xf8, 0xf1, 0x23},
+			[]MidiMessage{{SYSTEM, MTC_QUARTER_FRAME, 0x01, 0}, {SYSTEM, MTC_QUARTER_FRAME, 0x12, 0}, clock, {SYSTEM, MTC_QUARTER_FRAME, 0x23, 0}},
+		},
+		{
+			"song position, song select, and tune request",
+			[]byte{0xf2, 0x10, 0x02, 0xf3, 5, 0xf6},
+			[]MidiMessage{{SYSTEM, SONG_POSITION, 0x10, 0x02}, {SYSTEM, SONG_SELECT, 5, 0}, {SYSTEM, TUNE_REQUEST, 0, 0}},
+		},
+		{
+			"system common messages cancel running status",
+			[]byte{0x90, 60, 100, 0xf3, 5, 62, 100, 0xf4, 1, 2},
+			[]MidiMessage{{NOTE_ON, 0, 60, 100}, {SYSTEM, SONG_SELECT, 5, 0}},
+		},
+	}
+	for _, test := range tests {
+		expectMessages(t, test.name, test.bytes, test.expected)
+	}
+}
+
+func TestSysEx(t *testing.T) {
+	ch := SubscribeSysEx()
+	defer UnsubscribeSysEx(ch)
+
+	long := []byte{0xf0}
+	for ii := 0; ii < MAX_SYSEX_LENGTH; ii++ {
+		long = append(long, 1)
+	}
+	tests := []struct {
+		name     string
+		bytes    []byte
+		expected []MidiMessage
+		sysex    [][]byte
+	}{
+		{
+			"identity reply with a clock in the middle",
+			[]byte{0xf0, 0x7e, 0x7f, 0x06, 0xf8, 0x02, 0x47, 0xf7},
+			[]MidiMessage{{SYSTEM, CLOCK, 0, 0}},
+			[][]byte{{0xf0, 0x7e, 0x7f, 0x06, 0x02, 0x47, 0xf7}},
+		},
+		{
+			"two in a row, then a note",
+			[]byte{0xf0, 1, 0xf7, 0xf0, 2, 3, 0xf7, 0x90, 60, 100},
+			[]MidiMessage{{NOTE_ON, 0, 60, 100}},
+			[][]byte{{0xf0, 1, 0xf7}, {0xf0, 2, 3, 0xf7}},
+		},
+		{
+			"cut off by a status byte",
+			[]byte{0xf0, 1, 2, 0x90, 60, 100, 0xf7},
+			[]MidiMessage{{NOTE_ON, 0, 60, 100}},
+			nil,
+		},
+		{
+			"too long",
+			append(long, 0xf7),
+			nil,
+			nil,
+		},
+	}
+	for _, test := range tests {
+		expectMessages(t, test.name, test.bytes, test.expected)
+		for _, expected := range test.sysex {
+			select {
+			case got := <-ch:
+				if string(got) != string(expected) {
+					t.Errorf("%s: expected SysEx % x, got % x", test.name, expected, got)
+				}
+			default:
+				t.Errorf("%s: expected SysEx % x, got nothing", test.name, expected)
+			}
+		}
+		if len(ch) > 0 {
+			t.Errorf("%s: unexpected SysEx % x", test.name, <-ch)
+		}
+	}
+}
+
+// A realtime byte between two messages which share a running status mustn't cancel it.
+func TestRealtimeKeepsRunningStatus(t *testing.T) {
+	for _, rt := range []byte{CLOCK, START, CONTINUE, STOP, ACTIVE_SENSING, RESET} {
+		expected := []MidiMessage{{NOTE_ON, 0, 60, 100}, {SYSTEM, rt, 0, 0}, {NOTE_ON, 0, 62, 100}}
+		if rt == ACTIVE_SENSING {
+			expected = []MidiMessage{expected[0], expected[2]}
+		}
+		expectMessages(t, fmt.Sprintf("%#x between running status messages", SYSTEM|rt), []byte{0x90, 60, 100, SYSTEM | rt, 62, 100}, expected)
+	}
+}
+
+//================================================================================
+// REPLAYS
+//   testdata/NAME.hex holds a stream of MIDI bytes as hex, in the format midi/midicapture
+//   writes.  testdata/NAME.txt holds the messages we expect the parser to make from it,
+//   one per line, then any SysEx messages.  The streams there now are all written by hand;
+//   none of them are captures from real hardware.  To write the .txt files after adding a
+//   stream, run "go test ./midi -run TestReplay -update" and check them by hand.
+
+// Read a .hex file: hex bytes separated by whitespace, with "#" starting a comment.
+func readHexFile(t *testing.T, fn string) []byte {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bytes []byte
+	for _, line := range strings.Split(string(data), "\n") {
+		if ii := strings.Index(line, "#"); ii >= 0 {
+			line = line[:ii]
+		}
+		for _, word := range strings.Fields(line) {
+			b, err := strconv.ParseUint(word, 16, 8)
+			if err != nil {
+				t.Fatalf("%s: bad byte \"%s\"", fn, word)
+			}
+			bytes = append(bytes, byte(b))
+		}
+	}
+	return bytes
+}
+
+func TestReplay(t *testing.T) {
+	fns, err := filepath.Glob(filepath.Join("testdata", "*.hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fns) == 0 {
+		t.Fatal("no MIDI streams in testdata")
+	}
+	ch := SubscribeSysEx()
+	defer UnsubscribeSysEx(ch)
+	for _, fn := range fns {
+		got := ""
+		for _, m := range midiBytesToMessages(readHexFile(t, fn)) {
+			got += m.String() + "\n"
+		}
+		for len(ch) > 0 {
+			got += fmt.Sprintf("sysex % x\n", <-ch)
+		}
+
+		expectedFn := strings.TrimSuffix(fn, ".hex") + ".txt"
+		if *UPDATE_REPLAYS {
+			if err := ioutil.WriteFile(expectedFn, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expected, err := ioutil.ReadFile(expectedFn)
+		if err != nil {
+			t.Errorf("%v (run with -update to write it)", err)
+			continue
+		}
+		if got != string(expected) {
+			t.Errorf("%s: expected\n%s\ngot\n%s", fn, expected, got)
+		}
+	}
+}
+
 //================================================================================
 
 func TestMidiState(t *testing.T) {
@@ -83,4 +338,9 @@ func TestMidiState(t *testing.T) {
 	if state.KeyVolumes[61] != 12 {
 		t.Errorf("state failed")
 	}
+
+	state.UpdateStateFromSlice(midiBytesToMessages([]byte{0xc0, 5, 0xc3, 9}))
+	if state.Program != 9 || len(state.RecentMidiMessages) != 2 {
+		t.Errorf("program change failed")
+	}
 }
@@ -0,0 +1,73 @@
+/*
+Midicapture records the raw bytes from a MIDI device so they can be replayed by the
+midi package's tests.
+
+	go run ./midi/midicapture /dev/midi1 > midi/testdata/my-controller.hex
+
+Play the controller, then press ctrl-C.  The bytes are written as hex, with a new line
+whenever the device pauses, and the parsed messages are printed to stderr as they arrive
+so you can see what you're recording.  Then run
+
+	go test ./midi -run TestReplay -update
+
+to write the messages the parser makes from the recording to my-controller.txt, check
+that they're right, and commit both files.  (The streams in testdata so far were written
+by hand, not recorded with this.)
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/longears/pixelslinger/midi"
+)
+
+// Start a new line when the device has been quiet this long
+const PAUSE = 50 * time.Millisecond
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: midicapture /dev/midi1 > midi/testdata/name.hex")
+		os.Exit(1)
+	}
+	path := os.Args[1]
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[midicapture] couldn't open midi device:", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	fmt.Printf("# captured from %s on %s\n", path, time.Now().Format("2006-01-02 15:04"))
+
+	// show what the parser makes of it
+	byteChan := make(chan byte, 3000)
+	messageChan := make(chan *midi.MidiMessage, 500)
+	go midi.MidiStreamParserThread(byteChan, messageChan)
+	go func() {
+		for m := range messageChan {
+			fmt.Fprintln(os.Stderr, m)
+		}
+	}()
+
+	buf := make([]byte, 1024)
+	lastRead := time.Now()
+	for {
+		count, err := file.Read(buf)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "[midicapture] couldn't read from midi device:", err)
+			break
+		}
+		if time.Since(lastRead) > PAUSE {
+			fmt.Println()
+		}
+		lastRead = time.Now()
+		for _, b := range buf[:count] {
+			fmt.Printf("%02x ", b)
+			byteChan <- b
+		}
+	}
+	fmt.Println()
+	close(byteChan)
+}
@@ -0,0 +1,54 @@
+package opc
+
+// Temporal dithering
+//   Chipsets like the LPD8806 only have 7 bits per channel, so after gamma correction
+//   the dim end of the range collapses into a few visible steps.
+//   A Ditherer remembers the rounding error of every channel from the previous frame
+//   and adds it back in on the next frame, so over several frames each LED averages
+//   out to the brightness we actually asked for.
+
+// Keeps a per-channel rounding residual between frames.
+// Create one per output with NewDitherer and call Quantize once per channel per frame.
+// Not safe for use by more than one goroutine at a time.
+type Ditherer struct {
+	Enabled  bool      // if false, Quantize just rounds to the nearest level
+	residual []float64 // leftover error for each channel, in units of output levels
+}
+
+// Make a new Ditherer.  If enabled is false it will just round to the nearest level.
+func NewDitherer(enabled bool) *Ditherer {
+	return &Ditherer{Enabled: enabled}
+}
+
+// Prepare the residual buffer for a frame with nChannels channels (3 times the number of pixels).
+// If the frame size has changed since last time, the old residuals are thrown away.
+func (d *Ditherer) BeginFrame(nChannels int) {
+	if len(d.residual) != nChannels {
+		d.residual = make([]float64, nChannels)
+	}
+}
+
+// Convert x, a float in the range 0-1, to an integer level from 0 to maxLevel inclusive.
+// ii is the index of the channel within the frame and selects which residual to use.
+// Out-of-range values of x are clamped.
+func (d *Ditherer) Quantize(ii int, x float64, maxLevel int) byte {
+	if x < 0 {
+		x = 0
+	} else if x > 1 {
+		x = 1
+	}
+	if !d.Enabled {
+		// same scale as dithering, so turning it on or off doesn't shift the levels
+		return byte(int(x*float64(maxLevel) + 0.5))
+	}
+
+	want := x*float64(maxLevel) + d.residual[ii]
+	level := int(want + 0.5)
+	if level < 0 {
+		level = 0
+	} else if level > maxLevel {
+		level = maxLevel
+	}
+	d.residual[ii] = want - float64(level)
+	return byte(level)
+}
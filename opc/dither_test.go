@@ -0,0 +1,87 @@
+package opc
+
+import (
+	"math"
+	"testing"
+)
+
+//================================================================================
+func TestDitherAverages(t *testing.T) {
+	const N_FRAMES = 1000
+	const MAX_LEVEL = 127
+	levels := []float64{0, 0.001, 0.3 / MAX_LEVEL, 0.5 / MAX_LEVEL, 1.7 / MAX_LEVEL, 0.25, 0.5, 0.999, 1}
+	d := NewDitherer(true)
+	sums := make([]float64, len(levels))
+	for frame := 0; frame < N_FRAMES; frame++ {
+		d.BeginFrame(len(levels))
+		for ii, x := range levels {
+			sums[ii] += float64(d.Quantize(ii, x, MAX_LEVEL))
+		}
+	}
+	for ii, x := range levels {
+		// the leftover error never gets bigger than half a level, so the average is
+		// within half a level over N_FRAMES of what we asked for
+		got := sums[ii] / N_FRAMES / MAX_LEVEL
+		if math.Abs(got-x) > 0.5/N_FRAMES/MAX_LEVEL+1e-9 {
+			t.Errorf("dithering %v: averaged %v over %v frames", x, got, N_FRAMES)
+		}
+	}
+}
+
+func TestDitherDisabledRounds(t *testing.T) {
+	const MAX_LEVEL = 127
+	d := NewDitherer(false)
+	d.BeginFrame(3)
+	for ii := 0; ii <= 1000; ii++ {
+		x := float64(ii) / 1000
+		want := int(math.Floor(x*MAX_LEVEL + 0.5))
+		// the same every frame, whatever came before
+		for frame := 0; frame < 3; frame++ {
+			if got := d.Quantize(frame, x, MAX_LEVEL); int(got) != want {
+				t.Fatalf("Quantize(%v) without dithering: got %v, want %v", x, got, want)
+			}
+		}
+	}
+	if d.Quantize(0, -0.5, MAX_LEVEL) != 0 || d.Quantize(0, 1.5, MAX_LEVEL) != MAX_LEVEL {
+		t.Errorf("expected values outside 0 to 1 to be clamped")
+	}
+}
+
+// Turning dithering on or off shouldn't shift the levels: without dithering each value
+// rounds to within half a level of what dithering averages out to.
+func TestDitherModesAgree(t *testing.T) {
+	const N_FRAMES = 200
+	const MAX_LEVEL = 127
+	const N_VALUES = 1000
+	on := NewDitherer(true)
+	off := NewDitherer(false)
+	sums := make([]float64, N_VALUES+1)
+	for frame := 0; frame < N_FRAMES; frame++ {
+		on.BeginFrame(len(sums))
+		for ii := range sums {
+			sums[ii] += float64(on.Quantize(ii, float64(ii)/N_VALUES, MAX_LEVEL))
+		}
+	}
+	off.BeginFrame(len(sums))
+	for ii := range sums {
+		x := float64(ii) / N_VALUES
+		average := sums[ii] / N_FRAMES
+		plain := float64(off.Quantize(ii, x, MAX_LEVEL))
+		if math.Abs(plain-average) > 0.5+0.5/N_FRAMES {
+			t.Errorf("%v: %v without dithering but %v on average with it", x, plain, average)
+		}
+		if math.Abs(x*MAX_LEVEL-math.Floor(x*MAX_LEVEL+0.5)) < 1e-9 && plain != average {
+			t.Errorf("%v is exactly a level, so both modes should give %v, got %v and %v", x, x*MAX_LEVEL, plain, average)
+		}
+	}
+}
+
+func TestDitherBeginFrameResets(t *testing.T) {
+	d := NewDitherer(true)
+	d.BeginFrame(3)
+	d.Quantize(0, 0.4/127, 127) // leaves a residual of 0.4
+	d.BeginFrame(6)
+	if got := d.Quantize(0, 0.4/127, 127); got != 0 {
+		t.Errorf("a new frame size should start without residuals, got %v", got)
+	}
+}
@@ -7,14 +7,13 @@ package opc
 import (
 	"math"
 	"math/rand"
-	"time"
 
 	"github.com/longears/pixelslinger/colorutils"
-	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/controls"
 	"github.com/longears/pixelslinger/midi"
 )
 
-func MakeEffectFader(locations []float64) ByteThread {
+func MakeEffectFader(locations []float64) FrameThread {
 
 	const (
 		FLASH_DURATION_MIN = 2.0 / 40.0  // in seconds
@@ -32,7 +31,7 @@ func MakeEffectFader(locations []float64) ByteThread {
 		FADE_TO_BLACK_TIME = 15.0 / 40.0 // in seconds
 	)
 
-	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
 
 		// get bounding box
 		n_pixels := len(locations) / 3
@@ -74,36 +73,37 @@ func MakeEffectFader(locations []float64) ByteThread {
 		lastTwinklePad := 0.0
 		lastFadeToBlackPad := 0.0
 		fadeToBlackBeginTime := 0.0
-		for bytes := range bytesIn {
-			n_pixels := len(bytes) / 3
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+		for frame := range framesIn {
+			pixels := frame.Pixels
+			n_pixels := len(pixels) / 3
+			t := frame.Time
 
 			// twinkle strobe pad
-			twinklePad := float64(midiState.KeyVolumes[config.TWINKLE_PAD]) / 127.0
+			twinklePad := controls.TWINKLE.Get(midiState)
 			if twinklePad > 0 {
 				lastTwinklePad = twinklePad
 				lastTwinkleTime = t
 			}
 
 			// blink regions
-			blinkArchPad := float64(midiState.KeyVolumes[config.BLINK_ARCH_PAD]) / 127.0
-			blinkBackPad := float64(midiState.KeyVolumes[config.BLINK_BACK_PAD]) / 127.0
+			blinkArchPad := controls.BLINK_ARCH.Get(midiState)
+			blinkBackPad := controls.BLINK_BACK.Get(midiState)
 
 			// gain knob
-			gainKnob := float64(midiState.ControllerValues[config.GAIN_KNOB]) / 127.0
+			gainKnob := controls.GAIN.Get(midiState)
 			gain0 := colorutils.Clamp(colorutils.Remap(gainKnob, 0.75, 0.95, 0, 1), 0, 1)
 			gain1 := colorutils.Clamp(colorutils.Remap(gainKnob, 0.40, 0.50, 0, 1), 0, 1)
 			gain2 := colorutils.Clamp(colorutils.Remap(gainKnob, 0.05, 0.25, 0, 1), 0, 1)
 
 			// eyelid knob
-			eyelidKnob := float64(midiState.ControllerValues[config.EYELID_KNOB]) / 127.0
+			eyelidKnob := controls.EYELID.Get(midiState)
 			eyelidKnob = colorutils.Clamp(colorutils.Remap(eyelidKnob, 0.05, 0.95, 0, 1), 0, 1)
 
 			// saturation knob
-			desatKnob := float64(midiState.ControllerValues[config.DESAT_KNOB]) / 127.0
+			desatKnob := controls.DESAT.Get(midiState)
 
 			// fade to black pad
-			fadeToBlackPad := float64(midiState.KeyVolumes[config.FADE_TO_BLACK_PAD]) / 127.0
+			fadeToBlackPad := controls.FADE_TO_BLACK.Get(midiState)
 			if fadeToBlackPad > 0 && lastFadeToBlackPad == 0 {
 				// pad has just gone down
 				fadeToBlackBeginTime = t
@@ -119,9 +119,9 @@ func MakeEffectFader(locations []float64) ByteThread {
 				//--------------------------------------------------------------------------------
 				//pct := float64(ii) / float64(n_pixels)
 
-				r := float64(bytes[ii*3+0]) / 255
-				g := float64(bytes[ii*3+1]) / 255
-				b := float64(bytes[ii*3+2]) / 255
+				r := float64(pixels[ii*3+0])
+				g := float64(pixels[ii*3+1])
+				b := float64(pixels[ii*3+2])
 
 				z := locations[ii*3+2]
 
@@ -158,7 +158,7 @@ func MakeEffectFader(locations []float64) ByteThread {
 				// twinkle strobe
 				twinkleAmt := colorutils.Clamp(colorutils.Remap(t-lastTwinkleTime, 0, TWINKLE_DURATION, 1, 0), 0, 1)
 				if twinkleAmt > 0 {
-					thisTwinkle := rand.Float64()
+					thisTwinkle := rng.Float64()
 					if thisTwinkle < lastTwinklePad*MAX_TWINKLE_DENSITY {
 						thisTwinkle = twinkleAmt
 					} else {
@@ -196,13 +196,14 @@ func MakeEffectFader(locations []float64) ByteThread {
 					b *= fadeToBlackAmount
 				}
 
-				bytes[ii*3+0] = colorutils.FloatToByte(r)
-				bytes[ii*3+1] = colorutils.FloatToByte(g)
-				bytes[ii*3+2] = colorutils.FloatToByte(b)
+				// no clipping here; the dest does that
+				pixels[ii*3+0] = float32(r)
+				pixels[ii*3+1] = float32(g)
+				pixels[ii*3+2] = float32(b)
 
 				//--------------------------------------------------------------------------------
 			}
-			bytesOut <- bytes
+			framesOut <- frame
 		}
 	}
 }
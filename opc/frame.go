@@ -0,0 +1,140 @@
+package opc
+
+// Frames
+//   Between the source and the dests, pixels travel as Frames of float32 colors instead
+//   of bytes, so a chain of effects doesn't round off dim colors at every step.  Values
+//   above 1 are allowed (for HDR-style overbright effects); they're only clipped and
+//   quantized once, when a dest encodes the frame for its output.
+//
+//   Patterns are still ByteThreads.  MakeFrameThread adapts any ByteThread so it can
+//   run as a FrameThread.  Everything that combines patterns into a source (switching
+//   transitions, playlists, layers, zones, resizing and interpolation) works on Frames,
+//   so a pattern's bytes aren't rounded again on their way to the dests.
+
+import (
+	"math"
+
+	"github.com/longears/pixelslinger/midi"
+)
+
+// One frame of pixels.
+type Frame struct {
+	Pixels []float32 // r, g, b for each pixel.  0 is off and 1 is full brightness, but higher values are allowed.
+	Seq    uint64    // counts up by one for each frame the main loop renders
+	Time   float64   // the frame clock time this frame is rendered for (see the clock package)
+	Delta  float64   // frame clock seconds since the previous frame
+}
+
+// Like a ByteThread, but passing Frames instead of byte slices.
+// Stages should modify the frame in place and pass the same pointer along.
+type FrameThread func(chan *Frame, chan *Frame, *midi.MidiState)
+
+// Make a black frame with room for nPixels pixels.
+func NewFrame(nPixels int) *Frame {
+	return &Frame{Pixels: make([]float32, nPixels*3)}
+}
+
+// Set the pixels from 0-255 bytes.  The frame takes on the length of bytes.
+func (f *Frame) SetFromBytes(bytes []byte) {
+	f.SetLength(len(bytes))
+	for ii, b := range bytes {
+		f.Pixels[ii] = float32(b) / 255
+	}
+}
+
+// Clip the pixels to the range 0-1, round them to bytes, and return them in bytes[:0]
+// (which is reallocated if it's too small).
+func (f *Frame) ToBytes(bytes []byte) []byte {
+	bytes = bytes[:0]
+	for _, x := range f.Pixels {
+		bytes = append(bytes, FloatToByte(x))
+	}
+	return bytes
+}
+
+// Copy the pixels, sequence number, time and delta from another frame.
+func (f *Frame) CopyFrom(other *Frame) {
+	f.Pixels = append(f.Pixels[:0], other.Pixels...)
+	f.Seq = other.Seq
+	f.Time = other.Time
+	f.Delta = other.Delta
+}
+
+// Set the number of channels (3 times the number of pixels), reallocating only if
+// there isn't room.  The values of the channels are left as they were.
+func (f *Frame) SetLength(nChannels int) {
+	if cap(f.Pixels) < nChannels {
+		f.Pixels = make([]float32, nChannels)
+	}
+	f.Pixels = f.Pixels[:nChannels]
+}
+
+// Multiply every channel by x.
+func (f *Frame) Scale(x float32) {
+	for ii := range f.Pixels {
+		f.Pixels[ii] *= x
+	}
+}
+
+// Convert a float color channel to a byte, clipping it to the range 0-1 and rounding.
+// This is the inverse of what SetFromBytes does, so bytes survive the round trip.
+func FloatToByte(x float32) byte {
+	if x <= 0 {
+		return 0
+	} else if x >= 1 {
+		return 255
+	}
+	return byte(x*255 + 0.5)
+}
+
+//--------------------------------------------------------------------------------
+// GAMMA
+
+// Gamma corrects float colors by looking them up in a table this big, with linear interpolation in between
+const GAMMA_TABLE_SIZE = 4096
+
+var gammaTable = makeGammaTable()
+
+func makeGammaTable() []float64 {
+	table := make([]float64, GAMMA_TABLE_SIZE+1)
+	for ii := range table {
+		table[ii] = math.Pow(float64(ii)/GAMMA_TABLE_SIZE, GAMMA)
+	}
+	return table
+}
+
+// Clip x to the range 0-1 and apply GAMMA to it.
+func applyGamma(x float32) float64 {
+	if x <= 0 {
+		return 0
+	} else if x >= 1 {
+		return 1
+	}
+	pos := float64(x) * GAMMA_TABLE_SIZE
+	ii := int(pos)
+	frac := pos - float64(ii)
+	return gammaTable[ii]*(1-frac) + gammaTable[ii+1]*frac
+}
+
+//--------------------------------------------------------------------------------
+// WRAPPERS
+
+// Return a FrameThread which runs a ByteThread, converting each frame to bytes on the way
+// in and back to floats on the way out.  This is how patterns and other byte-based stages
+// run in the frame pipeline.
+func MakeFrameThread(thread ByteThread) FrameThread {
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+		chanToThread := make(chan []byte, 0)
+		chanFromThread := make(chan []byte, 0)
+		go thread(chanToThread, chanFromThread, midiState)
+		var bytes []byte
+		for frame := range framesIn {
+			bytes = frame.ToBytes(bytes)
+			chanToThread <- bytes
+			bytes = <-chanFromThread
+			frame.SetFromBytes(bytes)
+			framesOut <- frame
+		}
+		close(chanToThread)
+	}
+}
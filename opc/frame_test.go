@@ -0,0 +1,159 @@
+package opc
+
+import (
+	"math"
+	"testing"
+
+	"github.com/longears/pixelslinger/clock"
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+)
+
+//================================================================================
+func TestFrameBytesRoundTrip(t *testing.T) {
+	bytes := make([]byte, 256*3)
+	for ii := range bytes {
+		bytes[ii] = byte(ii / 3)
+	}
+	frame := NewFrame(2)
+	frame.SetFromBytes(bytes)
+	if len(frame.Pixels) != len(bytes) {
+		t.Fatalf("the frame should take on the length of the bytes, got %v", len(frame.Pixels))
+	}
+	if frame.Pixels[0] != 0 || frame.Pixels[len(bytes)-1] != 1 {
+		t.Errorf("expected 0 to 255 to become 0 to 1, got %v to %v", frame.Pixels[0], frame.Pixels[len(bytes)-1])
+	}
+	out := frame.ToBytes(nil)
+	for ii := range bytes {
+		if out[ii] != bytes[ii] {
+			t.Fatalf("byte %v: put in %v and got back %v", ii, bytes[ii], out[ii])
+		}
+	}
+
+	// a shorter slice keeps the frame's buffer
+	pixels := frame.Pixels
+	frame.SetFromBytes(bytes[:3])
+	if len(frame.Pixels) != 3 || &frame.Pixels[0] != &pixels[0] {
+		t.Errorf("expected the frame to shrink in place, got %v", frame.Pixels)
+	}
+}
+
+func TestFrameCopyFrom(t *testing.T) {
+	frame := &Frame{Pixels: []float32{0.1, 0.2, 1.5}, Seq: 7, Time: 12.5, Delta: 0.025}
+	other := NewFrame(5)
+	other.CopyFrom(frame)
+	if len(other.Pixels) != 3 || other.Pixels[2] != 1.5 || other.Seq != 7 || other.Time != 12.5 || other.Delta != 0.025 {
+		t.Errorf("expected a copy of %v, got %v", frame, other)
+	}
+	frame.Pixels[0] = 0.9
+	if other.Pixels[0] != 0.1 {
+		t.Errorf("the copy shouldn't share pixels with the original")
+	}
+}
+
+// Number the frames like the main loop does, with two frames taking turns, and check
+// that the sequence numbers come out of the interpolator and the source switcher
+// unchanged, across a switch and the transition after it.
+func TestFrameSeq(t *testing.T) {
+	clock.Set(clock.NewFixedStepClock(1.0 / 40))
+	defer clock.Set(clock.NewRealTimeClock())
+	locations := ReadLocations(TEST_LAYOUT)
+	transitionTime := 0.25
+	pc := &PipelineConfig{
+		Source:         StageConfig{Name: "fire"},
+		Dests:          []StageConfig{{Name: DEVNULL_MAGIC_WORD}},
+		Interpolate:    INTERPOLATE_LINEAR,
+		Transition:     TRANSITION_CROSSFADE,
+		TransitionTime: &transitionTime,
+	}
+	pipeline, err := pc.Build(locations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	midiState := &midi.MidiState{}
+	controls.Reset(midiState)
+	framesIn := make(chan *Frame, 0)
+	framesOut := make(chan *Frame, 0)
+	go RunStage(pipeline.Source, framesIn, framesOut, midiState)
+
+	frames := []*Frame{NewFrame(len(locations) / 3), NewFrame(len(locations) / 3)}
+	var seq, lastSeq uint64
+	for ii := 0; ii < 60; ii++ {
+		if ii == 20 {
+			if err := pipeline.Switcher.SwitchTo("eye"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		clock.Tick()
+		seq++
+		frame := frames[ii%2]
+		frame.Seq, frame.Time, frame.Delta = seq, clock.Now(), clock.Delta()
+		framesIn <- frame
+		frame = <-framesOut
+		if frame.Seq != seq || frame.Seq != lastSeq+1 {
+			t.Fatalf("frame %v: sent sequence number %v and got back %v after %v", ii, seq, frame.Seq, lastSeq)
+		}
+		lastSeq = frame.Seq
+	}
+	close(framesIn)
+	for _ = range framesOut {
+		t.Fatal("got a frame after shutting down")
+	}
+}
+
+func TestFrameSetLengthAndScale(t *testing.T) {
+	frame := &Frame{Pixels: []float32{0.5, 1, 2}}
+	frame.Scale(0.5)
+	if frame.Pixels[0] != 0.25 || frame.Pixels[1] != 0.5 || frame.Pixels[2] != 1 {
+		t.Errorf("expected every channel halved, got %v", frame.Pixels)
+	}
+	frame.SetLength(1)
+	frame.SetLength(3)
+	if len(frame.Pixels) != 3 || frame.Pixels[2] != 1 {
+		t.Errorf("growing back within capacity should keep the values, got %v", frame.Pixels)
+	}
+	frame.SetLength(6)
+	if len(frame.Pixels) != 6 {
+		t.Errorf("expected 6 channels, got %v", len(frame.Pixels))
+	}
+}
+
+func TestFloatToByte(t *testing.T) {
+	tests := []struct {
+		x    float32
+		want byte
+	}{
+		{-1, 0},
+		{0, 0},
+		{0.5 / 255, 1},
+		{0.49 / 255, 0},
+		{0.5, 128},
+		{1, 255},
+		{1.5, 255},
+		{float32(math.Inf(1)), 255},
+	}
+	for _, test := range tests {
+		if got := FloatToByte(test.x); got != test.want {
+			t.Errorf("FloatToByte(%v): got %v, want %v", test.x, got, test.want)
+		}
+	}
+}
+
+func TestApplyGamma(t *testing.T) {
+	if applyGamma(-0.5) != 0 || applyGamma(0) != 0 || applyGamma(1) != 1 || applyGamma(3) != 1 {
+		t.Errorf("expected the ends to be clipped to 0 and 1")
+	}
+	last := 0.0
+	for ii := 1; ii <= 1000; ii++ {
+		x := float32(ii) / 1000
+		got := applyGamma(x)
+		want := math.Pow(float64(x), GAMMA)
+		if math.Abs(got-want) > 1e-5 {
+			t.Errorf("applyGamma(%v): got %v, want %v", x, got, want)
+		}
+		if got <= last {
+			t.Errorf("applyGamma should always increase, but applyGamma(%v) is %v after %v", x, got, last)
+		}
+		last = got
+	}
+}
@@ -0,0 +1,178 @@
+package opc
+
+// Frame interpolation
+//   A source like the OPC server might only send 15 frames a second while we output 60.
+//   Instead of showing each frame for four output frames and then jumping, the
+//   interpolator runs the source in its own goroutine, timestamps the frames as they
+//   arrive, and blends between the last two at output time.
+//
+//   Blending between the last two frames means showing things a little late: up to one
+//   source frame interval, but never more than the max latency.  If the source keeps
+//   up with the output rate, frames pass straight through with no extra latency.
+//
+//   Timestamps come from the frame clock: a frame is stamped with the time of the latest
+//   output frame when it arrives.  The source renders while the main loop moves on to
+//   later frames, so it sees whichever frame's time is current (see the clock package).
+//
+//   With a fixed step or offline clock, frames take no clock time to render, so the
+//   source always keeps up: each output frame waits for the source to render it and
+//   passes it straight through.  That keeps the output the same every run.
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/longears/pixelslinger/clock"
+	"github.com/longears/pixelslinger/colorutils"
+	"github.com/longears/pixelslinger/midi"
+)
+
+// Interpolation modes
+const (
+	INTERPOLATE_OFF    = "off"    // don't interpolate; the output waits for the source
+	INTERPOLATE_LINEAR = "linear" // blend evenly from one frame to the next
+	INTERPOLATE_EASED  = "eased"  // blend slowly at the start and end of each step, faster in the middle
+)
+
+var INTERPOLATE_MODES = []string{INTERPOLATE_OFF, INTERPOLATE_LINEAR, INTERPOLATE_EASED}
+
+// Default for the longest we'll delay frames in order to blend them, in seconds
+const DEFAULT_MAX_LATENCY = 0.1
+
+// If the source's frames arrive at most this many times the output's frame interval apart,
+// the source is keeping up and its frames pass straight through.
+const INTERPOLATE_KEEPING_UP = 1.25
+
+func isInterpolateMode(mode string) bool {
+	for _, m := range INTERPOLATE_MODES {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// A frame from the source and when it arrived.
+type timedFrame struct {
+	pixels []float32
+	t      float64 // frame clock seconds
+}
+
+// Return a FrameThread which runs the given source thread in the background and blends
+// between its two most recent frames, using the given mode (one of INTERPOLATE_MODES).
+// maxLatency is in seconds.  With INTERPOLATE_OFF, the thread is returned unchanged.
+func MakeInterpolateThread(thread FrameThread, mode string, maxLatency float64) FrameThread {
+	if mode == INTERPOLATE_OFF || mode == "" {
+		return thread
+	}
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+		fmt.Printf("[opc.InterpolateThread] %s interpolation, max latency %v ms\n", mode, maxLatency*1000)
+		lockstep := !clock.IsRealtime()
+		var mutex sync.Mutex
+		var previous, newest timedFrame   // guarded by mutex
+		nFrames := 0                      // guarded by mutex; how many frames have arrived
+		frameSize := 0                    // guarded by mutex; number of channels in the frames we're asked to fill
+		var frameTime, frameDelta float64 // guarded by mutex; of the most recent output frame
+		var frameSeq uint64               // guarded by mutex; ditto
+		arrived := make(chan bool, 1)     // pinged when a frame arrives
+		wantFrame := make(chan bool, 1)   // pinged once per output frame so the source doesn't run faster than we need
+
+		// the source gets its own copy of the MidiState since it runs while the main loop is updating
+		// the real one.  we refresh the copy once per output frame.
+		var midiSnapshot midi.MidiState // guarded by mutex
+		privateState := &midi.MidiState{}
+
+		go func() {
+			chanToThread := make(chan *Frame, 0)
+			chanFromThread := make(chan *Frame, 0)
+			go thread(chanToThread, chanFromThread, privateState)
+
+			spare := &Frame{}
+			for _ = range wantFrame {
+				mutex.Lock()
+				*privateState = midiSnapshot
+				spare.SetLength(frameSize)
+				spare.Seq, spare.Time, spare.Delta = frameSeq, frameTime, frameDelta
+				mutex.Unlock()
+
+				chanToThread <- spare
+				spare = <-chanFromThread
+				frame := timedFrame{spare.Pixels, clock.Now()}
+
+				mutex.Lock()
+				spare.Pixels = previous.pixels
+				previous = newest
+				newest = frame
+				nFrames += 1
+				mutex.Unlock()
+				select {
+				case arrived <- true:
+				default:
+				}
+			}
+			close(chanToThread)
+		}()
+
+		lastOutputTime := 0.0
+		outputInterval := 0.0
+		for frame := range framesIn {
+			mutex.Lock()
+			midiSnapshot = *midiState
+			frameSize = len(frame.Pixels)
+			frameSeq, frameTime, frameDelta = frame.Seq, frame.Time, frame.Delta
+			mutex.Unlock()
+			select {
+			case wantFrame <- true:
+			default:
+			}
+
+			// keep track of how often we output frames
+			t := clock.Now()
+			if lastOutputTime > 0 {
+				outputInterval = t - lastOutputTime
+			}
+			lastOutputTime = t
+
+			// the very first frame has to wait for the source, and so does every frame
+			// if the clock isn't the wall clock
+			mutex.Lock()
+			if nFrames == 0 || lockstep {
+				mutex.Unlock()
+				<-arrived
+				mutex.Lock()
+			}
+			frame.Pixels = interpolateFrames(frame.Pixels, previous, newest, nFrames, t, outputInterval, mode, maxLatency)
+			mutex.Unlock()
+
+			framesOut <- frame
+		}
+		close(wantFrame)
+	}
+}
+
+// Fill pixels with the frame to show at time t.
+func interpolateFrames(pixels []float32, previous, newest timedFrame, nFrames int, t, outputInterval float64, mode string, maxLatency float64) []float32 {
+	sourceInterval := newest.t - previous.t
+	keepingUp := nFrames < 2 || sourceInterval <= outputInterval*INTERPOLATE_KEEPING_UP
+	if keepingUp || len(previous.pixels) != len(newest.pixels) {
+		return append(pixels[:0], newest.pixels...)
+	}
+
+	// blend from the previous frame to the newest one over one source interval, or maxLatency if that's shorter
+	duration := math.Min(sourceInterval, maxLatency)
+	pct := 1.0
+	if duration > 0 {
+		pct = colorutils.Clamp((t-newest.t)/duration, 0, 1)
+	}
+	if mode == INTERPOLATE_EASED {
+		pct = pct * pct * (3 - 2*pct)
+	}
+
+	pixels = pixels[:0]
+	for ii, b := range newest.pixels {
+		a := float64(previous.pixels[ii])
+		pixels = append(pixels, float32(a+(float64(b)-a)*pct))
+	}
+	return pixels
+}
@@ -0,0 +1,112 @@
+package opc
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/longears/pixelslinger/clock"
+	"github.com/longears/pixelslinger/midi"
+)
+
+//================================================================================
+func TestInterpolateFrames(t *testing.T) {
+	black := timedFrame{[]float32{0, 0, 0}, 10}
+	white := timedFrame{[]float32{0.8, 0.8, 0.8}, 10.1}
+	short := timedFrame{[]float32{0.8}, 10.1}
+	tests := []struct {
+		name           string
+		previous       timedFrame
+		newest         timedFrame
+		nFrames        int
+		t              float64
+		outputInterval float64
+		mode           string
+		maxLatency     float64
+		want           float32
+	}{
+		{"only one frame", timedFrame{}, white, 1, 10.15, 0.025, INTERPOLATE_LINEAR, 1, 0.8},
+		{"keeping up", black, white, 2, 10.15, 0.1, INTERPOLATE_LINEAR, 1, 0.8},
+		{"nearly keeping up", black, white, 2, 10.15, 0.1 / INTERPOLATE_KEEPING_UP, INTERPOLATE_LINEAR, 1, 0.8},
+		{"start of the blend", black, white, 2, 10.1, 0.025, INTERPOLATE_LINEAR, 1, 0},
+		{"linear halfway", black, white, 2, 10.15, 0.025, INTERPOLATE_LINEAR, 1, 0.4},
+		{"linear a quarter of the way", black, white, 2, 10.125, 0.025, INTERPOLATE_LINEAR, 1, 0.2},
+		{"eased a quarter of the way", black, white, 2, 10.125, 0.025, INTERPOLATE_EASED, 1, 0.125},
+		{"eased halfway", black, white, 2, 10.15, 0.025, INTERPOLATE_EASED, 1, 0.4},
+		{"after the blend", black, white, 2, 10.5, 0.025, INTERPOLATE_LINEAR, 1, 0.8},
+		{"max latency shortens the blend", black, white, 2, 10.125, 0.025, INTERPOLATE_LINEAR, 0.05, 0.4},
+		{"no latency allowed", black, white, 2, 10.1, 0.025, INTERPOLATE_LINEAR, 0, 0.8},
+	}
+	for _, test := range tests {
+		pixels := interpolateFrames(make([]float32, 3), test.previous, test.newest, test.nFrames, test.t, test.outputInterval, test.mode, test.maxLatency)
+		if len(pixels) != 3 || math.Abs(float64(pixels[0]-test.want)) > 1e-6 || math.Abs(float64(pixels[2]-test.want)) > 1e-6 {
+			t.Errorf("%s: got %v, want %v", test.name, pixels, test.want)
+		}
+	}
+
+	// frames of different sizes can't be blended, so the newest one is shown
+	pixels := interpolateFrames(make([]float32, 3), black, short, 2, 10.15, 0.025, INTERPOLATE_LINEAR, 1)
+	if len(pixels) != 1 || pixels[0] != 0.8 {
+		t.Errorf("size mismatch: got %v, want the newest frame", pixels)
+	}
+}
+
+// A source which fills every pixel with its frame number by the clock, taking a while
+// to do it.
+func makeSlowClockSource(step float64, delay time.Duration) ByteThread {
+	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		for bytes := range bytesIn {
+			n := byte((clock.Now()-clock.FIXED_START_TIME)/step + 0.5)
+			time.Sleep(delay)
+			for ii := range bytes {
+				bytes[ii] = n
+			}
+			bytesOut <- bytes
+		}
+	}
+}
+
+// Tick the clock and pull frames from thread like the main loop does.
+// Returns the frames as bytes.
+func runLikeMainLoop(thread FrameThread, nFrames int, delay time.Duration) [][]byte {
+	framesIn := make(chan *Frame, 0)
+	framesOut := make(chan *Frame, 0)
+	go thread(framesIn, framesOut, &midi.MidiState{})
+	frames := [][]byte{}
+	frame := NewFrame(2)
+	for ii := 0; ii < nFrames; ii++ {
+		clock.Tick()
+		frame.Time, frame.Delta = clock.Now(), clock.Delta()
+		framesIn <- frame
+		frame = <-framesOut
+		frames = append(frames, frame.ToBytes(nil))
+		time.Sleep(delay)
+	}
+	close(framesIn)
+	return frames
+}
+
+func TestInterpolateWithRealtimeClock(t *testing.T) {
+	// the source reads the clock while the main loop ticks it; go test -race checks this
+	clock.Set(clock.NewRealTimeClock())
+	thread := MakeInterpolateThread(MakeFrameThread(makeSlowClockSource(1, 5*time.Millisecond)), INTERPOLATE_LINEAR, 0.1)
+	frames := runLikeMainLoop(thread, 40, time.Millisecond)
+	if len(frames) != 40 || len(frames[39]) != 6 {
+		t.Errorf("expected 40 frames of 6 bytes, got %v", frames)
+	}
+}
+
+func TestInterpolateWithFixedClock(t *testing.T) {
+	// with a fixed clock, each frame is rendered by the source for that frame's time
+	step := 1.0 / 40
+	clock.Set(clock.NewFixedStepClock(step))
+	defer clock.Set(clock.NewRealTimeClock())
+	thread := MakeInterpolateThread(MakeFrameThread(makeSlowClockSource(step, time.Millisecond)), INTERPOLATE_EASED, 0.1)
+	for ii, frame := range runLikeMainLoop(thread, 30, 0) {
+		for _, b := range frame {
+			if b != byte(ii) {
+				t.Fatalf("frame %v: got %v, want every byte to be %v", ii, frame, ii)
+			}
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package opc
+
+// Layers
+//   A layers source runs several patterns from PATTERN_REGISTRY at once and stacks
+//   their frames on top of each other, like layers in a paint program.
+//   Choose it with "--source layers:path/to/file.json".
+//
+//   {
+//       "layers": [
+//           {"name": "fire"},
+//           {"name": "raver-plaid", "blend": "screen", "opacity": 0.4, "opacity_knob": "morph"},
+//           {"name": "aqua", "mask": {"name": "spatial-stripes"}, "invert_mask": true}
+//       ]
+//   }
+//
+//   The first layer is on the bottom.  Each layer is blended onto the layers below it with
+//   its blend mode (one of BLEND_MODES, default "normal") and its opacity (0 to 1, default 1).
+//   If "opacity_knob" names a float control (see the controls package), the opacity is multiplied by it.
+//   "mask" is another pattern whose brightness at each pixel scales the layer's opacity there;
+//   "invert_mask" flips it.  Layers and masks take "params" to pin controls, like pipeline stages.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+
+	"github.com/longears/pixelslinger/colorutils"
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+)
+
+// Sources starting with this are layer files
+const LAYERS_PREFIX = "layers:"
+
+// Blend modes
+const (
+	BLEND_NORMAL     = "normal"     // the layer covers what's below it
+	BLEND_ADD        = "add"        // add the layer to what's below, clipping at full brightness
+	BLEND_MULTIPLY   = "multiply"   // darken what's below by the layer
+	BLEND_SCREEN     = "screen"     // brighten what's below by the layer, without clipping
+	BLEND_LIGHTEN    = "lighten"    // the brighter of the layer and what's below
+	BLEND_DIFFERENCE = "difference" // the absolute difference between the layer and what's below
+)
+
+var BLEND_MODES = []string{
+	BLEND_NORMAL,
+	BLEND_ADD,
+	BLEND_MULTIPLY,
+	BLEND_SCREEN,
+	BLEND_LIGHTEN,
+	BLEND_DIFFERENCE,
+}
+
+//--------------------------------------------------------------------------------
+// TYPES
+
+// One layer in a layers file.
+type LayerConfig struct {
+	StageConfig
+	Blend       string       `json:"blend,omitempty"`        // one of BLEND_MODES, default BLEND_NORMAL
+	Opacity     *float64     `json:"opacity,omitempty"`      // 0 to 1, default 1
+	OpacityKnob string       `json:"opacity_knob,omitempty"` // name of a FLOAT control, or "" for none
+	Mask        *StageConfig `json:"mask,omitempty"`         // pattern whose brightness scales the opacity per pixel
+	InvertMask  bool         `json:"invert_mask,omitempty"`
+}
+
+// The contents of a layers file.
+type LayersConfig struct {
+	Layers []LayerConfig `json:"layers"`
+}
+
+//--------------------------------------------------------------------------------
+// LOADING
+
+// Read a layers file and validate it.
+func ReadLayersConfig(fn string) (*LayersConfig, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("could not read layers file %s: %v", fn, err)
+	}
+	lc := &LayersConfig{}
+	if err := json.Unmarshal(data, lc); err != nil {
+		return nil, fmt.Errorf("could not parse layers file %s: %v", fn, err)
+	}
+	if err := lc.validate(); err != nil {
+		return nil, fmt.Errorf("bad layers file %s: %v", fn, err)
+	}
+	return lc, nil
+}
+
+func (lc *LayersConfig) validate() error {
+	if len(lc.Layers) == 0 {
+		return fmt.Errorf("no layers")
+	}
+	for _, layer := range lc.Layers {
+		if _, ok := PATTERN_REGISTRY[layer.Name]; !ok {
+			return fmt.Errorf("unknown pattern \"%s\"", layer.Name)
+		}
+		if err := validateKnobParams(layer.StageConfig); err != nil {
+			return err
+		}
+		if layer.Blend != "" && !isBlendMode(layer.Blend) {
+			return fmt.Errorf("unknown blend mode \"%s\" (should be one of %s)", layer.Blend, strings.Join(BLEND_MODES, ", "))
+		}
+		if layer.Opacity != nil && (*layer.Opacity < 0 || *layer.Opacity > 1) {
+			return fmt.Errorf("opacity for \"%s\" should be between 0 and 1, got %v", layer.Name, *layer.Opacity)
+		}
+		if c := controls.Lookup(layer.OpacityKnob); layer.OpacityKnob != "" && (c == nil || c.Kind != controls.FLOAT) {
+			return fmt.Errorf("unknown opacity_knob \"%s\" for \"%s\" (should be one of %s)", layer.OpacityKnob, layer.Name, strings.Join(controls.Names(controls.FLOAT), ", "))
+		}
+		if layer.Mask != nil {
+			if _, ok := PATTERN_REGISTRY[layer.Mask.Name]; !ok {
+				return fmt.Errorf("unknown mask pattern \"%s\"", layer.Mask.Name)
+			}
+			if err := validateKnobParams(*layer.Mask); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isBlendMode(mode string) bool {
+	for _, m := range BLEND_MODES {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+//--------------------------------------------------------------------------------
+// BLENDING
+
+// Blend one channel of a layer (b) onto what's below it (a).  Values go from 0 to 1.
+func BlendChannel(mode string, a, b float64) float64 {
+	switch mode {
+	case BLEND_ADD:
+		return math.Min(a+b, 1)
+	case BLEND_MULTIPLY:
+		return a * b
+	case BLEND_SCREEN:
+		return 1 - (1-a)*(1-b)
+	case BLEND_LIGHTEN:
+		return math.Max(a, b)
+	case BLEND_DIFFERENCE:
+		return math.Abs(a - b)
+	}
+	return b // BLEND_NORMAL
+}
+
+//--------------------------------------------------------------------------------
+// SOURCE
+
+// A layer which has been launched.
+type runningLayer struct {
+	config    LayerConfig
+	pattern   *subPattern
+	mask      *subPattern // nil if no mask
+	frame     *Frame
+	maskFrame *Frame
+}
+
+// Return a FrameThread which stacks up the layers in the given file.
+// The file should already have been checked with ReadLayersConfig.
+func MakeLayersThread(fn string, locations []float64) FrameThread {
+	lc, err := ReadLayersConfig(fn)
+	if err != nil {
+		panic(fmt.Sprintf("[opc.LayersThread] %v", err))
+	}
+
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+		fmt.Printf("[opc.LayersThread] stacking %v layers from %s\n", len(lc.Layers), fn)
+		layers := make([]*runningLayer, len(lc.Layers))
+		for ii, layerConfig := range lc.Layers {
+			layer := &runningLayer{config: layerConfig, frame: &Frame{}, maskFrame: &Frame{}}
+			layer.pattern = startSubPattern(layerConfig.Name, layerConfig.Params, locations, midiState)
+			if layerConfig.Mask != nil {
+				layer.mask = startSubPattern(layerConfig.Mask.Name, layerConfig.Mask.Params, locations, midiState)
+			}
+			layers[ii] = layer
+		}
+
+		for frame := range framesIn {
+			// let all the patterns render at the same time
+			for _, layer := range layers {
+				layer.frame.CopyFrom(frame)
+				layer.pattern.chanToPattern <- layer.frame
+				if layer.mask != nil {
+					layer.maskFrame.CopyFrom(frame)
+					layer.mask.chanToPattern <- layer.maskFrame
+				}
+			}
+			for _, layer := range layers {
+				layer.frame = <-layer.pattern.chanFromPattern
+				if layer.mask != nil {
+					layer.maskFrame = <-layer.mask.chanFromPattern
+				}
+			}
+
+			// stack them up, starting from black
+			for ii := range frame.Pixels {
+				frame.Pixels[ii] = 0
+			}
+			for _, layer := range layers {
+				layer.composite(frame.Pixels, midiState)
+			}
+
+			framesOut <- frame
+		}
+
+		for _, layer := range layers {
+			layer.pattern.stop()
+			if layer.mask != nil {
+				layer.mask.stop()
+			}
+		}
+	}
+}
+
+// Blend this layer's most recent frame onto the canvas.
+func (layer *runningLayer) composite(canvas []float32, midiState *midi.MidiState) {
+	opacity := 1.0
+	if layer.config.Opacity != nil {
+		opacity = *layer.config.Opacity
+	}
+	if layer.config.OpacityKnob != "" {
+		opacity *= controls.Lookup(layer.config.OpacityKnob).Get(midiState)
+	}
+	mode := layer.config.Blend
+
+	// patterns are allowed to send back the wrong number of pixels
+	pixels := layer.frame.Pixels
+	maskPixels := layer.maskFrame.Pixels
+	n_pixels := len(canvas) / 3
+	if len(pixels)/3 < n_pixels {
+		n_pixels = len(pixels) / 3
+	}
+
+	for ii := 0; ii < n_pixels; ii++ {
+		pixelOpacity := opacity
+		if layer.mask != nil {
+			mask := 0.0
+			if ii*3+2 < len(maskPixels) {
+				// the brightest channel decides
+				mask = colorutils.Clamp(float64(maxFloat(maskPixels[ii*3], maskPixels[ii*3+1], maskPixels[ii*3+2])), 0, 1)
+			}
+			if layer.config.InvertMask {
+				mask = 1 - mask
+			}
+			pixelOpacity *= mask
+		}
+		if pixelOpacity <= 0 {
+			continue
+		}
+		for jj := ii * 3; jj < ii*3+3; jj++ {
+			a := float64(canvas[jj])
+			b := float64(pixels[jj])
+			canvas[jj] = float32(a*(1-pixelOpacity) + BlendChannel(mode, a, b)*pixelOpacity)
+		}
+	}
+}
+
+func maxFloat(r, g, b float32) float32 {
+	if g > r {
+		r = g
+	}
+	if b > r {
+		r = b
+	}
+	return r
+}
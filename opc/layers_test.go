@@ -0,0 +1,135 @@
+package opc
+
+import (
+	"math"
+	"testing"
+
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+)
+
+func closeTo(got, want []float32) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for ii := range got {
+		if math.Abs(float64(got[ii]-want[ii])) > 1e-6 {
+			return false
+		}
+	}
+	return true
+}
+
+// Make a layer whose latest frame is pixels, as if its pattern had just rendered.
+// If maskPixels isn't nil the layer has a mask which just rendered those.
+func makeTestLayer(config LayerConfig, pixels, maskPixels []float32) *runningLayer {
+	layer := &runningLayer{config: config, frame: &Frame{Pixels: pixels}, maskFrame: &Frame{Pixels: maskPixels}}
+	if maskPixels != nil {
+		layer.mask = &subPattern{name: "test mask"}
+	}
+	return layer
+}
+
+//================================================================================
+func TestBlendChannel(t *testing.T) {
+	tests := []struct {
+		mode string
+		a, b float64
+		want float64
+	}{
+		{BLEND_NORMAL, 0.6, 0.5, 0.5},
+		{"", 0.6, 0.5, 0.5},
+		{BLEND_ADD, 0.6, 0.5, 1},
+		{BLEND_MULTIPLY, 0.6, 0.5, 0.3},
+		{BLEND_SCREEN, 0.6, 0.5, 0.8},
+		{BLEND_LIGHTEN, 0.6, 0.5, 0.6},
+		{BLEND_DIFFERENCE, 0.6, 0.5, 0.1},
+	}
+	for _, test := range tests {
+		if got := BlendChannel(test.mode, test.a, test.b); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%q: BlendChannel(%v, %v) = %v, want %v", test.mode, test.a, test.b, got, test.want)
+		}
+	}
+	for _, mode := range BLEND_MODES {
+		found := false
+		for _, test := range tests {
+			found = found || test.mode == mode
+		}
+		if !found {
+			t.Errorf("no test for blend mode %q", mode)
+		}
+	}
+}
+
+func TestCompositeOpacity(t *testing.T) {
+	midiState := &midi.MidiState{}
+	controls.Reset(midiState)
+	below := []float32{0.2, 0.4, 0.6, 1, 1, 1}
+	layerPixels := []float32{1, 1, 1, 0, 0, 0}
+	zero, half, one := 0.0, 0.5, 1.0
+	tests := []struct {
+		config LayerConfig
+		want   []float32
+	}{
+		{LayerConfig{Opacity: &zero}, below},
+		{LayerConfig{Opacity: &one}, layerPixels},
+		{LayerConfig{}, layerPixels}, // default opacity is 1
+		{LayerConfig{Opacity: &half}, []float32{0.6, 0.7, 0.8, 0.5, 0.5, 0.5}},
+		{LayerConfig{Opacity: &one, Blend: BLEND_MULTIPLY}, []float32{0.2, 0.4, 0.6, 0, 0, 0}},
+		{LayerConfig{Opacity: &half, Blend: BLEND_ADD}, []float32{0.6, 0.7, 0.8, 1, 1, 1}},
+	}
+	for _, test := range tests {
+		canvas := append([]float32{}, below...)
+		makeTestLayer(test.config, layerPixels, nil).composite(canvas, midiState)
+		if !closeTo(canvas, test.want) {
+			t.Errorf("%+v: got %v, want %v", test.config, canvas, test.want)
+		}
+	}
+
+	// the opacity knob scales the opacity
+	controls.MORPH.Set(midiState, 0.5)
+	canvas := append([]float32{}, below...)
+	makeTestLayer(LayerConfig{OpacityKnob: "morph"}, layerPixels, nil).composite(canvas, midiState)
+	if want := []float32{0.6, 0.7, 0.8, 0.5, 0.5, 0.5}; !closeTo(canvas, want) {
+		t.Errorf("opacity knob at 0.5: got %v, want %v", canvas, want)
+	}
+	controls.MORPH.Set(midiState, 0)
+	canvas = append([]float32{}, below...)
+	makeTestLayer(LayerConfig{OpacityKnob: "morph"}, layerPixels, nil).composite(canvas, midiState)
+	if !closeTo(canvas, below) {
+		t.Errorf("opacity knob at 0: got %v, want %v", canvas, below)
+	}
+
+	// a layer with too few pixels leaves the rest of the canvas alone
+	canvas = append([]float32{}, below...)
+	makeTestLayer(LayerConfig{}, []float32{0, 0, 0}, nil).composite(canvas, midiState)
+	if want := []float32{0, 0, 0, 1, 1, 1}; !closeTo(canvas, want) {
+		t.Errorf("short layer: got %v, want %v", canvas, want)
+	}
+}
+
+func TestCompositeMask(t *testing.T) {
+	midiState := &midi.MidiState{}
+	controls.Reset(midiState)
+	below := []float32{0, 0, 0, 0, 0, 0, 0, 0, 0}
+	layerPixels := []float32{1, 1, 1, 1, 1, 1, 1, 1, 1}
+	// the brightest channel of each mask pixel is its opacity, clipped to 0 to 1;
+	// the third pixel is missing from the mask
+	maskPixels := []float32{0, 2, 0, 0.25, 0, 0.1}
+	half := 0.5
+	tests := []struct {
+		config LayerConfig
+		want   []float32
+	}{
+		{LayerConfig{}, []float32{1, 1, 1, 0.25, 0.25, 0.25, 0, 0, 0}},
+		{LayerConfig{InvertMask: true}, []float32{0, 0, 0, 0.75, 0.75, 0.75, 1, 1, 1}},
+		{LayerConfig{Opacity: &half}, []float32{0.5, 0.5, 0.5, 0.125, 0.125, 0.125, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		canvas := append([]float32{}, below...)
+		makeTestLayer(test.config, layerPixels, maskPixels).composite(canvas, midiState)
+		if !closeTo(canvas, test.want) {
+			t.Errorf("%+v: got %v, want %v", test.config, canvas, test.want)
+		}
+	}
+}
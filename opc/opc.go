@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/longears/pixelslinger/metrics"
 	"github.com/longears/pixelslinger/midi"
 )
 
@@ -21,6 +22,11 @@ import (
 
 var PATTERN_REGISTRY map[string](func(locations []float64) ByteThread)
 
+// Effects take frames from a source (or another effect) and modify them.
+// They are chained after the source by pipeline files.
+// They work on Frames so they don't lose precision; byte-based effects can be added with MakeFrameThread.
+var EFFECT_REGISTRY map[string](func(locations []float64) FrameThread)
+
 func init() {
 	// This has to happen in init() to avoid an initialization loop (circular dependency)
 	// because the midi-switcher pattern reads from this map.
@@ -47,6 +53,10 @@ func init() {
 		"house-potty":     MakePatternHousePotty,
 		"colorbox":        MakePatternSpatialColorBox,
 	}
+	EFFECT_REGISTRY = map[string](func(locations []float64) FrameThread){
+		"fader":       MakeEffectFader,
+		"potty-fader": MakeEffectPottyFader,
+	}
 }
 
 //--------------------------------------------------------------------------------
@@ -170,13 +180,16 @@ func MakeSendToScreenThread() ByteThread {
 	}
 }
 
-// Return a ByteThread which writes bytes to SPI via the given filename (such as "/dev/spidev1.0").
+// Return a FrameThread which writes frames to SPI via the given filename (such as "/dev/spidev1.0").
 // Format the outgoing bytes for LED strips which use the LPD8806 chipset.
 // If the SPI device can't be opened, exit the whole program with exit status 1.
 // This chipset expects colors in G R B order; this function is responsible for swapping from
 // the usual R G B order.
-func MakeSendToLPD8806Thread(spiFn string) ByteThread {
-	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+// Gamma is applied to the frame's floats and then they're quantized to the chipset's 7 bits.
+// If dither is true, use temporal dithering to hide the banding caused by the 7 bits.
+// See Ditherer.
+func MakeSendToLPD8806Thread(spiFn string, dither bool) FrameThread {
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
 		fmt.Println("[opc.SendToLPD8806Thread] starting up")
 
 		// open output file and keep the file descriptor around
@@ -193,51 +206,49 @@ func MakeSendToLPD8806Thread(spiFn string) ByteThread {
 			}
 		}()
 
-		gamma_lookup := make([]byte, 256)
-		for ii := 0; ii < 256; ii++ {
-			floatVal := math.Pow(float64(ii)/255, GAMMA)
-			if floatVal >= 1 {
-				gamma_lookup[ii] = 255
-			} else {
-				gamma_lookup[ii] = byte(floatVal * 256)
-			}
-		}
+		ditherer := NewDitherer(dither)
+
+		// as we get frames over the channel...
+		for frame := range framesIn {
+			pixels := frame.Pixels
+			ditherer.BeginFrame(len(pixels))
 
-		// as we get byte slices over the channel...
-		for bytes := range bytesIn {
 			// build a new slice of bytes in the format the LED strand wants
 			// TODO: avoid allocating these bytes over and over
 			spiBytes := make([]byte, 0)
 
 			// leading zeros to begin a new frame of bytes
-			numZeroes := (len(bytes)+31)/32 + 2
+			numZeroes := (len(pixels)+31)/32 + 2
 			for ii := 0; ii < numZeroes*5; ii++ {
 				spiBytes = append(spiBytes, 0)
 			}
 
 			// actual bytes
-			//for _, v := range bytes {
-			for ii := 0; ii < len(bytes)-2; ii += 3 {
-				// apply gamma lookup table
-				r := gamma_lookup[bytes[ii+0]]
-				g := gamma_lookup[bytes[ii+1]]
-				b := gamma_lookup[bytes[ii+2]]
+			for ii := 0; ii < len(pixels)-2; ii += 3 {
+				// apply gamma at full precision
+				rf := applyGamma(pixels[ii+0])
+				gf := applyGamma(pixels[ii+1])
+				bf := applyGamma(pixels[ii+2])
 
 				// HACK
 				// white balance for the strips with white backing
 				// red needs a boost
 				// green and blue are too strong
 				if ii >= 160*3 {
-					//r = byte(math.Pow(float64(r)/256.0, 0.7) * 256.0)
-					g = byte(float64(g) * 0.8)
-					b = byte(float64(b) * 0.7)
+					gf *= 0.8
+					bf *= 0.7
 				}
 
+				// quantize to the chipset's seven bits, carrying the error to the next frame if dithering
+				r := ditherer.Quantize(ii+0, rf, 127)
+				g := ditherer.Quantize(ii+1, gf, 127)
+				b := ditherer.Quantize(ii+2, bf, 127)
+
 				// format for LPD8806
 				// high bit must be always on, remaining seven bits are data
-				r = 128 | (r >> 1)
-				g = 128 | (g >> 1)
-				b = 128 | (b >> 1)
+				r = 128 | r
+				g = 128 | g
+				b = 128 | b
 				// swap to [g r b] order
 				if ii < 160*3 {
 					// copper-colored strip
@@ -273,42 +284,40 @@ func MakeSendToLPD8806Thread(spiFn string) ByteThread {
 			}
 			//fmt.Println(bytesSent,len(spiBytes))
 
-			bytesOut <- bytes
+			framesOut <- frame
 		}
 	}
 }
 
-// Return a ByteThread which sends the bytes out as OPC messages to the given ipPort.
-// Create OPC headers for each byte slice it sends.
+// Return a FrameThread which sends the frames out as OPC messages to the given ipPort.
+// Gamma correct each frame, quantize it to bytes, and create an OPC header for it.
 // Initiate and maintains a long-lived connection to ipPort.  If the connection is bad at any point
 // (or was never good to begin with), keep trying to reconnect whenever new bytes come in.
 // Can sleep for WAIT_TO_RETRY during reconnection attempts; this blocks the input channel.
-// Silently drop bytes if it's not possible to send them.
-func MakeSendToOpcThread(ipPort string) ByteThread {
-	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+// Silently drop frames if it's not possible to send them.
+// Dropped frames and reconnection attempts are counted in the metrics package.
+func MakeSendToOpcThread(ipPort string) FrameThread {
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
 		fmt.Println("[opc.SendToOpcThread] starting up")
 
 		var conn net.Conn
 		var err error
+		triedToConnect := false
+		bytes := make([]byte, 0)
 
-		gamma_lookup := make([]byte, 256)
-		for ii := 0; ii < 256; ii++ {
-			floatVal := math.Pow(float64(ii)/255, GAMMA)
-			if floatVal >= 1 {
-				gamma_lookup[ii] = 255
-			} else {
-				gamma_lookup[ii] = byte(floatVal * 256)
-			}
-		}
-
-		for bytes := range bytesIn {
+		for frame := range framesIn {
 			// if the connection has gone bad, make a new one
 			if conn == nil {
+				if triedToConnect {
+					metrics.DEST_RECONNECTS.Add(ipPort, 1)
+				}
 				conn = getConnection(ipPort)
+				triedToConnect = true
 			}
 			// if that didn't work, wait a second and restart the loop
 			if conn == nil {
-				bytesOut <- bytes
+				metrics.FRAMES_DROPPED.Add("unsent", 1)
+				framesOut <- frame
 				fmt.Println("[opc.SendToOpcThread] waiting to retry")
 				time.Sleep(WAIT_TO_RETRY * time.Millisecond)
 				continue
@@ -316,11 +325,12 @@ func MakeSendToOpcThread(ipPort string) ByteThread {
 
 			// ok, at this point the connection is good
 
-			// gamma correct
+			// gamma correct and quantize
 			// HACK: change this later when we decide if OPC should have
 			// pixels in perceptual or linear space
-			for ii := range bytes {
-				bytes[ii] = gamma_lookup[bytes[ii+0]]
+			bytes = bytes[:0]
+			for _, x := range frame.Pixels {
+				bytes = append(bytes, byte(math.Min(applyGamma(x)*256, 255)))
 			}
 
 			// make and send OPC header
@@ -334,7 +344,8 @@ func MakeSendToOpcThread(ipPort string) ByteThread {
 				// net error -- set conn to nil so we can try to make a new one
 				fmt.Println("[opc.SendToOpcThread]", err)
 				conn = nil
-				bytesOut <- bytes
+				metrics.FRAMES_DROPPED.Add("unsent", 1)
+				framesOut <- frame
 				continue
 			}
 
@@ -344,10 +355,16 @@ func MakeSendToOpcThread(ipPort string) ByteThread {
 				// net error -- set conn to nil so we can try to make a new one
 				fmt.Println("[opc.SendToOpcThread]", err)
 				conn = nil
-				bytesOut <- bytes
+				metrics.FRAMES_DROPPED.Add("unsent", 1)
+				framesOut <- frame
 				continue
 			}
-			bytesOut <- bytes
+			framesOut <- frame
+		}
+
+		// input channel has been closed; hang up
+		if conn != nil {
+			conn.Close()
 		}
 	}
 }
@@ -371,6 +388,8 @@ func handleOpcConnection(conn net.Conn, incomingOpcMessageChan chan *OpcMessage)
 	// byte 2: length (high byte)
 	// byte 3: length (low byte)
 	// bytes 4...: data in R G B order
+	metrics.OPC_CLIENTS.Add("", 1)
+	defer metrics.OPC_CLIENTS.Add("", -1)
 	for {
 		// get header
 		headerBuf := make([]byte, 4)
@@ -430,6 +449,8 @@ func LaunchOpcServer(ipPort string) chan *OpcMessage {
 // the usual way ByteThreads do.  The channel field is ignored, so if you're piping OPC In to
 // OPC Out be aware that the channel will be set to zero in the process.
 // Only pays attention to OPC messages with command 0 (set pixels).
+// The frames it emits have however many pixels the client sent, so wrap it with
+// MakeResizeThread before handing the frames to anything that expects the layout's size.
 func MakeOpcServerThread(ipPort string) ByteThread {
 	incomingOpcMessageChan := make(chan *OpcMessage, 0)
 	go OpcServerThread(ipPort, incomingOpcMessageChan)
@@ -437,10 +458,10 @@ func MakeOpcServerThread(ipPort string) ByteThread {
 		// wait for ready signal from outside
 		for byteSlice := range bytesIn {
 			// wait for incoming opc message
-			opcMessage := <-incomingOpcMessageChan
 			// only accept command 0 (set pixels)
-			if opcMessage.Command != 0 {
-				continue
+			opcMessage := <-incomingOpcMessageChan
+			for opcMessage.Command != 0 {
+				opcMessage = <-incomingOpcMessageChan
 			}
 			// copy opc message bytes into byteSlice and return it
 			// because byteSlice and opcMessage.Bytes might be different lengths,
@@ -6,11 +6,11 @@ package opc
 //   that the LEDs are indexed.
 
 import (
+	"github.com/longears/pixelslinger/clock"
 	"github.com/longears/pixelslinger/colorutils"
 	"github.com/longears/pixelslinger/midi"
 	"math"
 	"math/rand"
-	"time"
 	//"fmt"
 )
 
@@ -50,7 +50,7 @@ func MakePatternAquaB(locations []float64) ByteThread {
 	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
 		for bytes := range bytesIn {
 			n_pixels := len(bytes) / 3
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := clock.Now()
 			// fill in bytes slice
 			for ii := 0; ii < n_pixels; ii++ {
 				//--------------------------------------------------------------------------------
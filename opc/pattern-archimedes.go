@@ -6,12 +6,12 @@ package opc
 //   that the LEDs are indexed.
 
 import (
+	"github.com/longears/pixelslinger/clock"
 	"github.com/longears/pixelslinger/colorutils"
 	"github.com/longears/pixelslinger/midi"
 	"github.com/lucasb-eyer/go-colorful"
 	"math"
 	"math/rand"
-	"time"
 )
 
 func Spiral(x, y, t, SPIRAL_tightness, SPIRAL_speed, SPIRAL_thickness, SPIRAL_thickness_gradient float64, SPIRAL_rings int) float64 {
@@ -41,9 +41,10 @@ func Spiral(x, y, t, SPIRAL_tightness, SPIRAL_speed, SPIRAL_thickness, SPIRAL_th
 
 func MakePatternArchimedes(locations []float64) ByteThread {
 	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		rng := rand.New(rand.NewSource(99))
 		for bytes := range bytesIn {
 			n_pixels := len(bytes) / 3
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := clock.Now()
 			// fill in bytes slice
 			for ii := 0; ii < n_pixels; ii++ {
 				//--------------------------------------------------------------------------------
@@ -72,7 +73,7 @@ func MakePatternArchimedes(locations []float64) ByteThread {
 				}
 				//noi = 0.0
 				//fmt.Println(noi)
-				noii := math.Abs(rand.Float64() * 0.0000000001)
+				noii := math.Abs(rng.Float64() * 0.0000000001)
 				//fmt.Println(noii)
 				//noii = 0.0
 				spiral1 := Spiral(x, y, t, 0.1*noi, 2+noii, 0.05, 0.9, 4)
@@ -5,9 +5,9 @@ package opc
 //   LEDs are colored in rainbow order according to the circle of fifths.
 
 import (
+	"github.com/longears/pixelslinger/clock"
 	"github.com/longears/pixelslinger/colorutils"
 	"github.com/longears/pixelslinger/midi"
-	"time"
 )
 
 func MakePatternBasicMidi(locations []float64) ByteThread {
@@ -32,7 +32,7 @@ func MakePatternBasicMidi(locations []float64) ByteThread {
 		last_t := float64(0)
 		for bytes := range bytesIn {
 			n_pixels := len(bytes) / 3
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := clock.Now()
 			tDiff := colorutils.Clamp(t-last_t, 0, 5) // limit to max of 5 second to avoid pathological value at startup
 
 			// update keyVolumes from MidiState
@@ -4,10 +4,10 @@ package opc
 // Every pixel's r,g,b  is linearly related to its x,y,z.
 
 import (
+	"github.com/longears/pixelslinger/clock"
 	"github.com/longears/pixelslinger/colorutils"
 	"github.com/longears/pixelslinger/midi"
 	"math"
-	"time"
 )
 
 func MakePatternSpatialColorBox(locations []float64) ByteThread {
@@ -31,7 +31,7 @@ func MakePatternSpatialColorBox(locations []float64) ByteThread {
 
 		for bytes := range bytesIn {
 			n_pixels := len(bytes) / 3
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := clock.Now()
 			// fill in bytes slice
 			for ii := 0; ii < n_pixels; ii++ {
 				//--------------------------------------------------------------------------------
@@ -6,11 +6,11 @@ package opc
 //   that the LEDs are indexed.
 
 import (
+	"github.com/longears/pixelslinger/clock"
 	"github.com/longears/pixelslinger/colorutils"
-	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/controls"
 	"github.com/longears/pixelslinger/midi"
 	"math"
-	"time"
 )
 
 func MakePatternDiamond(locations []float64) ByteThread {
@@ -38,8 +38,8 @@ func MakePatternDiamond(locations []float64) ByteThread {
 		for bytes := range bytesIn {
 			var (
 				// 0 to 1.  0 is large blend, 1 is tiny blend
-				MORPH = float64(midiState.ControllerValues[config.MORPH_KNOB]) / 127.0
-				HUE   = float64(midiState.ControllerValues[config.HUE_KNOB]) / 127.0
+				MORPH = controls.MORPH.Get(midiState)
+				HUE   = controls.HUE.Get(midiState)
 
 				SPEED = 0.83 // Overall speed. This is applied in addition to the speed knob.
 
@@ -67,14 +67,14 @@ func MakePatternDiamond(locations []float64) ByteThread {
 			n_pixels := len(bytes) / 3
 
 			// time and speed knob bookkeeping
-			this_t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
-			speedKnob := float64(midiState.ControllerValues[config.SPEED_KNOB]) / 127.0
+			this_t := clock.Now()
+			speedKnob := controls.SPEED.Get(midiState)
 			if speedKnob < 0.5 {
 				speedKnob = colorutils.RemapAndClamp(speedKnob, 0, 0.4, 0, 1)
 			} else {
 				speedKnob = colorutils.RemapAndClamp(speedKnob, 0.6, 1, 1, 4)
 			}
-			if midiState.KeyVolumes[config.SLOWMO_PAD] > 0 {
+			if controls.SLOWMO.On(midiState) {
 				speedKnob *= 0.25
 			}
 			if last_t != 0 {
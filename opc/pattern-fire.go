@@ -5,11 +5,12 @@ package opc
 //   This pattern is scaled to fit the layout from top to bottom (z).
 
 import (
+	"github.com/longears/pixelslinger/clock"
 	"github.com/longears/pixelslinger/colorutils"
-	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/controls"
 	"github.com/longears/pixelslinger/midi"
     "math"
-	"time"
+    "math/rand"
 )
 
 // this is used to cache some per-pixel calculations
@@ -79,13 +80,14 @@ func MakePatternFire(locations []float64) ByteThread {
     }
 
 	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+        renderer := NewPixelRenderer(99)
         last_t := 0.0
         t := 0.0
 		for bytes := range bytesIn {
 
             var (
                 // hue knob controls hue
-                H = 0.05 + float64(midiState.ControllerValues[config.HUE_KNOB]) / 127.0
+                H = 0.05 + controls.HUE.Get(midiState)
                 S = 0.9
                 V = 0.65
                 OVERBRIGHT = 1.3
@@ -100,14 +102,14 @@ func MakePatternFire(locations []float64) ByteThread {
 			n_pixels := len(bytes) / 3
 
             // time and speed knob bookkeeping
-			this_t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
-			speedKnob := float64(midiState.ControllerValues[config.SPEED_KNOB]) / 127.0
+			this_t := clock.Now()
+			speedKnob := controls.SPEED.Get(midiState)
             if speedKnob < 0.5 {
                 speedKnob = colorutils.RemapAndClamp(speedKnob, 0, 0.4, 0, 1)
             } else {
                 speedKnob = colorutils.RemapAndClamp(speedKnob, 0.6, 1, 1, 4)
             }
-			if midiState.KeyVolumes[config.SLOWMO_PAD] > 0 {
+			if controls.SLOWMO.On(midiState) {
                 speedKnob *=  0.25
             }
             if last_t != 0 {
@@ -115,9 +117,8 @@ func MakePatternFire(locations []float64) ByteThread {
             }
             last_t = this_t
 
-			// fill in bytes array
-			var r, g, b float64
-			for ii := 0; ii < n_pixels; ii++ {
+			// fill in bytes array, spread across several cores
+			renderer.Render(n_pixels, func(ii int, rng *rand.Rand) {
                 //--------------------------------------------------------------------------------
 
                 pi := pixelInfoCache[ii]
@@ -156,9 +157,9 @@ func MakePatternFire(locations []float64) ByteThread {
                 //v = colorutils.Cos2( colorutils.Clamp(v,0,1), 0, 2, 1, 0 )
 
                 // color map
-                r = v * rFire
-                g = v * gFire
-                b = v * bFire
+                r := v * rFire
+                g := v * gFire
+                b := v * bFire
 
                 r,g,b = colorutils.ContrastRgb(r,g,b, 0.7, 1.1)
                 // r,g,b = colorutils.RGBClipBlackByLuminance(r,g,b, 0.2)  // TODO
@@ -168,8 +169,9 @@ func MakePatternFire(locations []float64) ByteThread {
 				bytes[ii*3+2] = colorutils.FloatToByte(b)
 
 				//--------------------------------------------------------------------------------
-			}
+			})
 			bytesOut <- bytes
 		}
+        renderer.Close()
 	}
 }
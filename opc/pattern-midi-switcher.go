@@ -5,54 +5,65 @@ package opc
 //   LEDs are colored in rainbow order according to the circle of fifths.
 
 import (
-	"time"
-
+	"github.com/longears/pixelslinger/clock"
 	"github.com/longears/pixelslinger/colorutils"
-	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/controls"
 	"github.com/longears/pixelslinger/midi"
 )
 
+// Registered name of this pattern.  A pipeline whose source is this pattern passes it the
+// pipeline's transition; anywhere else (like inside a playlist) it uses DEFAULT_TRANSITION.
+const MIDI_SWITCHER = "midi-switcher"
+
+// The patterns that our MIDI knob will switch between
+var MIDI_SWITCHER_PATTERNS = []string{
+	"fire",
+	"sunset",
+	"diamond",
+	"raver-plaid",
+	"shield",
+	"spatial-stripes",
+	"eye",
+	"white",
+	"aqua",
+	"house-potty",
+}
+
+// The pattern the switch knob picks when it's at switchKnob, from 0 to 1.
+func MidiSwitcherPattern(switchKnob float64) string {
+	return MIDI_SWITCHER_PATTERNS[int(colorutils.Clamp(switchKnob, 0, 1)*float64(len(MIDI_SWITCHER_PATTERNS))*0.99999)]
+}
+
 func MakePatternMidiSwitcher(locations []float64) ByteThread {
-	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+	return MakeMidiSwitcherWithTransition(locations, TransitionSettings{DEFAULT_TRANSITION, DEFAULT_TRANSITION_TIME})
+}
 
-		// The patterns that our MIDI knob will switch between
-		PATTERN_LIST := []string{
-			"fire",
-			"sunset",
-			"diamond",
-			"raver-plaid",
-			"shield",
-			"spatial-stripes",
-			"eye",
-			"white",
-			"aqua",
-			"house-potty",
-		}
+// Like MakePatternMidiSwitcher, blending patterns with the given transition.
+func MakeMidiSwitcherWithTransition(locations []float64, transition TransitionSettings) ByteThread {
+	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
 
-		// channels for communication with subpattern
-		chanToPattern := make(chan []byte, 0)
-		chanFromPattern := make(chan []byte, 0)
+		// runs the current subpattern and blends it with the previous one after a switch
+		runner := newTransitionRunner(transition.Kind, transition.Duration, locations)
+		frame := &Frame{}
 
 		var patternName, lastPatternName string
 		for bytes := range bytesIn {
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := clock.Now()
 
 			// decide which subpattern we want for this frame
 
 			// // VERSION A for testing
 			// switchKnob := colorutils.PosMod2(t, 1)
-			// _ = config.SWITCH_KNOB
+			// _ = controls.SWITCH
 
 			// VERSION B for production
-			_ = t
 			_ = colorutils.PosMod
-			switchKnob := float64(midiState.ControllerValues[config.SWITCH_KNOB]) / 127.0
+			switchKnob := controls.SWITCH.Get(midiState)
 
-			// assume switchKnob is between 0 and 1
-			ii := int(switchKnob * float64(len(PATTERN_LIST)) * 0.99999)
-			patternName = PATTERN_LIST[ii]
+			patternName = MidiSwitcherPattern(switchKnob)
 
-			// Subpattern has changed.  Close old one and start new one.
+			// Subpattern has changed.  Start the new one and let the transition
+			// runner fade out the old one.
 			// This is not ideal because it has to re-init each pattern every
 			// time they switch.  This makes the patterns always start in the same
 			// place depending on how their time calculations work.
@@ -60,24 +71,19 @@ func MakePatternMidiSwitcher(locations []float64) ByteThread {
 			// some might freak out with weird time calculations when their frames
 			// are sometimes a long time apart while other patterns were running.
 			if patternName != lastPatternName {
-				// If patterns are properly written using "for byte := range bytesIn", this
-				// should terminate the previous pattern thread
-				close(chanToPattern)
-				// Make a new to-pattern channel.  We will re-use the from-pattern channel.
-				chanToPattern = make(chan []byte, 0)
-				sourceThreadMaker := PATTERN_REGISTRY[patternName]
-				sourceThread := sourceThreadMaker(locations)
-				go sourceThread(chanToPattern, chanFromPattern, midiState)
+				runner.switchTo(patternName, nil, t, locations, midiState)
 			}
 			lastPatternName = patternName
 
-			// send byte slice to subpattern
-			chanToPattern <- bytes
-			// get result back from subpattern
-			bytes = <-chanFromPattern
+			// get a frame from the subpattern(s)
+			frame.SetFromBytes(bytes)
+			frame = runner.render(frame, t)
+			bytes = frame.ToBytes(bytes)
 
 			// send our result back to our parent
 			bytesOut <- bytes
 		}
+		// shut down the subpatterns
+		runner.stop()
 	}
 }
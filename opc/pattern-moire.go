@@ -4,9 +4,10 @@ package opc
 //   A super ugly pattern
 
 import (
+	"github.com/longears/pixelslinger/clock"
 	"github.com/longears/pixelslinger/colorutils"
 	"github.com/longears/pixelslinger/midi"
-	"time"
+	"math/rand"
 )
 
 func MakePatternMoire(locations []float64) ByteThread {
@@ -41,12 +42,13 @@ func MakePatternMoire(locations []float64) ByteThread {
 	}
 
 	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		renderer := NewPixelRenderer(99)
 		for bytes := range bytesIn {
 			n_pixels := len(bytes) / 3
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := clock.Now()
 
-			// fill in bytes slice
-			for ii := 0; ii < n_pixels; ii++ {
+			// fill in bytes slice, spread across several cores
+			renderer.Render(n_pixels, func(ii int, rng *rand.Rand) {
 				//--------------------------------------------------------------------------------
 
 				//// make moving stripes for x, y, and z
@@ -71,8 +73,9 @@ func MakePatternMoire(locations []float64) ByteThread {
 				bytes[ii*3+2] = colorutils.FloatToByte(b)
 
 				//--------------------------------------------------------------------------------
-			}
+			})
 			bytesOut <- bytes
 		}
+		renderer.Close()
 	}
 }
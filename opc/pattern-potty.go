@@ -1,6 +1,7 @@
 package opc
 
 import (
+	"github.com/longears/pixelslinger/midi"
 	"github.com/longears/pixelslinger/potty"
 )
 
@@ -9,3 +10,15 @@ import (
 func MakePatternHousePotty(locations []float64) ByteThread {
 	return potty.MakeWaterPattern(locations)
 }
+
+// Same as above, for the potty effect stack which runs after the fader effect.
+// It works on the frame's floats directly.
+func MakeEffectPottyFader(locations []float64) FrameThread {
+	effect := potty.NewEffectFaderFloats(locations)
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+		for frame := range framesIn {
+			frame.Pixels = effect.Render(frame.Pixels, midiState, frame.Time)
+			framesOut <- frame
+		}
+	}
+}
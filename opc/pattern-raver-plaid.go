@@ -4,11 +4,11 @@ package opc
 //   A rainbowy pattern with moving diagonal black stripes
 
 import (
+	"github.com/longears/pixelslinger/clock"
 	"github.com/longears/pixelslinger/colorutils"
-	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/controls"
 	"github.com/longears/pixelslinger/midi"
 	"math"
-	"time"
 )
 
 func MakePatternRaverPlaid(locations []float64) ByteThread {
@@ -49,14 +49,14 @@ func MakePatternRaverPlaid(locations []float64) ByteThread {
 
 			// Get the current time in Unix seconds.
 			// This requires some time and speed knob bookkeeping
-			this_t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
-			speedKnob := float64(midiState.ControllerValues[config.SPEED_KNOB]) / 127.0
+			this_t := clock.Now()
+			speedKnob := controls.SPEED.Get(midiState)
 			if speedKnob < 0.5 {
 				speedKnob = colorutils.RemapAndClamp(speedKnob, 0, 0.4, 0, 1)
 			} else {
 				speedKnob = colorutils.RemapAndClamp(speedKnob, 0.6, 1, 1, 4)
 			}
-			if midiState.KeyVolumes[config.SLOWMO_PAD] > 0 {
+			if controls.SLOWMO.On(midiState) {
 				speedKnob *= 0.25
 			}
 			if last_t != 0 {
@@ -4,11 +4,11 @@ package opc
 //   Waves of magenta and cyan sparkles.
 
 import (
+	"github.com/longears/pixelslinger/clock"
 	"github.com/longears/pixelslinger/colorutils"
 	"github.com/longears/pixelslinger/midi"
 	"math"
 	"math/rand"
-	"time"
 )
 
 func MakePatternSailorMoon(locations []float64) ByteThread {
@@ -32,7 +32,7 @@ func MakePatternSailorMoon(locations []float64) ByteThread {
 
 		for bytes := range bytesIn {
 			n_pixels := len(bytes) / 3
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := clock.Now()
 
 			// fill in bytes array
 			var r, g, b float64
@@ -2,8 +2,9 @@ package opc
 
 import (
 	"fmt"
+	"github.com/longears/pixelslinger/clock"
 	"github.com/longears/pixelslinger/colorutils"
-	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/controls"
 	"github.com/longears/pixelslinger/midi"
 	"image"
 	_ "image/color"
@@ -11,7 +12,6 @@ import (
 	"math"
 	"math/rand"
 	"os"
-	"time"
 )
 
 func handleErr(err error) {
@@ -170,14 +170,14 @@ func MakePatternSunset(locations []float64) ByteThread {
 			n_pixels := len(bytes) / 3
 
 			// time and speed knob bookkeeping
-			this_t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
-			speedKnob := float64(midiState.ControllerValues[config.SPEED_KNOB]) / 127.0
+			this_t := clock.Now()
+			speedKnob := controls.SPEED.Get(midiState)
 			if speedKnob < 0.5 {
 				speedKnob = colorutils.RemapAndClamp(speedKnob, 0, 0.4, 0, 1)
 			} else {
 				speedKnob = colorutils.RemapAndClamp(speedKnob, 0.6, 1, 1, 4)
 			}
-			if midiState.KeyVolumes[config.SLOWMO_PAD] > 0 {
+			if controls.SLOWMO.On(midiState) {
 				speedKnob *= 0.25
 			}
 			if last_t != 0 {
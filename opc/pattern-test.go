@@ -12,10 +12,10 @@ package opc
 //      Every 8th LED is dark blue
 
 import (
+	"github.com/longears/pixelslinger/clock"
 	"github.com/longears/pixelslinger/colorutils"
 	"github.com/longears/pixelslinger/midi"
 	"math/rand"
-	"time"
 )
 
 func MakePatternTest(locations []float64) ByteThread {
@@ -23,7 +23,7 @@ func MakePatternTest(locations []float64) ByteThread {
 		rng := rand.New(rand.NewSource(99))
 		for bytes := range bytesIn {
 			n_pixels := len(bytes) / 3
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := clock.Now()
 
 			// fill in bytes array
 			var r, g, b float64
@@ -5,15 +5,15 @@ package opc
 
 import (
 	"github.com/longears/pixelslinger/colorutils"
-	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/controls"
 	"github.com/longears/pixelslinger/midi"
 )
 
 func MakePatternWhite(locations []float64) ByteThread {
 	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
 		for bytes := range bytesIn {
-			H := float64(midiState.ControllerValues[config.HUE_KNOB]) / 127.0
-			FADE_TO_WHITE := float64(midiState.ControllerValues[config.MORPH_KNOB]) / 127.0
+			H := controls.HUE.Get(midiState)
+			FADE_TO_WHITE := controls.MORPH.Get(midiState)
 
 			r, g, b := colorutils.HslToRgb(H, 1.0, 0.5)
 			r = r*(1-FADE_TO_WHITE) + 1*FADE_TO_WHITE
@@ -0,0 +1,456 @@
+package opc
+
+// Pipelines
+//   A pipeline is a source, followed by zero or more effects, followed by a destination.
+//   They're all FrameThreads; a pattern source (a ByteThread) is run through
+//   MakeFrameThread.  Pipelines can be described in a JSON file:
+//
+//   {
+//       "source": {"name": "fire", "params": {"speed": 0.8}},
+//       "effects": [
+//           {"name": "fader"},
+//           {"name": "potty-fader"}
+//       ],
+//       "dests": [
+//           {"name": "localhost:7890"},
+//           {"name": "spi", "params": {"dither": 1}}
+//       ],
+//       "resize": "fit",
+//       "interpolate": "linear",
+//       "max_latency": 0.1,
+//       "transition": "crossfade",
+//       "transition_time": 1
+//   }
+//
+//   Params on sources and effects pin controls (by their names in the controls package)
+//   to fixed values, overriding the MIDI controller for that stage only.  Floats go from
+//   the control's Min to Max (0 to 1 for all the current ones) and bools are 0 or 1.
+//   Dests accept the param "dither" (0 or 1) which only matters for "spi".
+//   "resize" says what to do when the source emits frames of the wrong size (see resize.go).
+//   It's optional and defaults to "fit".
+//   "interpolate" blends between the source's frames when it's slower than the output (see
+//   interpolate.go).  It's optional and defaults to "off".  "max_latency" is in seconds.
+//   "transition" and "transition_time" (in seconds) are how the source blends into a new one
+//   when it's switched (see switcher.go), and the defaults for playlists and the midi-switcher
+//   pattern.  They're optional and default to DEFAULT_TRANSITION and DEFAULT_TRANSITION_TIME.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/metrics"
+	"github.com/longears/pixelslinger/midi"
+)
+
+// Special destination names
+const (
+	SPI_MAGIC_WORD     = "spi"
+	PRINT_MAGIC_WORD   = "print"
+	DEVNULL_MAGIC_WORD = "/dev/null"
+)
+
+// Sources containing this word (or starting with ":") are OPC servers instead of patterns
+const LOCALHOST = "localhost"
+
+// SPI device used by the "spi" destination
+const SPI_FN = "/dev/spidev1.0"
+
+// Port used when an OPC host is given without one
+const DEFAULT_PORT = "7890"
+
+//--------------------------------------------------------------------------------
+// CONFIG TYPES
+
+// One stage of a pipeline file: a registered name plus optional parameters.
+type StageConfig struct {
+	Name   string             `json:"name"`
+	Params map[string]float64 `json:"params,omitempty"`
+}
+
+// The contents of a pipeline file.
+type PipelineConfig struct {
+	Source  StageConfig   `json:"source"`
+	Effects []StageConfig `json:"effects"`
+	Dests   []StageConfig `json:"dests"`
+	Resize  string        `json:"resize,omitempty"` // one of RESIZE_POLICIES, default RESIZE_FIT
+
+	Interpolate string   `json:"interpolate,omitempty"` // one of INTERPOLATE_MODES, default INTERPOLATE_OFF
+	MaxLatency  *float64 `json:"max_latency,omitempty"` // seconds, default DEFAULT_MAX_LATENCY
+
+	Transition     string   `json:"transition,omitempty"`      // one of TRANSITION_KINDS, default DEFAULT_TRANSITION
+	TransitionTime *float64 `json:"transition_time,omitempty"` // seconds, default DEFAULT_TRANSITION_TIME
+
+	Timed bool `json:"-"` // time every stage for the metrics package (set from --metrics, not the file)
+}
+
+// A pipeline which has been built and is ready to be launched.
+type Pipeline struct {
+	Source  FrameThread
+	Effects []FrameThread
+	Dest    FrameThread // if the config had several dests, this sends to all of them
+
+	Switcher *SourceSwitcher // for changing the source while the pipeline runs
+}
+
+// Read a pipeline config from a JSON file and validate it.
+func ReadPipelineConfig(fn string) (*PipelineConfig, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("could not read pipeline file %s: %v", fn, err)
+	}
+	pc := &PipelineConfig{}
+	if err := json.Unmarshal(data, pc); err != nil {
+		return nil, fmt.Errorf("could not parse pipeline file %s: %v", fn, err)
+	}
+	if err := pc.Validate(); err != nil {
+		return nil, fmt.Errorf("bad pipeline file %s: %v", fn, err)
+	}
+	fmt.Printf("[opc.ReadPipelineConfig] Read pipeline with %v effects and %v dests from %s\n", len(pc.Effects), len(pc.Dests), fn)
+	return pc, nil
+}
+
+// Check that every stage refers to something that exists and has sensible params.
+func (pc *PipelineConfig) Validate() error {
+	if err := validateSourceName(pc.Source.Name); err != nil {
+		return err
+	}
+	if err := validateKnobParams(pc.Source); err != nil {
+		return err
+	}
+	for _, effect := range pc.Effects {
+		if _, ok := EFFECT_REGISTRY[effect.Name]; !ok {
+			return fmt.Errorf("unknown effect \"%s\"", effect.Name)
+		}
+		if err := validateKnobParams(effect); err != nil {
+			return err
+		}
+	}
+	if pc.Resize != "" && !isResizePolicy(pc.Resize) {
+		return fmt.Errorf("unknown resize policy \"%s\" (should be one of %s)", pc.Resize, strings.Join(RESIZE_POLICIES, ", "))
+	}
+	if pc.Interpolate != "" && !isInterpolateMode(pc.Interpolate) {
+		return fmt.Errorf("unknown interpolation mode \"%s\" (should be one of %s)", pc.Interpolate, strings.Join(INTERPOLATE_MODES, ", "))
+	}
+	if pc.MaxLatency != nil && *pc.MaxLatency < 0 {
+		return fmt.Errorf("max_latency should not be negative, got %v", *pc.MaxLatency)
+	}
+	if pc.Transition != "" && !isTransitionKind(pc.Transition) {
+		return fmt.Errorf("unknown transition \"%s\" (should be one of %s)", pc.Transition, strings.Join(TRANSITION_KINDS, ", "))
+	}
+	if pc.TransitionTime != nil && *pc.TransitionTime < 0 {
+		return fmt.Errorf("transition_time should not be negative, got %v", *pc.TransitionTime)
+	}
+	if len(pc.Dests) == 0 {
+		return fmt.Errorf("no dests given")
+	}
+	for _, dest := range pc.Dests {
+		if dest.Name == "" {
+			return fmt.Errorf("dest with no name")
+		}
+		for param := range dest.Params {
+			if param != "dither" {
+				return fmt.Errorf("unknown param \"%s\" for dest \"%s\"", param, dest.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Build the threads described by the config.
+// The source is wrapped so that its frames always have as many pixels as the layout,
+// and so that pipeline.Switcher can swap it for another one.
+// Every stage is labeled for profiles, and if pc.Timed, timed for the metrics package.
+func (pc *PipelineConfig) Build(locations []float64) (*Pipeline, error) {
+	if err := pc.Validate(); err != nil {
+		return nil, err
+	}
+	pipeline := &Pipeline{}
+	if err := checkSourceForLayout(pc.Source.Name, locations); err != nil {
+		return nil, err
+	}
+
+	resize := pc.Resize
+	if resize == "" {
+		resize = RESIZE_FIT
+	}
+	fitToLayout := func(thread FrameThread) FrameThread {
+		return MakeResizeThread(thread, len(locations)/3, resize)
+	}
+	transition := TransitionSettings{DEFAULT_TRANSITION, DEFAULT_TRANSITION_TIME}
+	if pc.Transition != "" {
+		transition.Kind = pc.Transition
+	}
+	if pc.TransitionTime != nil {
+		transition.Duration = *pc.TransitionTime
+	}
+	sourceThread := MakeSourceThread(pc.Source.Name, locations, transition)
+	sourceThread = fitToLayout(MakeKnobOverrideFrameThread(sourceThread, pc.Source.Params))
+	pipeline.Switcher = newSourceSwitcher(pc.Source.Name, locations, fitToLayout, transition)
+	sourceThread = MakeSwitchableThread(sourceThread, pipeline.Switcher)
+	maxLatency := DEFAULT_MAX_LATENCY
+	if pc.MaxLatency != nil {
+		maxLatency = *pc.MaxLatency
+	}
+	sourceThread = MakeInterpolateThread(sourceThread, pc.Interpolate, maxLatency)
+	timed := func(thread FrameThread, stage string) FrameThread {
+		if pc.Timed {
+			thread = MakeTimedThread(thread, stage)
+		}
+		return MakeLabeledThread(thread, stage)
+	}
+	pipeline.Source = timed(sourceThread, "source:"+pc.Source.Name)
+
+	for _, effect := range pc.Effects {
+		effectThread := EFFECT_REGISTRY[effect.Name](locations)
+		effectThread = MakeKnobOverrideFrameThread(effectThread, effect.Params)
+		pipeline.Effects = append(pipeline.Effects, timed(effectThread, "effect:"+effect.Name))
+	}
+
+	destThreads := make([]FrameThread, len(pc.Dests))
+	for ii, dest := range pc.Dests {
+		destThreads[ii] = MakeDestThread(dest.Name, dest.Params["dither"] != 0)
+		destThreads[ii] = timed(destThreads[ii], "dest:"+dest.Name)
+	}
+	if len(destThreads) == 1 {
+		pipeline.Dest = destThreads[0]
+	} else {
+		pipeline.Dest = MakeSendToManyThread(destThreads)
+	}
+
+	return pipeline, nil
+}
+
+func validateKnobParams(stage StageConfig) error {
+	for param, val := range stage.Params {
+		c := controls.Lookup(param)
+		if c == nil || c.Kind == controls.TRIGGER {
+			return fmt.Errorf("unknown param \"%s\" for \"%s\" (should be one of %s)", param, stage.Name, knobNameList())
+		}
+		if val < c.Min || val > c.Max {
+			return fmt.Errorf("param \"%s\" for \"%s\" should be between %v and %v, got %v", param, stage.Name, c.Min, c.Max, val)
+		}
+	}
+	return nil
+}
+
+// Names of the controls which can be pinned by params.
+func knobNameList() string {
+	return strings.Join(controls.Names(controls.FLOAT, controls.BOOL), ", ")
+}
+
+//--------------------------------------------------------------------------------
+// SOURCES AND DESTS BY NAME
+
+// Is this source name an OPC server address like "localhost", "localhost:7890" or ":7890"?
+func isOpcServerName(name string) bool {
+	return strings.Contains(name, LOCALHOST) || strings.HasPrefix(name, ":")
+}
+
+// Check that a source name refers to something that exists.
+func validateSourceName(name string) error {
+	if name == "" {
+		return fmt.Errorf("no source given")
+	}
+	if strings.HasPrefix(name, PLAYLIST_PREFIX) {
+		if _, err := ReadPlaylist(strings.TrimPrefix(name, PLAYLIST_PREFIX)); err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(name, LAYERS_PREFIX) {
+		if _, err := ReadLayersConfig(strings.TrimPrefix(name, LAYERS_PREFIX)); err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(name, ZONES_PREFIX) {
+		if _, err := ReadZonesConfig(strings.TrimPrefix(name, ZONES_PREFIX)); err != nil {
+			return err
+		}
+	} else if !isOpcServerName(name) {
+		if _, ok := PATTERN_REGISTRY[name]; !ok {
+			return fmt.Errorf("unknown source or pattern \"%s\"", name)
+		}
+	}
+	return nil
+}
+
+// Zones can only be checked once we know the layout.
+// The name should already have been checked with validateSourceName.
+func checkSourceForLayout(name string, locations []float64) error {
+	if strings.HasPrefix(name, ZONES_PREFIX) {
+		fn := strings.TrimPrefix(name, ZONES_PREFIX)
+		zc, err := ReadZonesConfig(fn)
+		if err != nil {
+			return err
+		}
+		if _, err := zc.PixelsForLayout(locations); err != nil {
+			return fmt.Errorf("bad zones file %s: %v", fn, err)
+		}
+	}
+	return nil
+}
+
+// Return the source FrameThread for the given name, which is either a pattern
+// from PATTERN_REGISTRY, a playlist file as "playlist:filename", a layers file as "layers:filename",
+// a zones file as "zones:filename",
+// or an OPC server address such as "localhost[:port]" or ":port".
+// Playlists and the midi-switcher pattern use the given transition.
+// The name should already have been checked with PipelineConfig.Validate.
+func MakeSourceThread(name string, locations []float64, transition TransitionSettings) FrameThread {
+	if strings.HasPrefix(name, PLAYLIST_PREFIX) {
+		return MakePlaylistThread(strings.TrimPrefix(name, PLAYLIST_PREFIX), locations, transition)
+	}
+	if name == MIDI_SWITCHER {
+		return MakeFrameThread(MakeMidiSwitcherWithTransition(locations, transition))
+	}
+	if strings.HasPrefix(name, LAYERS_PREFIX) {
+		return MakeLayersThread(strings.TrimPrefix(name, LAYERS_PREFIX), locations)
+	}
+	if strings.HasPrefix(name, ZONES_PREFIX) {
+		return MakeZonesThread(strings.TrimPrefix(name, ZONES_PREFIX), locations)
+	}
+	if isOpcServerName(name) {
+		if name[0] == ':' {
+			name = LOCALHOST + name
+		}
+		if !strings.Contains(name, ":") {
+			name += ":" + DEFAULT_PORT
+		}
+		return MakeFrameThread(MakeOpcServerThread(name))
+	}
+	return MakeFrameThread(PATTERN_REGISTRY[name](locations))
+}
+
+// Return the dest FrameThread for the given name: one of the magic words or hostname[:port].
+// dither is passed along to the SPI dest.
+func MakeDestThread(name string, dither bool) FrameThread {
+	switch name {
+	case DEVNULL_MAGIC_WORD:
+		return MakeFrameThread(MakeSendToDevNullThread())
+	case PRINT_MAGIC_WORD:
+		return MakeFrameThread(MakeSendToScreenThread())
+	case SPI_MAGIC_WORD:
+		return MakeSendToLPD8806Thread(SPI_FN, dither)
+	default:
+		if !strings.Contains(name, ":") {
+			name += ":" + DEFAULT_PORT
+		}
+		return MakeSendToOpcThread(name)
+	}
+}
+
+// Run one stage of a pipeline until framesIn is closed, then close framesOut so the next
+// stage stops too.  Closing the first stage's input shuts the whole chain down in order,
+// and no stage is ever sent a frame on a closed channel.
+func RunStage(thread FrameThread, framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+	thread(framesIn, framesOut, midiState)
+	close(framesOut)
+}
+
+//--------------------------------------------------------------------------------
+// WRAPPERS
+
+// Return a FrameThread which runs the given thread but with some controls pinned to fixed values.
+// knobs maps control names to values (already checked by validateKnobParams).
+// The wrapped thread gets its own copy of the MidiState, refreshed every frame.
+// If knobs is empty the thread is returned unchanged.
+func MakeKnobOverrideFrameThread(thread FrameThread, knobs map[string]float64) FrameThread {
+	if len(knobs) == 0 {
+		return thread
+	}
+	overrides := makeKnobOverrides(knobs)
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+		privateState := &midi.MidiState{}
+		chanToThread := make(chan *Frame, 0)
+		chanFromThread := make(chan *Frame, 0)
+		go thread(chanToThread, chanFromThread, privateState)
+		for frame := range framesIn {
+			overrides.apply(privateState, midiState)
+			chanToThread <- frame
+			framesOut <- <-chanFromThread
+		}
+		close(chanToThread)
+	}
+}
+
+// Control values to pin.
+type knobOverrides map[*controls.Control]float64
+
+// Look up the control names in knobs.
+func makeKnobOverrides(knobs map[string]float64) knobOverrides {
+	overrides := make(knobOverrides)
+	for name, val := range knobs {
+		overrides[controls.Lookup(name)] = val
+	}
+	return overrides
+}
+
+// Copy midiState into privateState and pin the controls.
+func (overrides knobOverrides) apply(privateState, midiState *midi.MidiState) {
+	*privateState = *midiState
+	for c, val := range overrides {
+		c.Set(privateState, val)
+	}
+}
+
+// Return a FrameThread which runs the given thread and reports how long it takes
+// to process each frame to the metrics package under the given stage name.
+func MakeTimedThread(thread FrameThread, stage string) FrameThread {
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+		chanToThread := make(chan *Frame, 0)
+		chanFromThread := make(chan *Frame, 0)
+		go thread(chanToThread, chanFromThread, midiState)
+		for frame := range framesIn {
+			startTime := time.Now()
+			chanToThread <- frame
+			frame = <-chanFromThread
+			metrics.ObserveStage(stage, time.Since(startTime).Seconds())
+			framesOut <- frame
+		}
+		close(chanToThread)
+	}
+}
+
+// Return a FrameThread which runs the given thread with the pprof label "stage" set to
+// the given stage name, so CPU profiles can be split up by stage.  Goroutines the thread
+// starts get the label too.  Unlike MakeTimedThread this costs nothing per frame.
+func MakeLabeledThread(thread FrameThread, stage string) FrameThread {
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+		pprof.Do(context.Background(), pprof.Labels("stage", stage), func(context.Context) {
+			thread(framesIn, framesOut, midiState)
+		})
+	}
+}
+
+// Return a FrameThread which sends each frame to several dest threads at once.
+// Each dest gets its own copy of the frame since some of them modify it in place.
+// Waits for all of them to finish before passing the original frame along.
+func MakeSendToManyThread(dests []FrameThread) FrameThread {
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+		chansToDest := make([]chan *Frame, len(dests))
+		chansFromDest := make([]chan *Frame, len(dests))
+		copies := make([]*Frame, len(dests))
+		for ii, dest := range dests {
+			chansToDest[ii] = make(chan *Frame, 0)
+			chansFromDest[ii] = make(chan *Frame, 0)
+			copies[ii] = &Frame{}
+			go dest(chansToDest[ii], chansFromDest[ii], midiState)
+		}
+		for frame := range framesIn {
+			for ii := range dests {
+				copies[ii].CopyFrom(frame)
+				chansToDest[ii] <- copies[ii]
+			}
+			for ii := range dests {
+				copies[ii] = <-chansFromDest[ii]
+			}
+			framesOut <- frame
+		}
+		for ii := range dests {
+			close(chansToDest[ii])
+		}
+	}
+}
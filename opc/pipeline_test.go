@@ -0,0 +1,139 @@
+package opc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/longears/pixelslinger/clock"
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+)
+
+const TEST_LAYOUT = "../layouts/circle_r1_160x.json"
+
+// Render frames through a freshly built pipeline (minus its dest) with a fixed step clock,
+// turning knobs and pressing pads along the way, and return copies of the frames that
+// come out of the last effect.
+func renderWithFixedClock(t *testing.T, pc *PipelineConfig, nFrames int) [][]float32 {
+	clock.Set(clock.NewFixedStepClock(1.0 / 40))
+	defer clock.Set(clock.NewRealTimeClock())
+	locations := ReadLocations(TEST_LAYOUT)
+	pipeline, err := pc.Build(locations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	midiState := &midi.MidiState{}
+	controls.Reset(midiState)
+	stageChans := []chan *Frame{make(chan *Frame, 0), make(chan *Frame, 0)}
+	go RunStage(pipeline.Source, stageChans[0], stageChans[1], midiState)
+	for _, effect := range pipeline.Effects {
+		stageChans = append(stageChans, make(chan *Frame, 0))
+		go RunStage(effect, stageChans[len(stageChans)-2], stageChans[len(stageChans)-1], midiState)
+	}
+
+	frame := NewFrame(len(locations) / 3)
+	frames := [][]float32{}
+	for ii := 0; ii < nFrames; ii++ {
+		clock.Tick()
+		var events []controls.Event
+		switch ii % 20 {
+		case 0:
+			events = []controls.Event{{Control: controls.TWINKLE, Value: 1}, {Control: controls.SWITCH, Value: float64(ii%60) / 60}}
+		case 5:
+			events = []controls.Event{{Control: controls.TWINKLE, Value: 0}, {Control: controls.BLINK_CIRCLE, Value: 1}}
+		case 10:
+			events = []controls.Event{{Control: controls.FLUSH, Value: 1}}
+		case 15:
+			events = []controls.Event{{Control: controls.FLUSH, Value: 0}}
+		}
+		controls.Update(midiState, nil, events)
+		frame.Time, frame.Delta = clock.Now(), clock.Delta()
+		stageChans[0] <- frame
+		frame = <-stageChans[len(stageChans)-1]
+		frames = append(frames, append([]float32{}, frame.Pixels...))
+	}
+	// shut down like the main loop does; the last channel closes once every stage has stopped
+	close(stageChans[0])
+	for _ = range stageChans[len(stageChans)-1] {
+		t.Fatal("got a frame after shutting down")
+	}
+	return frames
+}
+
+//================================================================================
+func TestFixedClockIsReproducible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	playlistFn := filepath.Join(dir, "playlist.json")
+	err = ioutil.WriteFile(playlistFn, []byte(`{
+		"shuffle": true, "loop": true, "transition": "dissolve", "transition_time": 0.2,
+		"items": [{"name": "eye", "duration": 0.5}, {"name": "fire", "duration": 0.5}, {"name": "sailor-moon", "duration": 0.5}]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	effects := []StageConfig{{Name: "fader"}, {Name: "potty-fader"}}
+	for _, source := range []string{"spatial-stripes", "eye", "fire", "house-potty", "midi-switcher", PLAYLIST_PREFIX + playlistFn} {
+		pc := &PipelineConfig{
+			Source:  StageConfig{Name: source},
+			Effects: effects,
+			Dests:   []StageConfig{{Name: DEVNULL_MAGIC_WORD}},
+		}
+		first := renderWithFixedClock(t, pc, 120)
+		second := renderWithFixedClock(t, pc, 120)
+		changed := false
+		for ii := range first {
+			for jj := range first[ii] {
+				if first[ii][jj] != second[ii][jj] {
+					t.Fatalf("%s: frame %v pixel %v differs between runs: %v, %v", source, ii, jj/3, first[ii][jj], second[ii][jj])
+				}
+				if first[ii][jj] != first[0][jj] {
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			t.Errorf("%s: every frame was the same, so this didn't test much", source)
+		}
+	}
+}
+
+func TestPipelineTransition(t *testing.T) {
+	dests := []StageConfig{{Name: DEVNULL_MAGIC_WORD}}
+	seconds := 0.5
+	tests := []struct {
+		pc   *PipelineConfig
+		want TransitionSettings
+	}{
+		{&PipelineConfig{Source: StageConfig{Name: "fire"}, Dests: dests}, TransitionSettings{DEFAULT_TRANSITION, DEFAULT_TRANSITION_TIME}},
+		{&PipelineConfig{Source: StageConfig{Name: "fire"}, Dests: dests, Transition: TRANSITION_WIPE_Z}, TransitionSettings{TRANSITION_WIPE_Z, DEFAULT_TRANSITION_TIME}},
+		{&PipelineConfig{Source: StageConfig{Name: "fire"}, Dests: dests, Transition: TRANSITION_CUT, TransitionTime: &seconds}, TransitionSettings{TRANSITION_CUT, 0.5}},
+	}
+	for _, test := range tests {
+		pipeline, err := test.pc.Build(DIAGONAL_LOCATIONS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pipeline.Switcher.Transition(); got != test.want {
+			t.Errorf("got %v, want %v", got, test.want)
+		}
+	}
+
+	negative := -1.0
+	bad := []*PipelineConfig{
+		{Source: StageConfig{Name: "fire"}, Dests: dests, Transition: "swirl"},
+		{Source: StageConfig{Name: "fire"}, Dests: dests, TransitionTime: &negative},
+	}
+	for _, pc := range bad {
+		if err := pc.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", pc)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package opc
+
+// Playlists
+//   A playlist source cycles through patterns from PATTERN_REGISTRY, each for its own
+//   duration, with optional knob params.  It can shuffle and loop, and a schedule can
+//   swap in different lists of patterns depending on the day of the week and time of day.
+//   Choose it with "--source playlist:path/to/file.json".
+//
+//   {
+//       "shuffle": true,
+//       "loop": true,
+//       "transition": "crossfade",
+//       "transition_time": 3,
+//       "items": [
+//           {"name": "fire", "duration": 300, "params": {"speed": 0.7}},
+//           {"name": "aqua", "duration": 120}
+//       ],
+//       "schedule": [
+//           {"start": "06:00", "end": "18:00", "items": [{"name": "off"}]},
+//           {"days": ["sat", "sun"], "start": "18:00", "end": "02:00", "items": [{"name": "sunset"}]}
+//       ]
+//   }
+//
+//   The first schedule entry which matches the local time wins.  If none match, the
+//   top-level items play.  Windows can cross midnight; "days" refers to the day the window
+//   starts on, so saturday's 18:00-02:00 window includes 01:00 on sunday morning.
+//   Leaving out "days" means every day.  Days are names like "saturday" or their first
+//   three letters.  Times go from "00:00" to "23:59", and "24:00" can end a window at midnight.
+//   Durations are in seconds of frame clock time; a duration of 0 means "until the schedule
+//   changes".
+//
+//   Everything in a playlist follows the frame clock, including the schedule: the local time
+//   is clock.Date of the frame time.  With the realtime clock that's the wall clock; with a
+//   fixed step or offline clock the schedule sees the same made-up dates every run.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/longears/pixelslinger/clock"
+	"github.com/longears/pixelslinger/midi"
+)
+
+// Sources starting with this are playlist files
+const PLAYLIST_PREFIX = "playlist:"
+
+var WEEKDAY_NAMES = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+//--------------------------------------------------------------------------------
+// TYPES
+
+// One pattern in a playlist.
+type PlaylistItem struct {
+	StageConfig
+	Duration float64 `json:"duration"` // seconds, or 0 for forever
+}
+
+// A set of items which play during a window of time on certain days.
+type ScheduleEntry struct {
+	Days  []string       `json:"days,omitempty"` // from WEEKDAY_NAMES; empty means every day
+	Start string         `json:"start"`          // "HH:MM" local time
+	End   string         `json:"end"`            // "HH:MM" local time; earlier than Start means it crosses midnight
+	Items []PlaylistItem `json:"items"`
+
+	startMinute int
+	endMinute   int
+	onDay       [7]bool
+}
+
+// The contents of a playlist file.
+type Playlist struct {
+	Shuffle        bool            `json:"shuffle"`
+	Loop           bool            `json:"loop"`
+	Transition     string          `json:"transition,omitempty"`      // one of TRANSITION_KINDS, default the pipeline's
+	TransitionTime *float64        `json:"transition_time,omitempty"` // seconds, default the pipeline's
+	Items          []PlaylistItem  `json:"items"`
+	Schedule       []ScheduleEntry `json:"schedule,omitempty"`
+}
+
+//--------------------------------------------------------------------------------
+// LOADING
+
+// Read a playlist from a JSON file and validate it.
+func ReadPlaylist(fn string) (*Playlist, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("could not read playlist file %s: %v", fn, err)
+	}
+	playlist := &Playlist{}
+	if err := json.Unmarshal(data, playlist); err != nil {
+		return nil, fmt.Errorf("could not parse playlist file %s: %v", fn, err)
+	}
+	if err := playlist.validate(); err != nil {
+		return nil, fmt.Errorf("bad playlist file %s: %v", fn, err)
+	}
+	return playlist, nil
+}
+
+func (playlist *Playlist) validate() error {
+	if playlist.Transition != "" && !isTransitionKind(playlist.Transition) {
+		return fmt.Errorf("unknown transition \"%s\" (should be one of %s)", playlist.Transition, strings.Join(TRANSITION_KINDS, ", "))
+	}
+	if playlist.TransitionTime != nil && *playlist.TransitionTime < 0 {
+		return fmt.Errorf("transition_time should not be negative, got %v", *playlist.TransitionTime)
+	}
+	if len(playlist.Items) == 0 && len(playlist.Schedule) == 0 {
+		return fmt.Errorf("no items")
+	}
+	if err := validatePlaylistItems(playlist.Items); err != nil {
+		return err
+	}
+	for ii := range playlist.Schedule {
+		entry := &playlist.Schedule[ii]
+		var err error
+		if entry.startMinute, err = parseTimeOfDay(entry.Start); err != nil {
+			return err
+		}
+		if entry.startMinute == 24*60 {
+			return fmt.Errorf("schedule entry can't start at %s", entry.Start)
+		}
+		if entry.endMinute, err = parseTimeOfDay(entry.End); err != nil {
+			return err
+		}
+		if len(entry.Days) == 0 {
+			for day := range entry.onDay {
+				entry.onDay[day] = true
+			}
+		}
+		for _, dayName := range entry.Days {
+			day := weekdayFromName(dayName)
+			if day < 0 {
+				return fmt.Errorf("unknown day \"%s\" (should be one of %s)", dayName, strings.Join(WEEKDAY_NAMES, ", "))
+			}
+			entry.onDay[day] = true
+		}
+		if len(entry.Items) == 0 {
+			return fmt.Errorf("schedule entry %s-%s has no items", entry.Start, entry.End)
+		}
+		if err := validatePlaylistItems(entry.Items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validatePlaylistItems(items []PlaylistItem) error {
+	for _, item := range items {
+		if _, ok := PATTERN_REGISTRY[item.Name]; !ok {
+			return fmt.Errorf("unknown pattern \"%s\"", item.Name)
+		}
+		if item.Duration < 0 {
+			return fmt.Errorf("negative duration for \"%s\"", item.Name)
+		}
+		if err := validateKnobParams(item.StageConfig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isTransitionKind(kind string) bool {
+	for _, k := range TRANSITION_KINDS {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert "HH:MM" to minutes since midnight.  "24:00" is allowed and means the end of the day.
+func parseTimeOfDay(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time of day \"%s\" (should be HH:MM from 00:00 to 24:00)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Return 0 for "sun" or "sunday" through 6 for "sat" or "saturday", or -1 if unknown.
+func weekdayFromName(name string) int {
+	name = strings.ToLower(name)
+	for ii, dayName := range WEEKDAY_NAMES {
+		if name == dayName || name == strings.ToLower(time.Weekday(ii).String()) {
+			return ii
+		}
+	}
+	return -1
+}
+
+//--------------------------------------------------------------------------------
+// SCHEDULING
+
+// Is the given local time inside this entry's window?
+func (entry *ScheduleEntry) contains(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	day := int(now.Weekday())
+	if entry.startMinute <= entry.endMinute {
+		return entry.onDay[day] && entry.startMinute <= minute && minute < entry.endMinute
+	}
+	// window crosses midnight
+	yesterday := (day + 6) % 7
+	return (entry.onDay[day] && minute >= entry.startMinute) || (entry.onDay[yesterday] && minute < entry.endMinute)
+}
+
+// Return the index of the schedule entry for the given local time, or -1 for the top-level items.
+func (playlist *Playlist) activeEntry(now time.Time) int {
+	for ii := range playlist.Schedule {
+		if playlist.Schedule[ii].contains(now) {
+			return ii
+		}
+	}
+	return -1
+}
+
+// Return the items to play for a schedule entry.
+// If there's nothing to play, return a single item which turns the pixels off.
+func (playlist *Playlist) itemsForEntry(entry int) []PlaylistItem {
+	items := playlist.Items
+	if entry >= 0 {
+		items = playlist.Schedule[entry].Items
+	}
+	if len(items) == 0 {
+		items = []PlaylistItem{{StageConfig: StageConfig{Name: "off"}}}
+	}
+	return items
+}
+
+//--------------------------------------------------------------------------------
+// SOURCE
+
+// Return a FrameThread which plays the playlist in the given file, using the given
+// transition unless the file has its own.
+// The file should already have been checked with ReadPlaylist.
+func MakePlaylistThread(fn string, locations []float64, defaultTransition TransitionSettings) FrameThread {
+	playlist, err := ReadPlaylist(fn)
+	if err != nil {
+		panic(fmt.Sprintf("[opc.PlaylistThread] %v", err))
+	}
+	transition := defaultTransition
+	if playlist.Transition != "" {
+		transition.Kind = playlist.Transition
+	}
+	if playlist.TransitionTime != nil {
+		transition.Duration = *playlist.TransitionTime
+	}
+
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+		fmt.Printf("[opc.PlaylistThread] playing %s\n", fn)
+		// a different shuffle every run, except with a fixed step clock
+		rng := rand.New(rand.NewSource(int64(clock.Now() * 1e6)))
+		runner := newTransitionRunner(transition.Kind, transition.Duration, locations)
+
+		entry := -2 // not yet chosen
+		var items []PlaylistItem
+		var order []int // order to play items in
+		pos := 0        // index into order
+		itemStartTime := 0.0
+
+		// start playing the item at order[pos]
+		playCurrent := func(t float64) {
+			item := items[order[pos]]
+			fmt.Printf("[opc.PlaylistThread] switching to %s\n", item.Name)
+			runner.switchTo(item.Name, item.Params, t, locations, midiState)
+			itemStartTime = t
+		}
+
+		for frame := range framesIn {
+			t := clock.Now()
+
+			// has the schedule changed?
+			if newEntry := playlist.activeEntry(clock.Date(t)); newEntry != entry {
+				entry = newEntry
+				items = playlist.itemsForEntry(entry)
+				order = makePlayOrder(len(items), playlist.Shuffle, rng)
+				pos = 0
+				playCurrent(t)
+			}
+
+			// is it time for the next item?
+			duration := items[order[pos]].Duration
+			if duration > 0 && t-itemStartTime >= duration {
+				lastItem := order[pos]
+				pos += 1
+				if pos >= len(order) {
+					if playlist.Loop {
+						order = makePlayOrder(len(items), playlist.Shuffle, rng)
+						pos = 0
+					} else {
+						// stay on the last item forever
+						pos = len(order) - 1
+					}
+				}
+				if order[pos] != lastItem {
+					playCurrent(t)
+				} else {
+					itemStartTime = t
+				}
+			}
+
+			framesOut <- runner.render(frame, t)
+		}
+		runner.stop()
+	}
+}
+
+// Return the indices 0 to n-1, shuffled if asked.
+func makePlayOrder(n int, shuffle bool, rng *rand.Rand) []int {
+	if shuffle {
+		return rng.Perm(n)
+	}
+	order := make([]int, n)
+	for ii := range order {
+		order[ii] = ii
+	}
+	return order
+}
@@ -0,0 +1,144 @@
+package opc
+
+import (
+	"testing"
+	"time"
+)
+
+// Local time on saturday october 17th 2026, plus some days.
+func saturdayAt(days, hour, minute int) time.Time {
+	return time.Date(2026, 10, 17+days, hour, minute, 0, 0, time.Local)
+}
+
+func validPlaylist(t *testing.T, schedule ...ScheduleEntry) *Playlist {
+	playlist := &Playlist{Items: []PlaylistItem{{StageConfig: StageConfig{Name: "fire"}}}, Schedule: schedule}
+	if err := playlist.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return playlist
+}
+
+func entry(days []string, start, end string) ScheduleEntry {
+	return ScheduleEntry{Days: days, Start: start, End: end, Items: []PlaylistItem{{StageConfig: StageConfig{Name: "off"}}}}
+}
+
+//================================================================================
+func TestParseTimeOfDay(t *testing.T) {
+	good := map[string]int{"00:00": 0, "06:30": 390, "6:30": 390, "23:59": 1439, "24:00": 1440}
+	for s, want := range good {
+		if got, err := parseTimeOfDay(s); err != nil || got != want {
+			t.Errorf("parseTimeOfDay(%q): got %v %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"24:59", "24:01", "25:00", "-1:00", "12:60", "12", "12:00pm", ""} {
+		if _, err := parseTimeOfDay(s); err == nil {
+			t.Errorf("parseTimeOfDay(%q) should fail", s)
+		}
+	}
+}
+
+func TestWeekdayFromName(t *testing.T) {
+	good := map[string]int{"sun": 0, "Sunday": 0, "mon": 1, "THU": 4, "thursday": 4, "sat": 6, "saturday": 6}
+	for name, want := range good {
+		if got := weekdayFromName(name); got != want {
+			t.Errorf("weekdayFromName(%q): got %v, want %v", name, got, want)
+		}
+	}
+	for _, name := range []string{"sundae", "satur", "mond", "s", ""} {
+		if got := weekdayFromName(name); got != -1 {
+			t.Errorf("weekdayFromName(%q) should be unknown, got %v", name, got)
+		}
+	}
+}
+
+func TestScheduleEntryContains(t *testing.T) {
+	if saturdayAt(0, 0, 0).Weekday() != time.Saturday {
+		t.Fatal("saturdayAt isn't a saturday")
+	}
+	playlist := validPlaylist(t,
+		entry(nil, "06:00", "18:00"),
+		entry([]string{"sat"}, "22:00", "02:00"),
+		entry([]string{"fri"}, "18:00", "24:00"),
+	)
+	day, overnight, untilMidnight := &playlist.Schedule[0], &playlist.Schedule[1], &playlist.Schedule[2]
+	tests := []struct {
+		entry *ScheduleEntry
+		when  time.Time
+		want  bool
+	}{
+		{day, saturdayAt(0, 5, 59), false},
+		{day, saturdayAt(0, 6, 0), true},
+		{day, saturdayAt(3, 17, 59), true},
+		{day, saturdayAt(0, 18, 0), false},
+		{overnight, saturdayAt(0, 21, 59), false},
+		{overnight, saturdayAt(0, 22, 0), true},
+		{overnight, saturdayAt(0, 23, 59), true},
+		{overnight, saturdayAt(1, 0, 0), true}, // sunday morning is still saturday night
+		{overnight, saturdayAt(1, 1, 59), true},
+		{overnight, saturdayAt(1, 2, 0), false},
+		{overnight, saturdayAt(0, 1, 0), false}, // friday night isn't in it
+		{overnight, saturdayAt(1, 22, 0), false},
+		{untilMidnight, saturdayAt(-1, 23, 59), true},
+		{untilMidnight, saturdayAt(0, 0, 0), false},
+	}
+	for _, test := range tests {
+		if got := test.entry.contains(test.when); got != test.want {
+			t.Errorf("%s-%s %v at %v: got %v, want %v", test.entry.Start, test.entry.End, test.entry.Days, test.when.Format("Mon 15:04"), got, test.want)
+		}
+	}
+}
+
+func TestActiveEntry(t *testing.T) {
+	if got := validPlaylist(t).activeEntry(saturdayAt(0, 12, 0)); got != -1 {
+		t.Errorf("an empty schedule should play the top-level items, got %v", got)
+	}
+
+	// where entries overlap, the first one wins
+	playlist := validPlaylist(t,
+		entry([]string{"sat", "sun"}, "10:00", "14:00"),
+		entry(nil, "08:00", "20:00"),
+	)
+	tests := []struct {
+		when time.Time
+		want int
+	}{
+		{saturdayAt(0, 7, 0), -1},
+		{saturdayAt(0, 9, 0), 1},
+		{saturdayAt(0, 12, 0), 0},
+		{saturdayAt(1, 12, 0), 0},
+		{saturdayAt(2, 12, 0), 1},
+		{saturdayAt(0, 20, 0), -1},
+	}
+	for _, test := range tests {
+		if got := playlist.activeEntry(test.when); got != test.want {
+			t.Errorf("at %v: got entry %v, want %v", test.when.Format("Mon 15:04"), got, test.want)
+		}
+	}
+
+	bad := &Playlist{Items: []PlaylistItem{{StageConfig: StageConfig{Name: "fire"}}}, Schedule: []ScheduleEntry{entry(nil, "24:00", "06:00")}}
+	if err := bad.validate(); err == nil {
+		t.Errorf("a window shouldn't be able to start at 24:00")
+	}
+}
+
+func TestPlaylistValidate(t *testing.T) {
+	items := []PlaylistItem{{StageConfig: StageConfig{Name: "fire"}}}
+	zero, negative := 0.0, -1.0
+	tests := []struct {
+		playlist *Playlist
+		ok       bool
+	}{
+		{&Playlist{Items: items}, true},
+		{&Playlist{Items: items, Transition: TRANSITION_WIPE_X, TransitionTime: &zero}, true},
+		{&Playlist{Items: items, TransitionTime: &negative}, false},
+		{&Playlist{Items: items, Transition: "swirl"}, false},
+		{&Playlist{Items: []PlaylistItem{{StageConfig: StageConfig{Name: "fire"}, Duration: -1}}}, false},
+		{&Playlist{Items: []PlaylistItem{{StageConfig: StageConfig{Name: "no-such-pattern"}}}}, false},
+		{&Playlist{}, false},
+	}
+	for _, test := range tests {
+		if err := test.playlist.validate(); (err == nil) != test.ok {
+			t.Errorf("%+v: expected ok = %v, got %v", test.playlist, test.ok, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package opc
+
+// Parallel rendering
+//   Patterns which do a lot of math per pixel can split the pixels across several cores
+//   by using a PixelRenderer instead of looping over the pixels themselves:
+//
+//   return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+//       renderer := NewPixelRenderer(99)
+//       for bytes := range bytesIn {
+//           renderer.Render(len(bytes)/3, func(ii int, rng *rand.Rand) {
+//               // ... fill in bytes[ii*3:ii*3+3] ...
+//           })
+//           bytesOut <- bytes
+//       }
+//       renderer.Close()
+//   }
+//
+//   The function is called from several goroutines at once, so it should only write to
+//   its own pixel.  Each worker has its own random number generator; use that instead of
+//   the global one in math/rand, which has a lock around it.  Which worker renders which
+//   pixel depends on RENDER_CORES, so random values won't match between machines.
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+)
+
+// How many cores PixelRenderers split the work across.  Set this before launching the pipeline.
+var RENDER_CORES = runtime.NumCPU()
+
+// Don't bother starting another worker for fewer pixels than this
+const MIN_PIXELS_PER_WORKER = 32
+
+// Splits the pixels of each frame across a pool of worker goroutines.
+type PixelRenderer struct {
+	jobs []chan renderJob // one per worker, except the first worker is the caller of Render
+	rngs []*rand.Rand     // one per worker
+	done sync.WaitGroup
+}
+
+type renderJob struct {
+	start, end int
+	fn         func(ii int, rng *rand.Rand)
+}
+
+// Start a pool of RENDER_CORES workers.  Each worker's random number generator
+// is seeded from seed.  Call Close when you're done with it.
+func NewPixelRenderer(seed int64) *PixelRenderer {
+	nWorkers := RENDER_CORES
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	pr := &PixelRenderer{
+		jobs: make([]chan renderJob, nWorkers-1),
+		rngs: make([]*rand.Rand, nWorkers),
+	}
+	for ww := range pr.rngs {
+		pr.rngs[ww] = rand.New(rand.NewSource(seed + int64(ww)))
+	}
+	for ww := range pr.jobs {
+		pr.jobs[ww] = make(chan renderJob, 0)
+		go pr.worker(pr.jobs[ww], pr.rngs[ww+1])
+	}
+	return pr
+}
+
+func (pr *PixelRenderer) worker(jobs chan renderJob, rng *rand.Rand) {
+	for job := range jobs {
+		for ii := job.start; ii < job.end; ii++ {
+			job.fn(ii, rng)
+		}
+		pr.done.Done()
+	}
+}
+
+// Call fn once for each pixel from 0 to nPixels-1, split across the workers,
+// and return when they're all done.
+func (pr *PixelRenderer) Render(nPixels int, fn func(ii int, rng *rand.Rand)) {
+	nWorkers := len(pr.rngs)
+	if nWorkers > nPixels/MIN_PIXELS_PER_WORKER {
+		nWorkers = nPixels / MIN_PIXELS_PER_WORKER
+	}
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	chunk := (nPixels + nWorkers - 1) / nWorkers
+
+	// hand out all but the first chunk
+	for ww := 1; ww < nWorkers; ww++ {
+		start := ww * chunk
+		end := start + chunk
+		if end > nPixels {
+			end = nPixels
+		}
+		if start >= end {
+			break
+		}
+		pr.done.Add(1)
+		pr.jobs[ww-1] <- renderJob{start, end, fn}
+	}
+
+	// do the first chunk ourselves
+	end := chunk
+	if end > nPixels {
+		end = nPixels
+	}
+	for ii := 0; ii < end; ii++ {
+		fn(ii, pr.rngs[0])
+	}
+	pr.done.Wait()
+}
+
+// Stop the workers.
+func (pr *PixelRenderer) Close() {
+	for _, jobs := range pr.jobs {
+		close(jobs)
+	}
+}
@@ -0,0 +1,69 @@
+package opc
+
+import (
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/longears/pixelslinger/clock"
+	"github.com/longears/pixelslinger/midi"
+)
+
+const BENCHMARK_LAYOUT = "../layouts/metal_tower_dense.json"
+
+//================================================================================
+func TestPixelRenderer(t *testing.T) {
+	defer func(cores int) { RENDER_CORES = cores }(RENDER_CORES)
+	for _, cores := range []int{1, 3, 8} {
+		RENDER_CORES = cores
+		renderer := NewPixelRenderer(1)
+		for _, nPixels := range []int{0, 1, 31, 100, 1000} {
+			counts := make([]int, nPixels)
+			renderer.Render(nPixels, func(ii int, rng *rand.Rand) {
+				counts[ii] += 1
+			})
+			for ii, count := range counts {
+				if count != 1 {
+					t.Errorf("%v cores, %v pixels: pixel %v was rendered %v times", cores, nPixels, ii, count)
+				}
+			}
+		}
+		renderer.Close()
+	}
+}
+
+//================================================================================
+// BENCHMARKS
+//   go test ./opc -bench . -cpu 1,2,4
+//   The speedup from more cores needs a multi-core machine to show; see the README.
+
+// Render frames of a pattern on the dense tower layout, using as many cores as -cpu allows.
+func benchmarkPattern(b *testing.B, name string) {
+	defer func(cores int) { RENDER_CORES = cores }(RENDER_CORES)
+	RENDER_CORES = runtime.GOMAXPROCS(0)
+	clock.Set(clock.NewFixedStepClock(1.0 / 40))
+
+	locations := ReadLocations(BENCHMARK_LAYOUT)
+	midiState := &midi.MidiState{}
+	bytesIn := make(chan []byte, 0)
+	bytesOut := make(chan []byte, 0)
+	go PATTERN_REGISTRY[name](locations)(bytesIn, bytesOut, midiState)
+
+	bytes := make([]byte, len(locations))
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		clock.Tick()
+		bytesIn <- bytes
+		bytes = <-bytesOut
+	}
+	b.StopTimer()
+	close(bytesIn)
+}
+
+func BenchmarkFire(b *testing.B) {
+	benchmarkPattern(b, "fire")
+}
+
+func BenchmarkMoire(b *testing.B) {
+	benchmarkPattern(b, "moire")
+}
@@ -0,0 +1,120 @@
+package opc
+
+// Frame resizing
+//   Sources like the OPC server can hand back frames with a different number of pixels
+//   than the layout has.  Stages after the source index into the layout's locations by
+//   pixel number, so the source is wrapped in a resizer which makes sure every frame
+//   leaving it has exactly as many pixels as the layout.
+
+import (
+	"fmt"
+
+	"github.com/longears/pixelslinger/metrics"
+	"github.com/longears/pixelslinger/midi"
+)
+
+// What to do with frames that are the wrong size
+const (
+	RESIZE_FIT    = "fit"    // cut off extra pixels, or fill in missing pixels with black
+	RESIZE_SCALE  = "scale"  // stretch or squash the frame to fit, blending neighboring pixels
+	RESIZE_REJECT = "reject" // print a warning and show the previous good frame instead
+)
+
+var RESIZE_POLICIES = []string{RESIZE_FIT, RESIZE_SCALE, RESIZE_REJECT}
+
+func isResizePolicy(policy string) bool {
+	for _, p := range RESIZE_POLICIES {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// Return a FrameThread which runs the given source thread and makes sure the frames it
+// emits are exactly nPixels long, using the given policy (one of the RESIZE_* constants).
+// The frames it emits are always the frame that was passed in.
+func MakeResizeThread(thread FrameThread, nPixels int, policy string) FrameThread {
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+		chanToThread := make(chan *Frame, 0)
+		chanFromThread := make(chan *Frame, 0)
+		go thread(chanToThread, chanFromThread, midiState)
+
+		scratch := make([]float32, 0, nPixels*3)
+		lastGoodFrame := make([]float32, nPixels*3)
+		lastBadLength := -1
+		for frame := range framesIn {
+			frame.SetLength(nPixels * 3)
+			chanToThread <- frame
+			result := <-chanFromThread
+
+			// the usual case: the source filled in the frame we gave it
+			if len(result.Pixels) == nPixels*3 {
+				if result != frame {
+					frame.CopyFrom(result)
+				}
+				if policy == RESIZE_REJECT {
+					copy(lastGoodFrame, frame.Pixels)
+				}
+				lastBadLength = -1
+				framesOut <- frame
+				continue
+			}
+
+			if len(result.Pixels)/3 != lastBadLength {
+				// only complain when the size changes so we don't print every frame
+				lastBadLength = len(result.Pixels) / 3
+				fmt.Printf("[opc.ResizeThread] got %v pixels, expected %v.  using policy \"%s\"\n", len(result.Pixels)/3, nPixels, policy)
+			}
+
+			// result and frame may be the same, so work from a copy
+			scratch = append(scratch[:0], result.Pixels...)
+			frame.SetLength(nPixels * 3)
+			switch policy {
+			case RESIZE_REJECT:
+				copy(frame.Pixels, lastGoodFrame)
+				metrics.FRAMES_DROPPED.Add("rejected", 1)
+			case RESIZE_SCALE:
+				scaleFrame(frame.Pixels, scratch)
+			default:
+				fitFrame(frame.Pixels, scratch)
+			}
+			framesOut <- frame
+		}
+		close(chanToThread)
+	}
+}
+
+// Copy src into dst, dropping any extra pixels and filling missing ones with black.
+func fitFrame(dst, src []float32) {
+	n := copy(dst, src)
+	for ii := n; ii < len(dst); ii++ {
+		dst[ii] = 0
+	}
+}
+
+// Stretch or squash the pixels in src to fill dst, linearly interpolating between
+// neighboring pixels.  The first and last pixels line up with each other.
+func scaleFrame(dst, src []float32) {
+	nDst := len(dst) / 3
+	nSrc := len(src) / 3
+	if nSrc == 0 {
+		fitFrame(dst, src)
+		return
+	}
+	for ii := 0; ii < nDst; ii++ {
+		pos := 0.0
+		if nDst > 1 {
+			pos = float64(ii) * float64(nSrc-1) / float64(nDst-1)
+		}
+		lo := int(pos)
+		hi := lo + 1
+		if hi >= nSrc {
+			hi = nSrc - 1
+		}
+		pct := pos - float64(lo)
+		for c := 0; c < 3; c++ {
+			dst[ii*3+c] = float32(float64(src[lo*3+c])*(1-pct) + float64(src[hi*3+c])*pct)
+		}
+	}
+}
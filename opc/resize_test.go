@@ -0,0 +1,96 @@
+package opc
+
+import (
+	"testing"
+
+	"github.com/longears/pixelslinger/midi"
+)
+
+// Return a FrameThread which sends back the given pixels, one slice per frame, in a new Frame.
+func makeScriptedThread(script [][]float32) FrameThread {
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+		ii := 0
+		for _ = range framesIn {
+			framesOut <- &Frame{Pixels: append([]float32{}, script[ii]...)}
+			ii++
+		}
+	}
+}
+
+//================================================================================
+func TestFitFrame(t *testing.T) {
+	tests := []struct {
+		dst, src, want []float32
+	}{
+		{make([]float32, 3), []float32{0.1, 0.2, 0.3, 0.4, 0.5, 0.6}, []float32{0.1, 0.2, 0.3}},
+		{[]float32{9, 9, 9, 9, 9, 9}, []float32{0.1, 0.2, 0.3}, []float32{0.1, 0.2, 0.3, 0, 0, 0}},
+		{[]float32{9, 9, 9}, nil, []float32{0, 0, 0}},
+	}
+	for _, test := range tests {
+		fitFrame(test.dst, test.src)
+		if !closeTo(test.dst, test.want) {
+			t.Errorf("fitFrame from %v: got %v, want %v", test.src, test.dst, test.want)
+		}
+	}
+}
+
+func TestScaleFrame(t *testing.T) {
+	tests := []struct {
+		nDst      int
+		src, want []float32
+	}{
+		// up: the ends line up and the new pixels are blended from their neighbors
+		{3, []float32{0, 0, 0, 1, 0.5, 0}, []float32{0, 0, 0, 0.5, 0.25, 0, 1, 0.5, 0}},
+		// down
+		{2, []float32{0, 0, 0, 0.5, 0.5, 0.5, 1, 1, 1}, []float32{0, 0, 0, 1, 1, 1}},
+		{2, []float32{0, 0, 0, 0.3, 0.3, 0.3, 0.6, 0.6, 0.6, 0.9, 0.9, 0.9}, []float32{0, 0, 0, 0.9, 0.9, 0.9}},
+		// one pixel to many, and many to one
+		{3, []float32{0.2, 0.4, 0.6}, []float32{0.2, 0.4, 0.6, 0.2, 0.4, 0.6, 0.2, 0.4, 0.6}},
+		{1, []float32{0.2, 0.4, 0.6, 1, 1, 1}, []float32{0.2, 0.4, 0.6}},
+		// nothing to scale gives black
+		{2, nil, []float32{0, 0, 0, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		dst := filledPixels(test.nDst*3, 9)
+		scaleFrame(dst, test.src)
+		if !closeTo(dst, test.want) {
+			t.Errorf("scaleFrame %v to %v pixels: got %v, want %v", test.src, test.nDst, dst, test.want)
+		}
+	}
+}
+
+func TestResizeThread(t *testing.T) {
+	good1 := []float32{0.1, 0.1, 0.1, 0.2, 0.2, 0.2}
+	good2 := []float32{0.3, 0.3, 0.3, 0.4, 0.4, 0.4}
+	short := []float32{1, 1, 1}
+	long := []float32{0.5, 0.5, 0.5, 0.6, 0.6, 0.6, 0.7, 0.7, 0.7}
+	script := [][]float32{short, good1, short, long, good2, long}
+	tests := []struct {
+		policy string
+		want   [][]float32
+	}{
+		{RESIZE_FIT, [][]float32{{1, 1, 1, 0, 0, 0}, good1, {1, 1, 1, 0, 0, 0}, long[:6], good2, long[:6]}},
+		{RESIZE_SCALE, [][]float32{{1, 1, 1, 1, 1, 1}, good1, {1, 1, 1, 1, 1, 1}, {0.5, 0.5, 0.5, 0.7, 0.7, 0.7}, good2, {0.5, 0.5, 0.5, 0.7, 0.7, 0.7}}},
+		// rejected frames repeat the last good one, or black if there hasn't been one
+		{RESIZE_REJECT, [][]float32{{0, 0, 0, 0, 0, 0}, good1, good1, good1, good2, good2}},
+	}
+	for _, test := range tests {
+		thread := MakeResizeThread(makeScriptedThread(script), 2, test.policy)
+		framesIn := make(chan *Frame, 0)
+		framesOut := make(chan *Frame, 0)
+		go thread(framesIn, framesOut, &midi.MidiState{})
+		frame := NewFrame(2)
+		for ii, want := range test.want {
+			framesIn <- frame
+			got := <-framesOut
+			if got != frame {
+				t.Errorf("%s: frame %v should have come back in the frame that was passed in", test.policy, ii)
+			}
+			if !closeTo(got.Pixels, want) {
+				t.Errorf("%s: frame %v: got %v, want %v", test.policy, ii, got.Pixels, want)
+			}
+			frame = got
+		}
+		close(framesIn)
+	}
+}
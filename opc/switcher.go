@@ -0,0 +1,120 @@
+package opc
+
+// Switching sources
+//   Every pipeline's source runs inside a switchable thread, so something outside the
+//   pipeline (like the remote control API) can ask for a different source while it runs.
+//   The switch happens at the start of the next frame, using the pipeline's transition.
+//   SwitchToOver can ask for a different transition time than the pipeline's.
+//   A switch asked for before the pipeline starts (like a source restored from the
+//   state file) happens right away instead, without a transition.
+//
+//   Any source name that --source accepts can be switched to, except OPC servers, since
+//   a second server can't listen on a port the first one might still be using.
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/longears/pixelslinger/clock"
+	"github.com/longears/pixelslinger/midi"
+)
+
+// Lets other goroutines change the source of a running pipeline.
+// Safe to use from any goroutine.
+type SourceSwitcher struct {
+	locations  []float64
+	wrap       func(FrameThread) FrameThread // applied to each new source, so it matches the layout
+	transition TransitionSettings
+
+	mutex    sync.Mutex
+	current  string
+	requests chan switchRequest // holds at most one switch which hasn't happened yet
+}
+
+type switchRequest struct {
+	name     string
+	duration float64 // seconds
+}
+
+func newSourceSwitcher(name string, locations []float64, wrap func(FrameThread) FrameThread, transition TransitionSettings) *SourceSwitcher {
+	return &SourceSwitcher{
+		locations:  locations,
+		wrap:       wrap,
+		transition: transition,
+		current:    name,
+		requests:   make(chan switchRequest, 1),
+	}
+}
+
+// The transition SwitchTo uses.
+func (ss *SourceSwitcher) Transition() TransitionSettings {
+	return ss.transition
+}
+
+// The name of the source that's playing, or that we're about to switch to.
+func (ss *SourceSwitcher) Current() string {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.current
+}
+
+// Ask the pipeline to switch to the named source on its next frame.
+// Returns an error if there's no such source or it can't be switched to.
+// If an earlier switch hasn't happened yet, it's replaced by this one.
+func (ss *SourceSwitcher) SwitchTo(name string) error {
+	return ss.SwitchToOver(name, ss.transition.Duration)
+}
+
+// Like SwitchTo, with a transition lasting the given number of seconds.
+func (ss *SourceSwitcher) SwitchToOver(name string, seconds float64) error {
+	if err := ss.Check(name); err != nil {
+		return err
+	}
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	select {
+	case <-ss.requests:
+	default:
+	}
+	ss.requests <- switchRequest{name, seconds}
+	ss.current = name
+	return nil
+}
+
+// Return an error if SwitchTo would refuse the named source.
+func (ss *SourceSwitcher) Check(name string) error {
+	if isOpcServerName(name) {
+		return fmt.Errorf("can't switch to an OPC server while running")
+	}
+	if err := validateSourceName(name); err != nil {
+		return err
+	}
+	return checkSourceForLayout(name, ss.locations)
+}
+
+// Return a FrameThread which runs the given source thread until the switcher
+// asks for a different one, then transitions to that.
+func MakeSwitchableThread(thread FrameThread, ss *SourceSwitcher) FrameThread {
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+		runner := newTransitionRunner(ss.transition.Kind, ss.transition.Duration, ss.locations)
+		select {
+		case req := <-ss.requests:
+			fmt.Println("[opc.SwitchableThread] starting with", req.name)
+			thread = ss.wrap(MakeSourceThread(req.name, ss.locations, ss.transition))
+		default:
+		}
+		runner.switchToThread(ss.Current(), thread, clock.Now(), midiState)
+		for frame := range framesIn {
+			t := clock.Now()
+			select {
+			case req := <-ss.requests:
+				fmt.Println("[opc.SwitchableThread] switching to", req.name)
+				runner.duration = req.duration
+				runner.switchToThread(req.name, ss.wrap(MakeSourceThread(req.name, ss.locations, ss.transition)), t, midiState)
+			default:
+			}
+			framesOut <- runner.render(frame, t)
+		}
+		runner.stop()
+	}
+}
@@ -0,0 +1,255 @@
+package opc
+
+// Transitions
+//   When a switcher changes from one pattern to another, both patterns run side by side
+//   for a little while and a Transitioner blends their frames together.
+
+import (
+	"math/rand"
+
+	"github.com/longears/pixelslinger/colorutils"
+	"github.com/longears/pixelslinger/midi"
+)
+
+// Kinds of transitions
+const (
+	TRANSITION_CUT        = "cut"        // switch immediately
+	TRANSITION_CROSSFADE  = "crossfade"  // blend from one pattern to the other
+	TRANSITION_WIPE_X     = "wipe-x"     // sweep the new pattern in along the layout's x axis
+	TRANSITION_WIPE_Y     = "wipe-y"     // ... y axis
+	TRANSITION_WIPE_Z     = "wipe-z"     // ... z axis, from the bottom up
+	TRANSITION_DISSOLVE   = "dissolve"   // switch each pixel over at a random moment
+	TRANSITION_FADE_BLACK = "fade-black" // fade the old pattern out, then the new one in
+)
+
+var TRANSITION_KINDS = []string{
+	TRANSITION_CROSSFADE,
+	TRANSITION_WIPE_X,
+	TRANSITION_WIPE_Y,
+	TRANSITION_WIPE_Z,
+	TRANSITION_DISSOLVE,
+	TRANSITION_FADE_BLACK,
+	TRANSITION_CUT,
+}
+
+// How wide the soft edge of wipes and dissolves is, as a fraction of the whole transition
+const TRANSITION_SOFTNESS = 0.15
+
+// Which transition switchers use, and how long it lasts in seconds, unless the
+// pipeline says otherwise
+const DEFAULT_TRANSITION = TRANSITION_CROSSFADE
+const DEFAULT_TRANSITION_TIME = 1.0
+
+// Which transition a switcher uses and how long it lasts.
+type TransitionSettings struct {
+	Kind     string  // one of TRANSITION_KINDS
+	Duration float64 // seconds
+}
+
+//--------------------------------------------------------------------------------
+// TRANSITIONER
+
+// Blends the frames of an outgoing and an incoming pattern.
+type Transitioner struct {
+	Kind     string
+	position []float64 // per pixel, 0 to 1: when this pixel switches over during a wipe or dissolve
+}
+
+// Make a Transitioner of the given kind (one of TRANSITION_KINDS) for the given layout.
+func NewTransitioner(kind string, locations []float64) *Transitioner {
+	tr := &Transitioner{Kind: kind}
+	n_pixels := len(locations) / 3
+	tr.position = make([]float64, n_pixels)
+
+	switch kind {
+	case TRANSITION_WIPE_X, TRANSITION_WIPE_Y, TRANSITION_WIPE_Z:
+		axis := 0
+		if kind == TRANSITION_WIPE_Y {
+			axis = 1
+		} else if kind == TRANSITION_WIPE_Z {
+			axis = 2
+		}
+		// find the extent of the layout along the axis
+		var minCoord, maxCoord float64
+		for ii := 0; ii < n_pixels; ii++ {
+			v := locations[ii*3+axis]
+			if ii == 0 || v < minCoord {
+				minCoord = v
+			}
+			if ii == 0 || v > maxCoord {
+				maxCoord = v
+			}
+		}
+		for ii := range tr.position {
+			tr.position[ii] = colorutils.Clamp(colorutils.Remap(locations[ii*3+axis], minCoord, maxCoord, 0, 1), 0, 1)
+		}
+	case TRANSITION_DISSOLVE:
+		rng := rand.New(rand.NewSource(99))
+		for ii := range tr.position {
+			tr.position[ii] = rng.Float64()
+		}
+	}
+	return tr
+}
+
+// Blend two frames' pixels into dst.  pct goes from 0 (all "from") to 1 (all "to").
+// dst may be the same slice as from or to.
+// If the slices are different lengths, or longer than the layout, only the channels they
+// have in common within the layout are blended and the rest of dst is copied from "to".
+func (tr *Transitioner) Blend(dst, from, to []float32, pct float64) {
+	pct = colorutils.Clamp(pct, 0, 1)
+	n := len(tr.position) * 3
+	for _, pixels := range [][]float32{dst, from, to} {
+		if len(pixels) < n {
+			n = len(pixels)
+		}
+	}
+	copy(dst[n:], to[n:])
+	for ii := 0; ii < n; ii++ {
+		a := float64(from[ii])
+		b := float64(to[ii])
+		var v float64
+		switch tr.Kind {
+		case TRANSITION_CUT:
+			v = b
+		case TRANSITION_FADE_BLACK:
+			if pct < 0.5 {
+				v = a * (1 - pct*2)
+			} else {
+				v = b * (pct*2 - 1)
+			}
+		case TRANSITION_WIPE_X, TRANSITION_WIPE_Y, TRANSITION_WIPE_Z, TRANSITION_DISSOLVE:
+			// stretch pct a little so the soft edge starts before the first pixel and ends after the last one
+			edge := pct*(1+TRANSITION_SOFTNESS) - TRANSITION_SOFTNESS
+			mix := colorutils.Clamp((edge-tr.position[ii/3])/TRANSITION_SOFTNESS+1, 0, 1)
+			v = a*(1-mix) + b*mix
+		default: // TRANSITION_CROSSFADE
+			v = a*(1-pct) + b*pct
+		}
+		dst[ii] = float32(v)
+	}
+}
+
+//--------------------------------------------------------------------------------
+// SUBPATTERNS
+
+// A pattern running in its own goroutine on behalf of a switcher.
+type subPattern struct {
+	name            string
+	chanToPattern   chan *Frame
+	chanFromPattern chan *Frame
+}
+
+// Look up a pattern in PATTERN_REGISTRY and launch it with the given knob params (which may be nil).
+func startSubPattern(name string, params map[string]float64, locations []float64, midiState *midi.MidiState) *subPattern {
+	return startSubThread(name, makePatternFrameThread(name, params, locations), midiState)
+}
+
+// Look up a pattern in PATTERN_REGISTRY and make a FrameThread which runs it with the
+// given knob params (which may be nil).
+func makePatternFrameThread(name string, params map[string]float64, locations []float64) FrameThread {
+	return MakeKnobOverrideFrameThread(MakeFrameThread(PATTERN_REGISTRY[name](locations)), params)
+}
+
+// Launch any FrameThread as a subpattern.  name is just for display.
+func startSubThread(name string, thread FrameThread, midiState *midi.MidiState) *subPattern {
+	sp := &subPattern{
+		name:            name,
+		chanToPattern:   make(chan *Frame, 0),
+		chanFromPattern: make(chan *Frame, 0),
+	}
+	go thread(sp.chanToPattern, sp.chanFromPattern, midiState)
+	return sp
+}
+
+// Stop the pattern.  If patterns are properly written using "for bytes := range bytesIn",
+// this terminates the pattern's goroutine.
+func (sp *subPattern) stop() {
+	close(sp.chanToPattern)
+}
+
+// Runs two subpatterns side by side while transitioning from one to the other.
+type transitionRunner struct {
+	transitioner  *Transitioner
+	duration      float64
+	current       *subPattern
+	outgoing      *subPattern // nil when not transitioning
+	startTime     float64
+	outgoingFrame *Frame
+}
+
+func newTransitionRunner(kind string, duration float64, locations []float64) *transitionRunner {
+	return &transitionRunner{
+		transitioner:  NewTransitioner(kind, locations),
+		duration:      duration,
+		outgoingFrame: &Frame{},
+	}
+}
+
+// Start switching to the named pattern (with optional knob params) at time t.
+// If a transition is already in progress, the oldest pattern is stopped right away.
+func (tr *transitionRunner) switchTo(name string, params map[string]float64, t float64, locations []float64, midiState *midi.MidiState) {
+	tr.switchToThread(name, makePatternFrameThread(name, params, locations), t, midiState)
+}
+
+// Like switchTo, for any FrameThread.
+func (tr *transitionRunner) switchToThread(name string, thread FrameThread, t float64, midiState *midi.MidiState) {
+	if tr.outgoing != nil {
+		tr.outgoing.stop()
+		tr.outgoing = nil
+	}
+	if tr.current != nil {
+		if tr.duration > 0 && tr.transitioner.Kind != TRANSITION_CUT {
+			tr.outgoing = tr.current
+			tr.startTime = t
+		} else {
+			tr.current.stop()
+		}
+	}
+	tr.current = startSubThread(name, thread, midiState)
+}
+
+// Fill the frame using the current pattern, blended with the outgoing one if we're in a transition.
+// The frame that comes back keeps the sequence number of the one passed in.
+func (tr *transitionRunner) render(frame *Frame, t float64) *Frame {
+	seq := frame.Seq
+	if tr.outgoing == nil {
+		tr.current.chanToPattern <- frame
+		frame = <-tr.current.chanFromPattern
+		frame.Seq = seq
+		return frame
+	}
+
+	// run both patterns in parallel
+	tr.outgoingFrame.CopyFrom(frame)
+	tr.outgoing.chanToPattern <- tr.outgoingFrame
+	tr.current.chanToPattern <- frame
+	tr.outgoingFrame = <-tr.outgoing.chanFromPattern
+	frame = <-tr.current.chanFromPattern
+	frame.Seq = seq
+
+	pct := (t - tr.startTime) / tr.duration
+	if pct >= 1 {
+		tr.outgoing.stop()
+		tr.outgoing = nil
+		return frame
+	}
+	if len(tr.outgoingFrame.Pixels) != len(frame.Pixels) {
+		// the patterns disagree about the size; the resizer after us will sort out the new one
+		return frame
+	}
+	tr.transitioner.Blend(frame.Pixels, tr.outgoingFrame.Pixels, frame.Pixels, pct)
+	return frame
+}
+
+// Stop all running patterns.
+func (tr *transitionRunner) stop() {
+	if tr.outgoing != nil {
+		tr.outgoing.stop()
+		tr.outgoing = nil
+	}
+	if tr.current != nil {
+		tr.current.stop()
+		tr.current = nil
+	}
+}
@@ -0,0 +1,130 @@
+package opc
+
+import (
+	"math"
+	"testing"
+)
+
+// Six pixels on a diagonal line from (0,0,0) to (5,5,5), so every wipe goes the same way.
+var DIAGONAL_LOCATIONS = []float64{0, 0, 0, 1, 1, 1, 2, 2, 2, 3, 3, 3, 4, 4, 4, 5, 5, 5}
+
+func filledPixels(n int, v float32) []float32 {
+	pixels := make([]float32, n)
+	for ii := range pixels {
+		pixels[ii] = v
+	}
+	return pixels
+}
+
+// Blend from black to white, so each channel comes out as how far it's gotten.
+func blendBlackToWhite(kind string, pct float64) []float32 {
+	dst := make([]float32, len(DIAGONAL_LOCATIONS))
+	NewTransitioner(kind, DIAGONAL_LOCATIONS).Blend(dst, filledPixels(len(dst), 0), filledPixels(len(dst), 1), pct)
+	return dst
+}
+
+//================================================================================
+func TestBlendEndpoints(t *testing.T) {
+	for _, kind := range TRANSITION_KINDS {
+		for _, pct := range []float64{-1, 0, 1, 2} {
+			want := float32(0)
+			if pct >= 1 || kind == TRANSITION_CUT {
+				want = 1
+			}
+			for ii, v := range blendBlackToWhite(kind, pct) {
+				if v != want {
+					t.Errorf("%s at %v: channel %v is %v, want %v", kind, pct, ii, v, want)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestBlendMidway(t *testing.T) {
+	// crossfade mixes every pixel the same amount
+	for _, v := range blendBlackToWhite(TRANSITION_CROSSFADE, 0.25) {
+		if math.Abs(float64(v)-0.25) > 1e-6 {
+			t.Errorf("crossfade at 0.25: got %v", v)
+		}
+	}
+
+	// fade-black goes through black halfway, and fades the old pattern out before that
+	fadeBlack := NewTransitioner(TRANSITION_FADE_BLACK, DIAGONAL_LOCATIONS)
+	dst := make([]float32, 3)
+	for _, test := range []struct {
+		pct  float64
+		want float32
+	}{{0.25, 0.25}, {0.5, 0}, {0.75, 0.5}} {
+		fadeBlack.Blend(dst, []float32{0.5, 0.5, 0.5}, []float32{1, 1, 1}, test.pct)
+		if math.Abs(float64(dst[0]-test.want)) > 1e-6 {
+			t.Errorf("fade-black at %v: got %v, want %v", test.pct, dst[0], test.want)
+		}
+	}
+
+	// wipes start at the low end of their axis
+	for _, kind := range []string{TRANSITION_WIPE_X, TRANSITION_WIPE_Y, TRANSITION_WIPE_Z} {
+		pixels := blendBlackToWhite(kind, 0.5)
+		if pixels[0] != 1 || pixels[len(pixels)-1] != 0 {
+			t.Errorf("%s at 0.5: expected the first pixel done and the last one not started, got %v", kind, pixels)
+		}
+		for ii := 3; ii < len(pixels); ii++ {
+			if pixels[ii] > pixels[ii-3] {
+				t.Errorf("%s at 0.5: pixel %v is further along than the one before it: %v", kind, ii/3, pixels)
+				break
+			}
+		}
+	}
+
+	// each pixel of a dissolve switches over at its own moment, which depends on
+	// Blend stretching pct to make room for the soft edge
+	dissolve := NewTransitioner(TRANSITION_DISSOLVE, DIAGONAL_LOCATIONS)
+	for ii, pos := range dissolve.position {
+		before := blendBlackToWhite(TRANSITION_DISSOLVE, pos/(1+TRANSITION_SOFTNESS)-0.001)
+		after := blendBlackToWhite(TRANSITION_DISSOLVE, (pos+TRANSITION_SOFTNESS)/(1+TRANSITION_SOFTNESS)+0.001)
+		if before[ii*3] != 0 || after[ii*3] != 1 {
+			t.Errorf("dissolve: pixel %v should switch over around %v, got %v before and %v after", ii, pos, before[ii*3], after[ii*3])
+		}
+	}
+}
+
+func TestBlendInPlace(t *testing.T) {
+	// the transition runner blends into the incoming frame
+	tr := NewTransitioner(TRANSITION_CROSSFADE, DIAGONAL_LOCATIONS)
+	from := filledPixels(len(DIAGONAL_LOCATIONS), 0.2)
+	to := filledPixels(len(DIAGONAL_LOCATIONS), 1)
+	tr.Blend(to, from, to, 0)
+	if math.Abs(float64(to[0])-0.2) > 1e-6 || from[0] != 0.2 {
+		t.Errorf("blending into \"to\" at 0 should give \"from\", got %v", to[0])
+	}
+}
+
+func TestBlendLengthMismatch(t *testing.T) {
+	tr := NewTransitioner(TRANSITION_CROSSFADE, DIAGONAL_LOCATIONS)
+	n := len(DIAGONAL_LOCATIONS)
+
+	// a short "to" only blends what it has and leaves the rest of dst alone
+	dst := filledPixels(n, 7)
+	tr.Blend(dst, filledPixels(n, 0), filledPixels(3, 1), 0.5)
+	if dst[0] != 0.5 || dst[3] != 7 || dst[n-1] != 7 {
+		t.Errorf("short \"to\": got %v", dst)
+	}
+
+	// a short "from" blends what it has and the rest comes from "to"
+	dst = filledPixels(n, 7)
+	tr.Blend(dst, filledPixels(3, 0), filledPixels(n, 1), 0.5)
+	if dst[0] != 0.5 || dst[3] != 1 || dst[n-1] != 1 {
+		t.Errorf("short \"from\": got %v", dst)
+	}
+
+	// frames longer than the layout get "to" past the end of the layout, even for wipes
+	wipe := NewTransitioner(TRANSITION_WIPE_X, DIAGONAL_LOCATIONS)
+	dst = filledPixels(n+6, 7)
+	wipe.Blend(dst, filledPixels(n+6, 0), filledPixels(n+6, 1), 0)
+	if dst[n-1] != 0 || dst[n] != 1 || dst[n+5] != 1 {
+		t.Errorf("frames longer than the layout: got %v", dst)
+	}
+
+	// a short dst doesn't panic
+	tr.Blend(make([]float32, 2), filledPixels(n, 0), filledPixels(n, 1), 0.5)
+}
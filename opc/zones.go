@@ -0,0 +1,220 @@
+package opc
+
+// Zones
+//   A zones source splits the layout into zones and runs a different pattern from
+//   PATTERN_REGISTRY in each one, then stitches them back together into one frame.
+//   Choose it with "--source zones:path/to/file.json".
+//
+//   {
+//       "zones": [
+//           {"name": "fire", "range": [0, 479]},
+//           {"name": "aqua", "box": {"min": [-1, -1, -1], "max": [1, 1, 0.2]}, "params": {"speed": 0.3}},
+//           {"name": "white", "pixels": [480, 481, 482]}
+//       ]
+//   }
+//
+//   Each zone has exactly one of:
+//     "range": the first and last pixel index, inclusive
+//     "box":   a bounding box in layout space; pixels on the edges are included
+//     "pixels": a list of pixel indices
+//   Each zone's pattern only sees the locations of its own pixels, so spatial patterns
+//   fill the zone instead of the whole layout.  Zones render in parallel.  Pixels in no zone
+//   are black, and where zones overlap the later one wins.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/longears/pixelslinger/midi"
+)
+
+// Sources starting with this are zone files
+const ZONES_PREFIX = "zones:"
+
+//--------------------------------------------------------------------------------
+// TYPES
+
+// A box in layout space.
+type BoundingBox struct {
+	Min [3]float64 `json:"min"`
+	Max [3]float64 `json:"max"`
+}
+
+// One zone in a zones file.
+type ZoneConfig struct {
+	StageConfig
+	Range  []int        `json:"range,omitempty"`  // first and last pixel index, inclusive
+	Box    *BoundingBox `json:"box,omitempty"`    // pixels inside this box
+	Pixels []int        `json:"pixels,omitempty"` // these pixel indices
+}
+
+// The contents of a zones file.
+type ZonesConfig struct {
+	Zones []ZoneConfig `json:"zones"`
+}
+
+//--------------------------------------------------------------------------------
+// LOADING
+
+// Read a zones file and validate it.
+// This can't check the zones against the layout; use ZonesConfig.PixelsForLayout for that.
+func ReadZonesConfig(fn string) (*ZonesConfig, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("could not read zones file %s: %v", fn, err)
+	}
+	zc := &ZonesConfig{}
+	if err := json.Unmarshal(data, zc); err != nil {
+		return nil, fmt.Errorf("could not parse zones file %s: %v", fn, err)
+	}
+	if err := zc.validate(); err != nil {
+		return nil, fmt.Errorf("bad zones file %s: %v", fn, err)
+	}
+	return zc, nil
+}
+
+func (zc *ZonesConfig) validate() error {
+	if len(zc.Zones) == 0 {
+		return fmt.Errorf("no zones")
+	}
+	for _, zone := range zc.Zones {
+		if _, ok := PATTERN_REGISTRY[zone.Name]; !ok {
+			return fmt.Errorf("unknown pattern \"%s\"", zone.Name)
+		}
+		if err := validateKnobParams(zone.StageConfig); err != nil {
+			return err
+		}
+		nShapes := 0
+		if zone.Range != nil {
+			nShapes += 1
+			if len(zone.Range) != 2 || zone.Range[0] < 0 || zone.Range[1] < zone.Range[0] {
+				return fmt.Errorf("range for \"%s\" should be [first, last] with first <= last", zone.Name)
+			}
+		}
+		if zone.Box != nil {
+			nShapes += 1
+		}
+		if zone.Pixels != nil {
+			nShapes += 1
+		}
+		if nShapes != 1 {
+			return fmt.Errorf("zone for \"%s\" should have exactly one of range, box, or pixels", zone.Name)
+		}
+	}
+	return nil
+}
+
+// Return the pixel indices in each zone for the given layout.
+// Returns an error if a zone refers to pixels past the end of the layout or has no pixels in it.
+func (zc *ZonesConfig) PixelsForLayout(locations []float64) ([][]int, error) {
+	n_pixels := len(locations) / 3
+	result := make([][]int, len(zc.Zones))
+	for zz, zone := range zc.Zones {
+		var pixels []int
+		switch {
+		case zone.Range != nil:
+			// check before making the list, since a huge range would take forever
+			if zone.Range[1] >= n_pixels {
+				return nil, fmt.Errorf("zone for \"%s\" has pixel %v but the layout only has %v pixels", zone.Name, zone.Range[1], n_pixels)
+			}
+			for ii := zone.Range[0]; ii <= zone.Range[1]; ii++ {
+				pixels = append(pixels, ii)
+			}
+		case zone.Box != nil:
+			for ii := 0; ii < n_pixels; ii++ {
+				if zone.Box.contains(locations[ii*3 : ii*3+3]) {
+					pixels = append(pixels, ii)
+				}
+			}
+		default:
+			pixels = zone.Pixels
+		}
+		if len(pixels) == 0 {
+			return nil, fmt.Errorf("zone for \"%s\" has no pixels in it", zone.Name)
+		}
+		for _, ii := range pixels {
+			if ii < 0 || ii >= n_pixels {
+				return nil, fmt.Errorf("zone for \"%s\" has pixel %v but the layout only has %v pixels", zone.Name, ii, n_pixels)
+			}
+		}
+		result[zz] = pixels
+	}
+	return result, nil
+}
+
+func (box *BoundingBox) contains(xyz []float64) bool {
+	for axis := 0; axis < 3; axis++ {
+		if xyz[axis] < box.Min[axis] || xyz[axis] > box.Max[axis] {
+			return false
+		}
+	}
+	return true
+}
+
+//--------------------------------------------------------------------------------
+// SOURCE
+
+// Return a FrameThread which runs a pattern in each zone of the given file.
+// The file should already have been checked with ReadZonesConfig and PixelsForLayout.
+func MakeZonesThread(fn string, locations []float64) FrameThread {
+	zc, err := ReadZonesConfig(fn)
+	if err != nil {
+		panic(fmt.Sprintf("[opc.ZonesThread] %v", err))
+	}
+	zonePixels, err := zc.PixelsForLayout(locations)
+	if err != nil {
+		panic(fmt.Sprintf("[opc.ZonesThread] %v", err))
+	}
+
+	return func(framesIn chan *Frame, framesOut chan *Frame, midiState *midi.MidiState) {
+		fmt.Printf("[opc.ZonesThread] running %v zones from %s\n", len(zc.Zones), fn)
+
+		// give each zone's pattern only the locations of its own pixels
+		patterns := make([]*subPattern, len(zc.Zones))
+		zoneFrames := make([]*Frame, len(zc.Zones))
+		for zz, zone := range zc.Zones {
+			zoneLocations := make([]float64, len(zonePixels[zz])*3)
+			for kk, ii := range zonePixels[zz] {
+				copy(zoneLocations[kk*3:kk*3+3], locations[ii*3:ii*3+3])
+			}
+			patterns[zz] = startSubPattern(zone.Name, zone.Params, zoneLocations, midiState)
+			zoneFrames[zz] = NewFrame(len(zonePixels[zz]))
+		}
+
+		for frame := range framesIn {
+			// let all the patterns render at the same time
+			for zz, pattern := range patterns {
+				zoneFrames[zz].SetLength(len(zonePixels[zz]) * 3)
+				zoneFrames[zz].Time, zoneFrames[zz].Delta = frame.Time, frame.Delta
+				pattern.chanToPattern <- zoneFrames[zz]
+			}
+			for zz, pattern := range patterns {
+				zoneFrames[zz] = <-pattern.chanFromPattern
+			}
+
+			// stitch the zones together
+			for ii := range frame.Pixels {
+				frame.Pixels[ii] = 0
+			}
+			for zz, pixels := range zonePixels {
+				src := zoneFrames[zz].Pixels
+				for kk, ii := range pixels {
+					if kk*3+2 >= len(src) {
+						break
+					}
+					if ii*3+2 >= len(frame.Pixels) {
+						continue
+					}
+					copy(frame.Pixels[ii*3:ii*3+3], src[kk*3:kk*3+3])
+				}
+			}
+
+			framesOut <- frame
+		}
+
+		for _, pattern := range patterns {
+			pattern.stop()
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package opc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+)
+
+// Six pixels in a row along the x axis, at x = 0 to 5.
+var ROW_LOCATIONS = []float64{0, 0, 0, 1, 0, 0, 2, 0, 0, 3, 0, 0, 4, 0, 0, 5, 0, 0}
+
+// Write contents to a file in a new temp directory and return its name.
+// Call the cleanup function when done.
+func writeTempFile(t *testing.T, contents string) (fn string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "opc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn = filepath.Join(dir, "test.json")
+	if err := ioutil.WriteFile(fn, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn, func() { os.RemoveAll(dir) }
+}
+
+// Run a thread for one frame of nPixels gray pixels, with controls at their defaults,
+// and return the pixels it sends back.
+func renderOneFrame(thread FrameThread, nPixels int) []float32 {
+	midiState := &midi.MidiState{}
+	controls.Reset(midiState)
+	framesIn := make(chan *Frame, 0)
+	framesOut := make(chan *Frame, 0)
+	go thread(framesIn, framesOut, midiState)
+	frame := NewFrame(nPixels)
+	for ii := range frame.Pixels {
+		frame.Pixels[ii] = 0.5
+	}
+	framesIn <- frame
+	frame = <-framesOut
+	close(framesIn)
+	return frame.Pixels
+}
+
+//================================================================================
+func TestPixelsForLayout(t *testing.T) {
+	zc := &ZonesConfig{Zones: []ZoneConfig{
+		{StageConfig: StageConfig{Name: "fire"}, Range: []int{1, 3}},
+		{StageConfig: StageConfig{Name: "aqua"}, Box: &BoundingBox{Min: [3]float64{3.5, -1, -1}, Max: [3]float64{5, 1, 1}}},
+		{StageConfig: StageConfig{Name: "white"}, Pixels: []int{5, 0}},
+	}}
+	pixels, err := zc.PixelsForLayout(ROW_LOCATIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]int{{1, 2, 3}, {4, 5}, {5, 0}}
+	for zz := range want {
+		if len(pixels[zz]) != len(want[zz]) {
+			t.Errorf("zone %v: got %v, want %v", zz, pixels[zz], want[zz])
+			continue
+		}
+		for kk := range want[zz] {
+			if pixels[zz][kk] != want[zz][kk] {
+				t.Errorf("zone %v: got %v, want %v", zz, pixels[zz], want[zz])
+				break
+			}
+		}
+	}
+
+	bad := []ZoneConfig{
+		{StageConfig: StageConfig{Name: "fire"}, Range: []int{4, 6}},
+		{StageConfig: StageConfig{Name: "fire"}, Range: []int{0, 1 << 30}}, // has to fail without listing them all
+		{StageConfig: StageConfig{Name: "fire"}, Pixels: []int{2, 6}},
+		{StageConfig: StageConfig{Name: "fire"}, Pixels: []int{-1}},
+		{StageConfig: StageConfig{Name: "fire"}, Pixels: []int{}},
+		{StageConfig: StageConfig{Name: "fire"}, Box: &BoundingBox{Min: [3]float64{0, 1, 0}, Max: [3]float64{5, 2, 0}}},
+	}
+	for _, zone := range bad {
+		zc := &ZonesConfig{Zones: []ZoneConfig{zone}}
+		if _, err := zc.PixelsForLayout(ROW_LOCATIONS); err == nil {
+			t.Errorf("expected an error for %+v", zone)
+		}
+	}
+}
+
+func TestOverlappingZones(t *testing.T) {
+	fn, cleanup := writeTempFile(t, `{"zones": [
+		{"name": "white", "params": {"morph": 1}, "range": [0, 3]},
+		{"name": "off", "pixels": [2, 3, 4]}
+	]}`)
+	defer cleanup()
+
+	// the later zone wins where they overlap, and pixels in no zone are black
+	pixels := renderOneFrame(MakeZonesThread(fn, ROW_LOCATIONS), len(ROW_LOCATIONS)/3)
+	want := []float32{1, 1, 0, 0, 0, 0}
+	for ii, v := range want {
+		for c := 0; c < 3; c++ {
+			if pixels[ii*3+c] != v {
+				t.Errorf("pixel %v: got %v, want %v", ii, pixels[ii*3:ii*3+3], v)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package osc
+
+// Mappings
+//   A mapping file lists which OSC addresses set which controls:
+//
+//   {
+//       "include_defaults": true,
+//       "mappings": [
+//           {"address": "/1/fader1", "control": "gain"},
+//           {"address": "/1/fader2", "controller": 20},
+//           {"address": "/1/toggle1", "control": "slowmo"},
+//           {"address": "/note/c4", "key": 60},
+//           {"address": "/ableton/volume", "control": "gain", "min": -70, "max": 6}
+//       ]
+//   }
+//
+//   Each mapping has exactly one of "control" (a name from the controls package),
+//   "controller" or "key" (a MIDI number from 0 to 127, which goes through the MIDI
+//   mapping like the real controller).
+//   The first numeric argument of the message is the value.  Floats go from 0 to 1
+//   and ints from 0 to 127, unless "min" and "max" give a different range.  True and
+//   false are 1 and 0.  The value is scaled to the control's range; bools and triggers
+//   are on above 0.  A key is pressed when its value is above 0 and released at 0.
+//
+//   Without a mapping file, or with "include_defaults", these addresses work:
+//     /knob/1 ... /knob/8, /pad/1 ... /pad/8    the LPD8's knobs and pads
+//     /control/NAME                             controls by name, like /control/hue
+//     /controller/N, /key/N                     any MIDI controller or key, 0 to 127
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+)
+
+//--------------------------------------------------------------------------------
+// TYPES
+
+// One line of a mapping file.
+type MappingEntry struct {
+	Address    string   `json:"address"`
+	Control    string   `json:"control,omitempty"`
+	Controller *int     `json:"controller,omitempty"`
+	Key        *int     `json:"key,omitempty"`
+	Min        *float64 `json:"min,omitempty"` // incoming value which means 0
+	Max        *float64 `json:"max,omitempty"` // incoming value which means the most
+}
+
+// The contents of a mapping file.
+type MappingConfig struct {
+	IncludeDefaults bool           `json:"include_defaults"`
+	Mappings        []MappingEntry `json:"mappings"`
+}
+
+// A mapping which is ready to use.  Make one with NewMapping or ReadMapping.
+type Mapping struct {
+	targets   []target
+	byAddress map[string][]int // address -> indexes into targets, for addresses without wildcards
+}
+
+// Where one address goes.
+type target struct {
+	address  string
+	control  *controls.Control // or nil for a raw MIDI message:
+	kind     byte              // midi.CONTROLLER or midi.NOTE_ON
+	number   byte
+	min, max *float64
+}
+
+//--------------------------------------------------------------------------------
+// LOADING
+
+// Read a mapping file and validate it.
+func ReadMapping(fn string) (*Mapping, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("could not read OSC mapping file %s: %v", fn, err)
+	}
+	mc := &MappingConfig{}
+	if err := json.Unmarshal(data, mc); err != nil {
+		return nil, fmt.Errorf("could not parse OSC mapping file %s: %v", fn, err)
+	}
+	mapping, err := NewMapping(mc)
+	if err != nil {
+		return nil, fmt.Errorf("bad OSC mapping file %s: %v", fn, err)
+	}
+	return mapping, nil
+}
+
+// Validate a MappingConfig and make a Mapping from it.  A nil config means the default mapping.
+func NewMapping(mc *MappingConfig) (*Mapping, error) {
+	if mc == nil {
+		mc = &MappingConfig{IncludeDefaults: true}
+	}
+	entries := mc.Mappings
+	if mc.IncludeDefaults {
+		entries = append(defaultEntries(), entries...)
+	}
+	mapping := &Mapping{byAddress: make(map[string][]int)}
+	for _, entry := range entries {
+		t, err := entry.target()
+		if err != nil {
+			return nil, err
+		}
+		mapping.byAddress[t.address] = append(mapping.byAddress[t.address], len(mapping.targets))
+		mapping.targets = append(mapping.targets, t)
+	}
+	return mapping, nil
+}
+
+func (entry *MappingEntry) target() (target, error) {
+	t := target{address: entry.Address, min: entry.Min, max: entry.Max}
+	if len(entry.Address) < 2 || entry.Address[0] != '/' || isPattern(entry.Address) {
+		return t, fmt.Errorf("bad address %q (should start with / and have no wildcards)", entry.Address)
+	}
+	if (entry.Min == nil) != (entry.Max == nil) || (entry.Min != nil && *entry.Min == *entry.Max) {
+		return t, fmt.Errorf("%s should have both min and max, and they should be different", entry.Address)
+	}
+	nTargets := 0
+	if entry.Control != "" {
+		nTargets += 1
+		t.control = controls.Lookup(entry.Control)
+		if t.control == nil {
+			return t, fmt.Errorf("unknown control \"%s\" for %s (should be one of %s)", entry.Control, entry.Address, strings.Join(controls.Names(), ", "))
+		}
+	}
+	if entry.Controller != nil {
+		nTargets += 1
+		if *entry.Controller < 0 || *entry.Controller > 127 {
+			return t, fmt.Errorf("controller for %s should be from 0 to 127", entry.Address)
+		}
+		t.kind, t.number = midi.CONTROLLER, byte(*entry.Controller)
+	}
+	if entry.Key != nil {
+		nTargets += 1
+		if *entry.Key < 0 || *entry.Key > 127 {
+			return t, fmt.Errorf("key for %s should be from 0 to 127", entry.Address)
+		}
+		t.kind, t.number = midi.NOTE_ON, byte(*entry.Key)
+	}
+	if nTargets != 1 {
+		return t, fmt.Errorf("%s should have exactly one of control, controller, or key", entry.Address)
+	}
+	return t, nil
+}
+
+func defaultEntries() []MappingEntry {
+	var entries []MappingEntry
+	for ii := 0; ii < 8; ii++ {
+		knob := int(midi.LPD8_KNOB1) + ii
+		pad := int(midi.LPD8_PAD1) + ii
+		entries = append(entries,
+			MappingEntry{Address: "/knob/" + strconv.Itoa(ii+1), Controller: &knob},
+			MappingEntry{Address: "/pad/" + strconv.Itoa(ii+1), Key: &pad})
+	}
+	for _, c := range controls.CONTROLS {
+		entries = append(entries, MappingEntry{Address: "/control/" + c.Name, Control: c.Name})
+	}
+	for ii := 0; ii < 128; ii++ {
+		number := ii
+		entries = append(entries,
+			MappingEntry{Address: "/controller/" + strconv.Itoa(ii), Controller: &number},
+			MappingEntry{Address: "/key/" + strconv.Itoa(ii), Key: &number})
+	}
+	return entries
+}
+
+//--------------------------------------------------------------------------------
+// TRANSLATING
+
+// Turn an OSC message into controls.Events.  A message with wildcards in its address can
+// match several mappings.  Messages which match nothing or have no numeric argument
+// produce nothing.
+func (mapping *Mapping) Translate(msg *Message) []controls.Event {
+	var indexes []int
+	if isPattern(msg.Address) {
+		for ii, t := range mapping.targets {
+			if Match(msg.Address, t.address) {
+				indexes = append(indexes, ii)
+			}
+		}
+	} else {
+		indexes = mapping.byAddress[msg.Address]
+	}
+
+	var result []controls.Event
+	for _, ii := range indexes {
+		t := mapping.targets[ii]
+		amount, ok := t.value(msg.Args)
+		if !ok {
+			continue
+		}
+		if t.control != nil {
+			c := t.control
+			result = append(result, controls.Event{Control: c, Value: c.Min + amount*(c.Max-c.Min)})
+			continue
+		}
+		value := byte(math.Floor(amount*127 + 0.5))
+		kind := t.kind
+		if kind == midi.NOTE_ON && value == 0 {
+			kind = midi.NOTE_OFF
+		}
+		result = append(result, controls.Event{Midi: &midi.MidiMessage{Kind: kind, Channel: 0, Key: t.number, Value: value}})
+	}
+	return result
+}
+
+// Scale the first numeric argument to 0-1.  NaN and infinite floats aren't
+// accepted, so the message is ignored.
+func (t *target) value(args []interface{}) (float64, bool) {
+	for _, arg := range args {
+		var x float64
+		isInt := false
+		switch v := arg.(type) {
+		case int32:
+			x, isInt = float64(v), true
+		case int64:
+			x, isInt = float64(v), true
+		case float32:
+			x = float64(v)
+		case float64:
+			x = v
+		case bool:
+			if v {
+				return 1, true
+			}
+			return 0, true
+		default:
+			continue
+		}
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return 0, false
+		}
+		switch {
+		case t.min != nil:
+			x = (x - *t.min) / (*t.max - *t.min)
+		case isInt:
+			x = x / 127
+		}
+		return math.Min(math.Max(x, 0), 1), true
+	}
+	return 0, false
+}
+
+//--------------------------------------------------------------------------------
+// SERVER
+
+// Listen for OSC packets on UDP at addr and translate them with the mapping.
+// Returns a channel of the resulting Events for the main loop to read.
+func Listen(addr string, mapping *Mapping) (chan controls.Event, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen for OSC on %s: %v", addr, err)
+	}
+	fmt.Println("[osc] listening for OSC on", conn.LocalAddr())
+	eventChan := make(chan controls.Event, 500)
+	go oscServerThread(conn, mapping, eventChan)
+	return eventChan, nil
+}
+
+func oscServerThread(conn net.PacketConn, mapping *Mapping, eventChan chan controls.Event) {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			fmt.Println("[osc] stopped listening:", err)
+			return
+		}
+		messages, err := ParsePacket(buf[:n])
+		if err != nil {
+			fmt.Println("[osc] bad packet from", from, ":", err)
+			continue
+		}
+		for _, msg := range messages {
+			for _, ev := range mapping.Translate(msg) {
+				// don't wait for the main loop; if it's this far behind, drop the event
+				select {
+				case eventChan <- ev:
+				default:
+					fmt.Println("[osc] too many messages waiting for the main loop.  dropping", msg.Address, "from", from)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,286 @@
+/*
+Package osc receives Open Sound Control messages over UDP and turns them into
+controls.Events, so TouchOSC, Max patches and the like can set the same controls as the
+knobs and pads on the MIDI controller.
+
+A Mapping says which OSC addresses set which controls (see mapping.go).
+Listen starts the UDP server and returns a channel of Events for the main loop
+to apply along with the real MIDI input.
+
+Messages and bundles are both understood.  Bundle timetags are ignored; everything
+takes effect on the next frame.  Incoming addresses can use OSC's wildcards
+(*, ?, [abc], [!abc], [a-z], {foo,bar}), so "/knob/*" turns every LPD8 knob at once.
+*/
+package osc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// An OSC message.  Args are int32, int64, float32, float64, string, []byte, bool, or nil.
+type Message struct {
+	Address string
+	Args    []interface{}
+}
+
+const BUNDLE_TAG = "#bundle"
+
+//================================================================================
+// DECODING
+
+// Decode a UDP packet, which is either one message or a bundle of messages and other bundles.
+func ParsePacket(data []byte) ([]*Message, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty packet")
+	}
+	if data[0] == '#' {
+		return parseBundle(data)
+	}
+	msg, err := parseMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	return []*Message{msg}, nil
+}
+
+func parseBundle(data []byte) ([]*Message, error) {
+	tag, data, err := readString(data)
+	if err != nil {
+		return nil, err
+	}
+	if tag != BUNDLE_TAG {
+		return nil, fmt.Errorf("expected %s, got %q", BUNDLE_TAG, tag)
+	}
+	if len(data) < 8 {
+		return nil, fmt.Errorf("bundle is missing its timetag")
+	}
+	data = data[8:]
+
+	var messages []*Message
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("bundle element is missing its size")
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size < 0 || size > len(data) {
+			return nil, fmt.Errorf("bundle element size %v is bigger than the packet", size)
+		}
+		elementMessages, err := ParsePacket(data[:size])
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, elementMessages...)
+		data = data[size:]
+	}
+	return messages, nil
+}
+
+func parseMessage(data []byte) (*Message, error) {
+	address, data, err := readString(data)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(address, "/") {
+		return nil, fmt.Errorf("bad address %q", address)
+	}
+	msg := &Message{Address: address}
+
+	// very old senders leave out the type tags
+	if len(data) == 0 {
+		return msg, nil
+	}
+	tags, data, err := readString(data)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(tags, ",") {
+		return nil, fmt.Errorf("bad type tags %q for %s", tags, address)
+	}
+
+	for _, tag := range tags[1:] {
+		var arg interface{}
+		switch tag {
+		case 'i':
+			if len(data) < 4 {
+				return nil, fmt.Errorf("missing int32 argument for %s", address)
+			}
+			arg = int32(binary.BigEndian.Uint32(data))
+			data = data[4:]
+		case 'f':
+			if len(data) < 4 {
+				return nil, fmt.Errorf("missing float32 argument for %s", address)
+			}
+			arg = math.Float32frombits(binary.BigEndian.Uint32(data))
+			data = data[4:]
+		case 'h':
+			if len(data) < 8 {
+				return nil, fmt.Errorf("missing int64 argument for %s", address)
+			}
+			arg = int64(binary.BigEndian.Uint64(data))
+			data = data[8:]
+		case 'd':
+			if len(data) < 8 {
+				return nil, fmt.Errorf("missing float64 argument for %s", address)
+			}
+			arg = math.Float64frombits(binary.BigEndian.Uint64(data))
+			data = data[8:]
+		case 's', 'S':
+			arg, data, err = readString(data)
+			if err != nil {
+				return nil, err
+			}
+		case 'b':
+			if len(data) < 4 {
+				return nil, fmt.Errorf("missing blob argument for %s", address)
+			}
+			size := int(binary.BigEndian.Uint32(data))
+			data = data[4:]
+			if size < 0 || size > len(data) {
+				return nil, fmt.Errorf("blob argument for %s is bigger than the packet", address)
+			}
+			arg = data[:size]
+			next := pad4(size)
+			if next > len(data) {
+				next = len(data)
+			}
+			data = data[next:]
+		case 'T', 'I':
+			arg = true
+		case 'F':
+			arg = false
+		case 'N':
+			arg = nil
+		default:
+			return nil, fmt.Errorf("unsupported type tag %q for %s", tag, address)
+		}
+		msg.Args = append(msg.Args, arg)
+	}
+	return msg, nil
+}
+
+// Read a null-terminated string padded to a multiple of 4 bytes.  Return it and the rest of data.
+func readString(data []byte) (string, []byte, error) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return "", nil, fmt.Errorf("unterminated string")
+	}
+	next := pad4(end + 1)
+	if next > len(data) {
+		next = len(data)
+	}
+	return string(data[:end]), data[next:], nil
+}
+
+// Round n up to a multiple of 4.
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+//================================================================================
+// ADDRESS PATTERNS
+
+// Does the OSC address pattern match the address?
+func Match(pattern, address string) bool {
+	patternParts := strings.Split(pattern, "/")
+	addressParts := strings.Split(address, "/")
+	if len(patternParts) != len(addressParts) {
+		return false
+	}
+	for ii, part := range patternParts {
+		if !matchPart(part, addressParts[ii]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Does the pattern contain any wildcards?
+func isPattern(address string) bool {
+	return strings.ContainsAny(address, "*?[]{}")
+}
+
+// Match one part of an address (between the slashes).
+// Remembers which positions in p and s it has tried already, so patterns with lots of
+// '*'s take time proportional to len(p)*len(s) instead of exponential time.
+func matchPart(p, s string) bool {
+	// "**" matches the same things as "*"
+	for strings.Contains(p, "**") {
+		p = strings.Replace(p, "**", "*", -1)
+	}
+	m := &partMatcher{p: p, s: s, memo: make(map[int]bool)}
+	return m.match(0, 0)
+}
+
+type partMatcher struct {
+	p, s string
+	memo map[int]bool // by pi*(len(s)+1) + si
+}
+
+// Does p[pi:] match s[si:]?
+func (m *partMatcher) match(pi, si int) bool {
+	key := pi*(len(m.s)+1) + si
+	if result, ok := m.memo[key]; ok {
+		return result
+	}
+	result := m.matchUncached(pi, si)
+	m.memo[key] = result
+	return result
+}
+
+func (m *partMatcher) matchUncached(pi, si int) bool {
+	p, s := m.p[pi:], m.s[si:]
+	if p == "" {
+		return s == ""
+	}
+	switch p[0] {
+	case '*':
+		// match nothing, or one more character
+		return m.match(pi+1, si) || (s != "" && m.match(pi, si+1))
+	case '?':
+		return s != "" && m.match(pi+1, si+1)
+	case '[':
+		end := strings.IndexByte(p, ']')
+		if end < 0 || s == "" {
+			return false
+		}
+		return matchSet(p[1:end], s[0]) && m.match(pi+end+1, si+1)
+	case '{':
+		end := strings.IndexByte(p, '}')
+		if end < 0 {
+			return false
+		}
+		for _, alt := range strings.Split(p[1:end], ",") {
+			if strings.HasPrefix(s, alt) && m.match(pi+end+1, si+len(alt)) {
+				return true
+			}
+		}
+		return false
+	default:
+		return s != "" && s[0] == p[0] && m.match(pi+1, si+1)
+	}
+}
+
+// Is c in a set like "abc", "a-z", or "!abc" (meaning not a, b or c)?
+func matchSet(set string, c byte) bool {
+	negate := strings.HasPrefix(set, "!")
+	if negate {
+		set = set[1:]
+	}
+	found := false
+	for ii := 0; ii < len(set); ii++ {
+		if ii+2 < len(set) && set[ii+1] == '-' {
+			if set[ii] <= c && c <= set[ii+2] {
+				found = true
+			}
+			ii += 2
+		} else if set[ii] == c {
+			found = true
+		}
+	}
+	return found != negate
+}
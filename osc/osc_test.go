@@ -0,0 +1,301 @@
+package osc
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+)
+
+// Build an OSC message the way a sender would.
+func encodeMessage(address string, args ...interface{}) []byte {
+	data := encodeString(address)
+	tags := ","
+	var argData []byte
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case int32:
+			tags += "i"
+			argData = appendUint32(argData, uint32(v))
+		case float32:
+			tags += "f"
+			argData = appendUint32(argData, math.Float32bits(v))
+		case float64:
+			tags += "d"
+			argData = appendUint64(argData, math.Float64bits(v))
+		case string:
+			tags += "s"
+			argData = append(argData, encodeString(v)...)
+		case bool:
+			if v {
+				tags += "T"
+			} else {
+				tags += "F"
+			}
+		}
+	}
+	return append(append(data, encodeString(tags)...), argData...)
+}
+
+func encodeString(s string) []byte {
+	data := append([]byte(s), 0)
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	return data
+}
+
+func encodeBundle(elements ...[]byte) []byte {
+	data := append(encodeString(BUNDLE_TAG), 0, 0, 0, 0, 0, 0, 0, 1)
+	for _, element := range elements {
+		data = appendUint32(data, uint32(len(element)))
+		data = append(data, element...)
+	}
+	return data
+}
+
+func appendUint32(data []byte, x uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, x)
+	return append(data, buf...)
+}
+
+func appendUint64(data []byte, x uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, x)
+	return append(data, buf...)
+}
+
+func controller(key, value byte) controls.Event {
+	return controls.Event{Midi: &midi.MidiMessage{Kind: midi.CONTROLLER, Key: key, Value: value}}
+}
+
+func key(kind, key, value byte) controls.Event {
+	return controls.Event{Midi: &midi.MidiMessage{Kind: kind, Key: key, Value: value}}
+}
+
+//================================================================================
+func TestParsePacket(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected []*Message
+	}{
+		{"float", encodeMessage("/knob/1", float32(0.5)), []*Message{{"/knob/1", []interface{}{float32(0.5)}}}},
+		{"int and string", encodeMessage("/a", int32(-3), "hi"), []*Message{{"/a", []interface{}{int32(-3), "hi"}}}},
+		{"double and bools", encodeMessage("/abcd", 1.5, true, false), []*Message{{"/abcd", []interface{}{1.5, true, false}}}},
+		{"no tags", encodeString("/old"), []*Message{{"/old", nil}}},
+		{"bundle", encodeBundle(encodeMessage("/a", int32(1)), encodeBundle(encodeMessage("/b", int32(2)))),
+			[]*Message{{"/a", []interface{}{int32(1)}}, {"/b", []interface{}{int32(2)}}}},
+	}
+	for _, test := range tests {
+		messages, err := ParsePacket(test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(messages, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, messages)
+		}
+	}
+
+	bad := map[string][]byte{
+		"empty":            {},
+		"no address":       encodeString("knob"),
+		"unterminated":     []byte("/knob"),
+		"missing int":      append(encodeString("/a"), encodeString(",i")...),
+		"unknown tag":      append(encodeString("/a"), encodeString(",x")...),
+		"oversized bundle": append(encodeBundle(), 0, 0, 1, 0),
+	}
+	for name, data := range bad {
+		if _, err := ParsePacket(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, address string
+		expected         bool
+	}{
+		{"/knob/1", "/knob/1", true},
+		{"/knob/1", "/knob/2", false},
+		{"/knob/*", "/knob/12", true},
+		{"/knob/*", "/knob/1/x", false},
+		{"/*/1", "/pad/1", true},
+		{"/knob/?", "/knob/3", true},
+		{"/knob/?", "/knob/10", false},
+		{"/knob/[1-3]", "/knob/2", true},
+		{"/knob/[1-3]", "/knob/4", false},
+		{"/knob/[!1-3]", "/knob/4", true},
+		{"/knob/[!1-3]", "/knob/1", false},
+		{"/pad/{flash,twinkle}", "/pad/twinkle", true},
+		{"/pad/{flash,twinkle}", "/pad/slowmo", false},
+		{"/pad/blink-*", "/pad/blink-arch", true},
+		{"/pad/**-arch", "/pad/blink-arch", true},
+		{"/pad/*-*-*", "/pad/blink-arch", false},
+		{"/pad/{blink,fade}*h", "/pad/blink-arch", true},
+		{"/pad/*", "/pad/", true},
+	}
+	for _, test := range tests {
+		if Match(test.pattern, test.address) != test.expected {
+			t.Errorf("Match(%q, %q) should be %v", test.pattern, test.address, test.expected)
+		}
+	}
+}
+
+func TestMatchIsFast(t *testing.T) {
+	// lots of stars which almost match used to take exponential time
+	pattern := "/" + strings.Repeat("a*", 40) + "b"
+	address := "/" + strings.Repeat("a", 200)
+	done := make(chan bool)
+	go func() {
+		done <- Match(pattern, address)
+	}()
+	select {
+	case matched := <-done:
+		if matched {
+			t.Errorf("%q shouldn't match %q", pattern, address)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Match took more than a second")
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	twenty := 20
+	low, high := -70.0, 6.0
+	mapping, err := NewMapping(&MappingConfig{
+		IncludeDefaults: true,
+		Mappings: []MappingEntry{
+			{Address: "/1/fader1", Control: "hue"},
+			{Address: "/1/fader2", Controller: &twenty},
+			{Address: "/live/volume", Control: "gain", Min: &low, Max: &high},
+			{Address: "/1/push1", Control: "flush"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		msg      *Message
+		expected []controls.Event
+	}{
+		{&Message{"/knob/1", []interface{}{float32(1)}}, []controls.Event{controller(midi.LPD8_KNOB1, 127)}},
+		{&Message{"/knob/1", []interface{}{int32(64)}}, []controls.Event{controller(midi.LPD8_KNOB1, 64)}},
+		{&Message{"/knob/1", []interface{}{int32(500)}}, []controls.Event{controller(midi.LPD8_KNOB1, 127)}},
+		{&Message{"/control/hue", []interface{}{0.5}}, []controls.Event{{Control: controls.HUE, Value: 0.5}}},
+		{&Message{"/control/hue", []interface{}{"label", float32(0)}}, []controls.Event{{Control: controls.HUE, Value: 0}}},
+		{&Message{"/1/fader1", []interface{}{float32(0.5)}}, []controls.Event{{Control: controls.HUE, Value: 0.5}}},
+		{&Message{"/1/fader2", []interface{}{float32(0.5)}}, []controls.Event{controller(20, 64)}},
+		{&Message{"/controller/99", []interface{}{int32(7)}}, []controls.Event{controller(99, 7)}},
+		{&Message{"/live/volume", []interface{}{float32(-32)}}, []controls.Event{{Control: controls.GAIN, Value: 0.5}}},
+		{&Message{"/1/push1", []interface{}{float32(1)}}, []controls.Event{{Control: controls.FLUSH, Value: 1}}},
+		{&Message{"/control/slowmo", []interface{}{false}}, []controls.Event{{Control: controls.SLOWMO, Value: 0}}},
+		{&Message{"/key/60", []interface{}{float32(1)}}, []controls.Event{key(midi.NOTE_ON, 60, 127)}},
+		{&Message{"/key/60", []interface{}{float32(0)}}, []controls.Event{key(midi.NOTE_OFF, 60, 0)}},
+		{&Message{"/pad/2", []interface{}{true}}, []controls.Event{key(midi.NOTE_ON, midi.LPD8_PAD2, 127)}},
+		{&Message{"/knob/[1-2]", []interface{}{float32(0)}}, []controls.Event{controller(midi.LPD8_KNOB1, 0), controller(midi.LPD8_KNOB2, 0)}},
+		{&Message{"/knob/1", nil}, nil},
+		{&Message{"/control/hue", []interface{}{float32(math.NaN())}}, nil},
+		{&Message{"/control/hue", []interface{}{math.Inf(1)}}, nil},
+		{&Message{"/live/volume", []interface{}{float32(math.Inf(-1))}}, nil},
+		{&Message{"/nothing", []interface{}{float32(1)}}, nil},
+	}
+	for _, test := range tests {
+		result := mapping.Translate(test.msg)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.msg, test.expected, result)
+		}
+	}
+}
+
+func TestBadMappings(t *testing.T) {
+	one := 1
+	big := 200
+	bad := []MappingEntry{
+		{Address: "knob", Control: "hue"},
+		{Address: "/knob/*", Control: "hue"},
+		{Address: "/a", Control: "nope"},
+		{Address: "/a", Controller: &big},
+		{Address: "/a"},
+		{Address: "/a", Control: "hue", Key: &one},
+		{Address: "/a", Control: "hue", Min: new(float64)},
+	}
+	for _, entry := range bad {
+		if _, err := NewMapping(&MappingConfig{Mappings: []MappingEntry{entry}}); err == nil {
+			t.Errorf("expected an error for %+v", entry)
+		}
+	}
+	if _, err := ReadMapping("../oscmaps/touchosc-simple.json"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServer(t *testing.T) {
+	mapping, _ := NewMapping(nil)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan controls.Event, 10)
+	go oscServerThread(conn, mapping, ch)
+	defer conn.Close()
+
+	sender, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.Write([]byte("garbage"))
+	sender.Write(encodeMessage("/control/hue", float32(1)))
+	select {
+	case ev := <-ch:
+		if ev.Control != controls.HUE || ev.Value != 1 {
+			t.Errorf("expected hue at 1, got %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestServerDropsWhenFull(t *testing.T) {
+	mapping, _ := NewMapping(nil)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan controls.Event, 1)
+	go oscServerThread(conn, mapping, ch)
+	defer conn.Close()
+
+	sender, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	// nobody reads the first few, so all but one get dropped instead of blocking the server
+	for ii := 0; ii < 5; ii++ {
+		sender.Write(encodeMessage("/control/hue", float32(0)))
+	}
+	time.Sleep(100 * time.Millisecond)
+	<-ch
+	sender.Write(encodeMessage("/control/hue", float32(1)))
+	select {
+	case ev := <-ch:
+		if ev.Value != 1 {
+			t.Errorf("expected the server to keep going after dropping events, got %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out; the server is stuck")
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Package persist saves the controls and the active source to a state file every few
+seconds, so after a power blip the lights come back the way the operator left them
+instead of at the controls' defaults.  (The MIDI controller only sends a knob's value
+when it moves, so there's no way to ask it where the knobs are.)
+
+The file is JSON:
+
+	{
+	    "source": "fire",
+	    "configured_source": "midi-switcher",
+	    "controls": {"gain": 0.8, "hue": 0.25, "slowmo": 0, ...}
+	}
+
+Triggers aren't saved, since a press shouldn't happen again on restart.  "source" is
+only restored if the command line (or pipeline file) still asks for the same
+"configured_source", so starting with a different --source isn't overridden by an
+old state file.
+
+Writes are atomic: the state goes to a temporary file in the same directory, which
+is then renamed over the old one, so a crash in the middle of a write leaves the
+previous state behind instead of a half-written file.
+
+Example
+
+	saved, err := persist.Load("state.json")  // nil if there's no file yet
+	saver := persist.NewSaver("state.json", configuredSource)
+	controls.Reset(&midiState)
+	saved.Restore(&midiState)
+	for {
+	    // ... update the controls and render a frame ...
+	    saver.Update(&midiState, switcher.Current())
+	}
+	saver.Close(&midiState, switcher.Current())
+*/
+package persist
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+)
+
+// How often Saver.Update writes the state, if it has changed
+const SAVE_INTERVAL = 5 * time.Second
+
+//================================================================================
+// STATE
+
+// The contents of a state file.
+type State struct {
+	Source           string             `json:"source,omitempty"`            // the source that was playing
+	ConfiguredSource string             `json:"configured_source,omitempty"` // the source the command line asked for
+	Controls         map[string]float64 `json:"controls"`                    // by name, without the triggers
+}
+
+// Take a snapshot of the controls and the source.
+func Capture(midiState *midi.MidiState, source, configuredSource string) *State {
+	st := &State{
+		Source:           source,
+		ConfiguredSource: configuredSource,
+		Controls:         make(map[string]float64),
+	}
+	for _, c := range controls.CONTROLS {
+		if c.Kind != controls.TRIGGER {
+			st.Controls[c.Name] = c.Get(midiState)
+		}
+	}
+	return st
+}
+
+// Set the controls in midiState to the saved values.  Controls which weren't saved
+// keep their values, and saved names which aren't controls any more are skipped.
+// Does nothing if st is nil.
+func (st *State) Restore(midiState *midi.MidiState) {
+	if st == nil {
+		return
+	}
+	for name, value := range st.Controls {
+		c := controls.Lookup(name)
+		if c == nil || c.Kind == controls.TRIGGER {
+			fmt.Printf("[persist.Restore] skipping unknown control \"%s\"\n", name)
+			continue
+		}
+		c.Set(midiState, value)
+	}
+}
+
+// The source to switch to at startup, or "" to keep configuredSource.
+// Does nothing if st is nil.
+func (st *State) SourceFor(configuredSource string) string {
+	if st == nil || st.ConfiguredSource != configuredSource || st.Source == configuredSource {
+		return ""
+	}
+	return st.Source
+}
+
+//================================================================================
+// FILES
+
+// Read a state file.  Returns nil and no error if the file doesn't exist yet.
+func Load(fn string) (*State, error) {
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read state file %s: %v", fn, err)
+	}
+	st := &State{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("could not parse state file %s: %v", fn, err)
+	}
+	return st, nil
+}
+
+// Write a state file atomically.
+func Save(fn string, st *State) error {
+	data, err := json.MarshalIndent(st, "", "    ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(fn, append(data, '\n'))
+}
+
+// Write data to a temporary file next to fn, flush it to disk, and rename it to fn.
+// Readers see either the old file or the new one, never part of one.
+func WriteFileAtomic(fn string, data []byte) error {
+	dir := filepath.Dir(fn)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(fn)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not write %s: %v", fn, err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not write %s: %v", fn, err)
+	}
+	// make the rename itself survive a power cut.  not every OS can sync a directory.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+//================================================================================
+// SAVER
+
+// Writes the state in the background now and then.  Make one with NewSaver.
+// Update and Close should only be called from the main loop.
+type Saver struct {
+	Fn               string
+	ConfiguredSource string
+	Interval         time.Duration
+
+	lastSaveTime time.Time
+	lastData     []byte
+	pending      chan []byte // holds at most one state which hasn't been written yet
+	done         chan bool
+}
+
+// Make a Saver which writes to fn and start its writer goroutine.
+func NewSaver(fn, configuredSource string) *Saver {
+	s := &Saver{
+		Fn:               fn,
+		ConfiguredSource: configuredSource,
+		Interval:         SAVE_INTERVAL,
+		lastSaveTime:     time.Now(),
+		pending:          make(chan []byte, 1),
+		done:             make(chan bool),
+	}
+	go s.writerThread()
+	return s
+}
+
+// Call this once per frame.  Every Interval, if the state has changed since it was
+// last written, hand it to the writer goroutine.
+func (s *Saver) Update(midiState *midi.MidiState, source string) {
+	if time.Since(s.lastSaveTime) < s.Interval {
+		return
+	}
+	s.lastSaveTime = time.Now()
+	s.queue(midiState, source)
+}
+
+// Write the final state and wait for the writer goroutine to finish.
+func (s *Saver) Close(midiState *midi.MidiState, source string) {
+	s.queue(midiState, source)
+	close(s.pending)
+	<-s.done
+}
+
+func (s *Saver) queue(midiState *midi.MidiState, source string) {
+	data, err := json.MarshalIndent(Capture(midiState, source, s.ConfiguredSource), "", "    ")
+	if err != nil || bytes.Equal(data, s.lastData) {
+		return
+	}
+	s.lastData = data
+	// only the newest state matters, so replace one that hasn't been written yet
+	select {
+	case <-s.pending:
+	default:
+	}
+	s.pending <- append(data, '\n')
+}
+
+func (s *Saver) writerThread() {
+	for data := range s.pending {
+		if err := WriteFileAtomic(s.Fn, data); err != nil {
+			fmt.Println("[persist.Saver]", err)
+		}
+	}
+	close(s.done)
+}
@@ -0,0 +1,115 @@
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+//================================================================================
+func TestSaveAndLoad(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state.json")
+
+	if st, err := Load(fn); st != nil || err != nil {
+		t.Fatalf("a missing file should load as nil with no error, got %v %v", st, err)
+	}
+
+	midiState := &midi.MidiState{}
+	controls.Reset(midiState)
+	controls.GAIN.Set(midiState, 0.25)
+	controls.SLOWMO.Set(midiState, 1)
+	controls.BLINK_CIRCLE.Set(midiState, 1)
+	if err := Save(fn, Capture(midiState, "fire", "midi-switcher")); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected only the state file, found %v files", len(files))
+	}
+
+	st, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := st.Controls["blink-circle"]; ok {
+		t.Errorf("triggers shouldn't be saved")
+	}
+	st.Controls["nope"] = 1
+
+	restored := &midi.MidiState{}
+	controls.Reset(restored)
+	st.Restore(restored)
+	if controls.GAIN.Get(restored) != 0.25 || !controls.SLOWMO.On(restored) || controls.SPEED.Get(restored) != controls.SPEED.Default {
+		t.Errorf("controls weren't restored: %v", restored.Controls)
+	}
+	if controls.BLINK_CIRCLE.Get(restored) != 0 {
+		t.Errorf("a trigger was restored")
+	}
+
+	if st.SourceFor("midi-switcher") != "fire" {
+		t.Errorf("expected to restore fire")
+	}
+	if st.SourceFor("aqua") != "" {
+		t.Errorf("the source shouldn't be restored when --source has changed")
+	}
+	var none *State
+	none.Restore(restored)
+	if none.SourceFor("aqua") != "" {
+		t.Errorf("a nil state shouldn't restore a source")
+	}
+
+	ioutil.WriteFile(fn, []byte("{not json"), 0644)
+	if _, err := Load(fn); err == nil {
+		t.Errorf("expected an error for a broken file")
+	}
+}
+
+func TestSaver(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state.json")
+
+	midiState := &midi.MidiState{}
+	controls.Reset(midiState)
+	s := NewSaver(fn, "fire")
+	s.Interval = 0
+	controls.HUE.Set(midiState, 0.5)
+	s.Update(midiState, "fire")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if st, _ := Load(fn); st != nil && st.Controls["hue"] == 0.5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the state file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.Interval = time.Hour
+	controls.HUE.Set(midiState, 0.75)
+	s.Update(midiState, "aqua")
+	s.Close(midiState, "aqua")
+	st, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Controls["hue"] != 0.75 || st.Source != "aqua" || st.ConfiguredSource != "fire" {
+		t.Errorf("Close didn't save the final state: %+v", st)
+	}
+}
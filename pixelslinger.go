@@ -1,51 +1,78 @@
 package main
 
-// TODO: figure out how to handle varying numbers of pixels
-// when we're getting pixels via our OPC server source
-
 import (
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
 	"sort"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/droundy/goopt"
+	"github.com/longears/pixelslinger/attract"
 	"github.com/longears/pixelslinger/beaglebone"
-	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/clock"
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/learn"
+	"github.com/longears/pixelslinger/metrics"
 	"github.com/longears/pixelslinger/midi"
 	"github.com/longears/pixelslinger/opc"
-	"github.com/longears/pixelslinger/potty"
-	"github.com/pkg/profile"
+	"github.com/longears/pixelslinger/osc"
+	"github.com/longears/pixelslinger/persist"
+	"github.com/longears/pixelslinger/profiling"
+	"github.com/longears/pixelslinger/remote"
+	"github.com/longears/pixelslinger/scenes"
 )
 
 const ONBOARD_LED_HEARTBEAT = 0
 const ONBOARD_LED_MIDI = 1
 
-const SPI_MAGIC_WORD = "spi"
-const PRINT_MAGIC_WORD = "print"
-const DEVNULL_MAGIC_WORD = "/dev/null"
-const LOCALHOST = "localhost"
-const SPI_FN = "/dev/spidev1.0"
+// how long to wait for the pipeline threads to exit when shutting down
+const SHUTDOWN_TIMEOUT = 2 * time.Second
 
-func init() {
-	runtime.GOMAXPROCS(2)
-}
+// how long to record a CPU profile for after getting SIGUSR1
+const PROFILE_SIGNAL_SECONDS = 10
 
 // these are pointers to the actual values from the command line parser
 var LAYOUT_FN = goopt.String([]string{"-l", "--layout"}, "...", "layout file (required)")
-var SOURCE = goopt.String([]string{"-s", "--source"}, "spatial-stripes", "pixel source (either a pattern name or "+LOCALHOST+"[:port])")
-var DEST = goopt.String([]string{"-d", "--dest"}, "localhost", "destination (one of "+PRINT_MAGIC_WORD+", "+SPI_MAGIC_WORD+", "+DEVNULL_MAGIC_WORD+", or hostname[:port])")
+var SOURCE = goopt.String([]string{"-s", "--source"}, "spatial-stripes", "pixel source (a pattern name, "+opc.PLAYLIST_PREFIX+"file.json, "+opc.LAYERS_PREFIX+"file.json, "+opc.ZONES_PREFIX+"file.json, or "+opc.LOCALHOST+"[:port])")
+var DEST = goopt.String([]string{"-d", "--dest"}, "localhost", "destination (one of "+opc.PRINT_MAGIC_WORD+", "+opc.SPI_MAGIC_WORD+", "+opc.DEVNULL_MAGIC_WORD+", or hostname[:port])")
+var PIPELINE_FN = goopt.String([]string{"-p", "--pipeline"}, "", "pipeline file (overrides --source, --dest, --dither, --resize and --interpolate)")
+var RESIZE = goopt.Alternatives([]string{"--resize"}, opc.RESIZE_POLICIES, "what to do when the source sends the wrong number of pixels: "+opc.RESIZE_FIT+" (truncate or pad with black), "+opc.RESIZE_SCALE+", or "+opc.RESIZE_REJECT)
+var INTERPOLATE = goopt.Alternatives([]string{"--interpolate"}, opc.INTERPOLATE_MODES, "blend between the source's frames when it's slower than --fps: "+opc.INTERPOLATE_LINEAR+" or "+opc.INTERPOLATE_EASED)
+var MAX_LATENCY = goopt.Int([]string{"--max-latency"}, 100, "when interpolating, never delay frames by more than this many milliseconds")
+var TRANSITION = goopt.Alternatives([]string{"--transition"}, opc.TRANSITION_KINDS, "how midi-switcher blends from one pattern to the next")
+var TRANSITION_TIME = goopt.Int([]string{"--transition-time"}, 1000, "how long pattern transitions last, in milliseconds")
+var CORES = goopt.Int([]string{"--cores"}, 0, "how many cores to run and render patterns on (0 for all of them)")
 var FPS = goopt.Int([]string{"-f", "--fps"}, 40, "max frames per second")
-var SECONDS = goopt.Int([]string{"-n", "--seconds"}, 0, "quit after this many seconds")
+var SECONDS = goopt.Int([]string{"-n", "--seconds"}, 0, "quit after this many seconds (of clock time)")
+var CLOCK = goopt.Alternatives([]string{"--clock"}, []string{clock.REALTIME, clock.FIXED, clock.OFFLINE}, "frame clock: "+clock.REALTIME+" follows the wall clock, "+clock.FIXED+" advances 1/fps per frame, "+clock.OFFLINE+" is "+clock.FIXED+" without sleeping between frames")
 var ONCE = goopt.Flag([]string{"-o", "--once"}, []string{}, "quit after one frame", "")
+var METRICS_ADDR = goopt.String([]string{"--metrics"}, "", "serve Prometheus /metrics and expvar /debug/vars at this [host]:port")
+var PROFILE = goopt.Alternatives([]string{"--profile"}, profiling.KINDS, "profile the whole run and write the profile to --profile-dir when quitting")
+var PROFILE_DIR = goopt.String([]string{"--profile-dir"}, ".", "where to write profiles")
+var PPROF_ADDR = goopt.String([]string{"--pprof"}, "", "serve net/http/pprof at this [host]:port")
+var REMOTE_ADDR = goopt.String([]string{"--remote"}, "", "serve the remote control API under /api/ at this [host]:port")
+var REMOTE_TOKEN = goopt.String([]string{"--remote-token"}, "", "require this token for the remote control API")
+var MIDI_MAP_FN = goopt.String([]string{"--midi-map"}, "", "MIDI controller mapping file, like midimaps/nanokontrol.json, which learn mode saves to (default: the AKAI LPD8)")
+var KNOB_SMOOTHING = goopt.Int([]string{"--knob-smoothing"}, 0, "smooth out the steps when a knob turns, with this time constant in milliseconds (0 to follow the knob exactly)")
+var TAKEOVER = goopt.Alternatives([]string{"--takeover"}, controls.TAKEOVER_MODES, "when something else has changed a knob's control: "+controls.JUMP+" to the knob as soon as it moves, or "+controls.PICKUP+" once it reaches the control's value")
+var OSC_ADDR = goopt.String([]string{"--osc"}, "", "listen for OSC messages over UDP at this [host]:port")
+var OSC_MAP_FN = goopt.String([]string{"--osc-map"}, "", "OSC mapping file (default: /knob/N, /pad/N, /control/NAME, /controller/N, /key/N)")
+var FADE_OUT = goopt.Int([]string{"--fade-out"}, 1000, "on ctrl-C or kill, fade to black over this many milliseconds before quitting")
+var ATTRACT_AFTER = goopt.Int([]string{"--attract-after"}, 0, "when the midi controller has been idle for this many seconds, switch patterns and turn knobs automatically (0 to disable)")
+var SCENES_FN = goopt.String([]string{"--scenes"}, "", "scenes file, for recalling scenes with MIDI program changes and saving them with the remote control API")
+var STATE_FN = goopt.String([]string{"--state-file"}, "", "save the controls and source to this file every few seconds and restore them at startup")
+var DITHER = goopt.Flag([]string{"--dither"}, []string{"--no-dither"}, "use temporal dithering for "+opc.SPI_MAGIC_WORD+" output", "don't dither "+opc.SPI_MAGIC_WORD+" output (default)")
 
 // Parse the command line flags.  If invalid, show help and quit.
-// Add default ports if needed.
 // Read the layout file.
-// Return the number of pixels in the layout, the source and dest thread methods.
-func parseFlags() (nPixels int, sourceThread, effectThread, pottyEffectThread, destThread opc.ByteThread) {
+// Read the pipeline file, or if there isn't one, make a simple pipeline from the
+// --source and --dest flags with the usual effects in between.
+// Return the number of pixels in the layout and the pipeline.
+func parseFlags() (nPixels int, pipeline *opc.Pipeline) {
 
 	// get sorted pattern names
 	patternNames := make([]string, len(opc.PATTERN_REGISTRY))
@@ -69,93 +96,150 @@ func parseFlags() (nPixels int, sourceThread, effectThread, pottyEffectThread, d
 		os.Exit(1)
 	}
 
+	// each HTTP server only serves its own handlers, so they can't share an address
+	if (*PPROF_ADDR != "" && *PPROF_ADDR == *METRICS_ADDR) || (*REMOTE_ADDR != "" && (*REMOTE_ADDR == *METRICS_ADDR || *REMOTE_ADDR == *PPROF_ADDR)) {
+		fmt.Println("Error: --remote, --metrics and --pprof need different addresses")
+		fmt.Println("--------------------------------------------------------------------------------/")
+		os.Exit(1)
+	}
+
+	// settings for knobs which the --midi-map file doesn't override
+	controls.DEFAULT_KNOB_SETTINGS.Smoothing = float64(*KNOB_SMOOTHING) / 1000
+	controls.DEFAULT_KNOB_SETTINGS.Takeover = *TAKEOVER
+
+	// --cores decides how many cores Go uses and how many the patterns render on.
+	// without it, both are all of them.
+	if *CORES > 0 {
+		opc.RENDER_CORES = *CORES
+		runtime.GOMAXPROCS(*CORES)
+	}
+
 	// read locations
 	locations := opc.ReadLocations(*LAYOUT_FN)
 	nPixels = len(locations) / 3
 
-	// choose source thread method
-	if strings.Contains(*SOURCE, LOCALHOST) {
-		// source is localhost, so we will start an OPC server.
-		// add default port if needed
-		if !strings.Contains(*SOURCE, ":") {
-			*SOURCE += ":7890"
-		}
-		sourceThread = opc.MakeOpcServerThread(*SOURCE)
-	} else if (*SOURCE)[0] == ':' {
-		// source is ":4908"
-		*SOURCE = "localhost" + *SOURCE
-		sourceThread = opc.MakeOpcServerThread(*SOURCE)
+	// read or assemble the pipeline config
+	var pipelineConfig *opc.PipelineConfig
+	var err error
+	if *PIPELINE_FN != "" {
+		pipelineConfig, err = opc.ReadPipelineConfig(*PIPELINE_FN)
 	} else {
-		// source is a pattern name
-		sourceThreadMaker, ok := opc.PATTERN_REGISTRY[*SOURCE]
-		if !ok {
-			fmt.Printf("Error: unknown source or pattern \"%s\"\n", *SOURCE)
-			fmt.Println("--------------------------------------------------------------------------------/")
-			os.Exit(1)
+		maxLatency := float64(*MAX_LATENCY) / 1000
+		dither := 0.0
+		if *DITHER {
+			dither = 1
+		}
+		pipelineConfig = &opc.PipelineConfig{
+			Source: opc.StageConfig{Name: *SOURCE},
+			Effects: []opc.StageConfig{
+				{Name: "fader"},
+				{Name: "potty-fader"},
+			},
+			Dests: []opc.StageConfig{
+				{Name: *DEST, Params: map[string]float64{"dither": dither}},
+			},
+			Resize:      *RESIZE,
+			Interpolate: *INTERPOLATE,
+			MaxLatency:  &maxLatency,
 		}
-		sourceThread = sourceThreadMaker(locations)
 	}
 
-	// choose effect thread method
-	effectThread = opc.MakeEffectFader(locations)
-	pottyEffectThread = potty.MakeEffectFaderPattern(locations)
-
-	// choose dest thread method
-	switch *DEST {
-	case DEVNULL_MAGIC_WORD:
-		destThread = opc.MakeSendToDevNullThread()
-	case PRINT_MAGIC_WORD:
-		destThread = opc.MakeSendToScreenThread()
-	case SPI_MAGIC_WORD:
-		destThread = opc.MakeSendToLPD8806Thread(SPI_FN)
-	default:
-		// add default port if needed
-		if !strings.Contains(*DEST, ":") {
-			*DEST += ":7890"
+	// build the threads
+	if err == nil {
+		// the transition flags fill in whatever the pipeline file leaves out
+		if pipelineConfig.Transition == "" {
+			pipelineConfig.Transition = *TRANSITION
 		}
-		destThread = opc.MakeSendToOpcThread(*DEST)
+		if pipelineConfig.TransitionTime == nil {
+			transitionTime := float64(*TRANSITION_TIME) / 1000
+			pipelineConfig.TransitionTime = &transitionTime
+		}
+		pipelineConfig.Timed = *METRICS_ADDR != ""
+		pipeline, err = pipelineConfig.Build(locations)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		fmt.Println("--------------------------------------------------------------------------------/")
+		os.Exit(1)
 	}
 
-	return // returns nPixels, sourceThread, destThread
+	return // returns nPixels, pipeline
 }
 
-// Launch the sourceThread and destThread methods and coordinate the transfer of bytes from one to the other.
-// Run until timeToRun seconds have passed and return.  If timeToRun is 0, run forever.
-// Turn on the CPU profiler if timeToRun seconds > 0.
+// Launch the pipeline's threads and coordinate the transfer of frames from the source to the dest.
+// Tick the frame clock once per frame before the source starts filling.
+// Run until timeToRun seconds of clock time have passed and return.  If timeToRun is 0, run forever.
 // Limit the framerate to a max of fps unless fps is 0.
-func mainLoop(nPixels int, sourceThread, effectThread, pottyEffectThread, destThread opc.ByteThread, fps float64, timeToRun float64) {
+// On SIGINT or SIGTERM, fade to black over fadeOutTime seconds, send a black frame, and return.
+// After attractAfter seconds without midi input, let attract mode turn the knobs.  If attractAfter is 0, never.
+// If remoteServer isn't nil, apply its control changes, tell it the state every frame, and obey its blackout button.
+// If oscEventChan isn't nil, apply the control changes from it too.
+// If sceneBank isn't nil, recall its scenes on program changes.
+// Let learner rebind the MIDI controller's knobs and pads.
+// Restore the controls from savedState (which may be nil) before the first frame, and if saver
+// isn't nil, let it save them every few seconds and once more before returning.
+// Before returning, close the pipeline's channels so its threads exit and turn off the onboard LEDs.
+func mainLoop(nPixels int, pipeline *opc.Pipeline, fps float64, timeToRun float64, fadeOutTime float64, attractAfter float64, remoteServer *remote.Server, oscEventChan chan controls.Event, sceneBank *scenes.Bank, learner *learn.Learner, savedState *persist.State, saver *persist.Saver) {
 	if timeToRun > 0 {
-		fmt.Printf("[mainLoop] Running for %f seconds with profiling turned on, pixels and network\n", timeToRun)
-		defer profile.Start(profile.CPUProfile).Stop()
+		fmt.Printf("[mainLoop] Running for %f seconds\n", timeToRun)
 	} else {
 		fmt.Println("[mainLoop] Running forever")
 	}
 
-	// prepare the byte slices and channels that connect the source and dest threads
-	fillingSlice := make([]byte, nPixels*3)
-	sendingSlice := make([]byte, nPixels*3)
+	// prepare the frames and channels that connect the source and dest threads
+	fillingFrame := opc.NewFrame(nPixels)
+	sendingFrame := opc.NewFrame(nPixels)
 
-	bytesToFillChan := make(chan []byte, 0)
-	toEffectChan := make(chan []byte, 0)
-	toPottyEffectChan := make(chan []byte, 0)
-	bytesFilledChan := make(chan []byte, 0)
-	bytesToSendChan := make(chan []byte, 0)
-	bytesSentChan := make(chan []byte, 0)
+	framesToFillChan := make(chan *opc.Frame, 0)
+	framesFilledChan := make(chan *opc.Frame, 0)
+	framesToSendChan := make(chan *opc.Frame, 0)
+	framesSentChan := make(chan *opc.Frame, 0)
 
-	// set up midi
+	// one channel between each pair of stages from the source to the last effect
+	stageChans := []chan *opc.Frame{framesToFillChan}
+	for _ = range pipeline.Effects {
+		stageChans = append(stageChans, make(chan *opc.Frame, 0))
+	}
+	stageChans = append(stageChans, framesFilledChan)
+
+	// set up midi, plus anything else that sets controls
 	midiMessageChan := midi.GetMidiMessageStream("/dev/midi1") // this launches the midi thread
+	var eventChans []chan controls.Event
+	if remoteServer != nil {
+		eventChans = append(eventChans, remoteServer.Events)
+	}
+	if oscEventChan != nil {
+		eventChans = append(eventChans, oscEventChan)
+	}
 	midiState := midi.MidiState{}
-	// set initial values for controller knobs
+	// set initial values for the controls
 	//  (because the midi hardware only sends us values when the knobs move)
-	for knob, defaultVal := range config.DEFAULT_KNOB_VALUES {
-		midiState.ControllerValues[knob] = defaultVal
+	controls.Reset(&midiState)
+	savedState.Restore(&midiState)
+	attractMode := attract.New(attractAfter)
+	attractMode.Switcher = pipeline.Switcher
+
+	// launch the threads, keeping track of when they exit
+	var threadsRunning sync.WaitGroup
+	launch := func(thread opc.FrameThread, framesIn chan *opc.Frame, framesOut chan *opc.Frame) {
+		threadsRunning.Add(1)
+		go func() {
+			opc.RunStage(thread, framesIn, framesOut, &midiState)
+			threadsRunning.Done()
+		}()
+	}
+	launch(pipeline.Source, stageChans[0], stageChans[1])
+	for ii, effectThread := range pipeline.Effects {
+		launch(effectThread, stageChans[ii+1], stageChans[ii+2])
 	}
+	launch(pipeline.Dest, framesToSendChan, framesSentChan)
 
-	// launch the threads
-	go sourceThread(bytesToFillChan, toEffectChan, &midiState)
-	go effectThread(toEffectChan, toPottyEffectChan, &midiState)
-	go pottyEffectThread(toPottyEffectChan, bytesFilledChan, &midiState)
-	go destThread(bytesToSendChan, bytesSentChan, &midiState)
+	// listen for ctrl-C and kill so we can fade out and shut down cleanly.
+	// a second signal quits immediately in case the pipeline is stuck.
+	signalChan := make(chan os.Signal, 2)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	shuttingDown := false
+	shutdownStartTime := 0.0
 
 	// main loop
 	frame_budget_ms := 1000.0 / fps
@@ -164,8 +248,11 @@ func mainLoop(nPixels int, sourceThread, effectThread, pottyEffectThread, destTh
 	frameStartTime := startTime
 	frameEndTime := startTime
 	framesSinceLastPrint := 0
+	midiMessagesSinceLastPrint := 0
 	firstIteration := true
+	var seq uint64 // sequence number of the frame being filled
 	flipper := 0
+	clockStartTime := clock.Now()
 	beaglebone.SetOnboardLED(0, 1)
 	for {
 		// if we have any frame budget left from last time around, sleep to control the framerate
@@ -174,6 +261,10 @@ func mainLoop(nPixels int, sourceThread, effectThread, pottyEffectThread, destTh
 			timeRemaining := float64(frame_budget_ms)/1000 - (frameEndTime - frameStartTime)
 			if timeRemaining > 0 {
 				time.Sleep(time.Duration(timeRemaining*1000*1000) * time.Microsecond)
+			} else if !firstIteration {
+				// count the frame slots we missed
+				missed := int((frameEndTime - frameStartTime) / (float64(frame_budget_ms) / 1000))
+				metrics.FRAMES_DROPPED.Add("late", float64(missed))
 			}
 		}
 
@@ -185,61 +276,257 @@ func mainLoop(nPixels int, sourceThread, effectThread, pottyEffectThread, destTh
 			lastPrintTime = frameStartTime
 			fmt.Printf("[mainLoop] %f ms/frame (%d fps)\n", 1000.0/float64(framesSinceLastPrint), framesSinceLastPrint)
 			framesSinceLastPrint = 0
+			metrics.MIDI_RATE.Set("", float64(midiMessagesSinceLastPrint))
+			midiMessagesSinceLastPrint = 0
 			// toggle LED
 			beaglebone.SetOnboardLED(ONBOARD_LED_HEARTBEAT, flipper)
 			flipper = 1 - flipper
 		}
 
-		// if profiling, quit after a while
-		if timeToRun > 0 && frameStartTime > startTime+timeToRun {
-			return
+		// advance the frame clock.  none of the threads are reading it right now.
+		clock.Tick()
+
+		// quit after a while if --seconds was given
+		if timeToRun > 0 && clock.Now() > clockStartTime+timeToRun {
+			break
+		}
+
+		// begin fading out if we've been asked to quit
+		if !shuttingDown {
+			select {
+			case sig := <-signalChan:
+				fmt.Printf("[mainLoop] got %v.  fading out over %v seconds.\n", sig, fadeOutTime)
+				shuttingDown = true
+				shutdownStartTime = clock.Now()
+				go func() {
+					<-signalChan
+					fmt.Println("[mainLoop] got another signal.  quitting immediately.")
+					os.Exit(1)
+				}()
+			default:
+			}
 		}
 
-		// get midi
-		midiState.UpdateStateFromChannel(midiMessageChan)
+		// get midi, and control changes from the remote control API and OSC
+		changed := controls.Update(&midiState, midi.GetAvailableMidiMessages(midiMessageChan), controls.GetAvailableEvents(eventChans...))
+		controls.Smooth(&midiState, clock.Now())
+		if sceneBank != nil {
+			changed = append(changed, sceneBank.Update(&midiState, changed, clock.Now())...)
+		}
+		midiMessagesSinceLastPrint += len(midiState.RecentMidiMessages)
+		metrics.MIDI_MESSAGES.Add("", float64(len(midiState.RecentMidiMessages)))
 		if len(midiState.RecentMidiMessages) > 0 {
 			beaglebone.SetOnboardLED(ONBOARD_LED_MIDI, 1)
 		} else {
 			beaglebone.SetOnboardLED(ONBOARD_LED_MIDI, 0)
 		}
+		learner.Update(&midiState, clock.Now())
+		attractMode.Update(&midiState, changed, clock.Now())
+		if remoteServer != nil {
+			remoteServer.Publish(&midiState)
+		}
+		if saver != nil {
+			saver.Update(&midiState, pipeline.Switcher.Current())
+		}
 
-		// start the threads filling and sending slices in parallel.
+		// start the threads filling and sending frames in parallel.
 		// if this is the first time through the loop we have to skip
 		//  the sending stage or we'll send out a whole bunch of zeros.
-		bytesToFillChan <- fillingSlice
+		seq++
+		fillingFrame.Seq = seq
+		fillingFrame.Time = clock.Now()
+		fillingFrame.Delta = clock.Delta()
+		framesToFillChan <- fillingFrame
 		if !firstIteration {
-			bytesToSendChan <- sendingSlice
+			framesToSendChan <- sendingFrame
 		}
 
 		// if only sending one frame, let's just get it all over with now
 		//  or we'd have to compute two frames worth of pixels because of
 		//  the double buffering effect of the two parallel threads
 		if *ONCE {
-			// get filled bytes and send them
-			bytesToSendChan <- <-bytesFilledChan
+			// get the filled frame and send it
+			framesToSendChan <- <-framesFilledChan
 			// wait for sending to complete
-			<-bytesSentChan
+			<-framesSentChan
 			fmt.Println("[mainLoop] just running once.  quitting now.")
-			return
+			break
 		}
 
 		// wait until both filling and sending threads are done
-		<-bytesFilledChan
+		<-framesFilledChan
 		if !firstIteration {
-			<-bytesSentChan
+			<-framesSentChan
 		}
 
-		// swap the slices
-		sendingSlice, fillingSlice = fillingSlice, sendingSlice
+		// the remote control's blackout button
+		if remoteServer != nil && remoteServer.Blackout() {
+			fillingFrame.Scale(0)
+		}
+
+		// dim the new frame if we're fading out
+		if shuttingDown {
+			fade := 0.0
+			if fadeOutTime > 0 {
+				fade = 1 - (clock.Now()-shutdownStartTime)/fadeOutTime
+			}
+			if fade <= 0 {
+				break
+			}
+			fillingFrame.Scale(float32(fade))
+		}
+
+		// swap the frames
+		sendingFrame, fillingFrame = fillingFrame, sendingFrame
+		metrics.FRAMES_TOTAL.Add("", 1)
 
 		firstIteration = false
 	}
+
+	// at this point none of the threads are holding a frame.
+
+	// leave the LEDs dark if we were killed
+	if shuttingDown {
+		fmt.Println("[mainLoop] sending a black frame")
+		sendingFrame.Scale(0)
+		framesToSendChan <- sendingFrame
+		<-framesSentChan
+	}
+
+	// close the inputs of the source and the dest.  each thread's range loop will end
+	// and the thread will return, closing the channels of any sub-threads it owns, and
+	// then its output channel, which stops the next stage.
+	close(framesToFillChan)
+	close(framesToSendChan)
+	threadsDone := make(chan bool)
+	go func() {
+		threadsRunning.Wait()
+		close(threadsDone)
+	}()
+	select {
+	case <-threadsDone:
+		fmt.Println("[mainLoop] all threads have exited")
+	case <-time.After(SHUTDOWN_TIMEOUT):
+		fmt.Println("[mainLoop] gave up waiting for threads to exit")
+	}
+
+	if saver != nil {
+		saver.Close(&midiState, pipeline.Switcher.Current())
+	}
+	if sceneBank != nil {
+		sceneBank.Close()
+	}
+	learner.Close()
+
+	beaglebone.SetOnboardLED(ONBOARD_LED_HEARTBEAT, 0)
+	beaglebone.SetOnboardLED(ONBOARD_LED_MIDI, 0)
 }
 
 func main() {
 	fmt.Println("--------------------------------------------------------------------------------\\")
 	defer fmt.Println("--------------------------------------------------------------------------------/")
 
-	nPixels, sourceThread, effectThread, pottyEffectThread, destThread := parseFlags()
-	mainLoop(nPixels, sourceThread, effectThread, pottyEffectThread, destThread, float64(*FPS), float64(*SECONDS))
+	nPixels, pipeline := parseFlags()
+
+	// MIDI controller.  learn mode creates a missing mapping file, starting from the LPD8.
+	if *MIDI_MAP_FN != "" {
+		var mapping *controls.MidiMapping
+		var err error
+		if _, statErr := os.Stat(*MIDI_MAP_FN); os.IsNotExist(statErr) {
+			fmt.Println("[main] no MIDI mapping file yet; starting from the LPD8 mapping")
+			mapping, err = controls.NewMidiMapping(&controls.LPD8_MAPPING.MidiMappingConfig)
+		} else {
+			mapping, err = controls.ReadMidiMapping(*MIDI_MAP_FN)
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			fmt.Println("--------------------------------------------------------------------------------/")
+			os.Exit(1)
+		}
+		mapping.Fn = *MIDI_MAP_FN // so learn mode saves to it, even if it doesn't exist yet
+		controls.MIDI_MAPPING = mapping
+		fmt.Printf("[main] MIDI mapping: %s (%s)\n", mapping.Name, mapping.Fn)
+	}
+
+	// OSC
+	var oscEventChan chan controls.Event
+	if *OSC_ADDR != "" {
+		mapping, err := osc.NewMapping(nil)
+		if *OSC_MAP_FN != "" {
+			mapping, err = osc.ReadMapping(*OSC_MAP_FN)
+		}
+		if err == nil {
+			oscEventChan, err = osc.Listen(*OSC_ADDR, mapping)
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			fmt.Println("--------------------------------------------------------------------------------/")
+			os.Exit(1)
+		}
+	}
+
+	// scenes
+	var sceneBank *scenes.Bank
+	if *SCENES_FN != "" {
+		var err error
+		sceneBank, err = scenes.Load(*SCENES_FN, pipeline.Switcher)
+		if err != nil {
+			fmt.Println("Error:", err)
+			fmt.Println("--------------------------------------------------------------------------------/")
+			os.Exit(1)
+		}
+	}
+
+	// pick up where we left off.  a broken state file shouldn't keep the lights off, so just warn.
+	var savedState *persist.State
+	var saver *persist.Saver
+	if *STATE_FN != "" {
+		configuredSource := pipeline.Switcher.Current()
+		var err error
+		savedState, err = persist.Load(*STATE_FN)
+		if err != nil {
+			fmt.Println("[main] warning:", err)
+		}
+		if source := savedState.SourceFor(configuredSource); source != "" {
+			fmt.Println("[main] restoring source", source)
+			if err := pipeline.Switcher.SwitchTo(source); err != nil {
+				fmt.Println("[main] warning: couldn't restore source:", err)
+			}
+		}
+		saver = persist.NewSaver(*STATE_FN, configuredSource)
+	}
+
+	if *METRICS_ADDR != "" {
+		metrics.Serve(*METRICS_ADDR)
+	}
+
+	// profiling.  mainLoop handles ctrl-C and returns normally, so the profile gets written.
+	defer profiling.Start(*PROFILE, *PROFILE_DIR)()
+	if *PPROF_ADDR != "" {
+		profiling.ServeHTTP(*PPROF_ADDR)
+	}
+	profiling.DumpOnSignal(syscall.SIGUSR1, *PROFILE_DIR, PROFILE_SIGNAL_SECONDS)
+
+	learner := learn.New()
+
+	// remote control
+	var remoteServer *remote.Server
+	if *REMOTE_ADDR != "" {
+		remoteServer = remote.New(*REMOTE_TOKEN, pipeline.Switcher)
+		remoteServer.Scenes = sceneBank
+		remoteServer.Learner = learner
+		if *REMOTE_TOKEN == "" {
+			fmt.Println("[main] warning: no --remote-token, so anyone on the network can control the lights")
+		}
+		remoteServer.Serve(*REMOTE_ADDR)
+	}
+
+	fps := float64(*FPS)
+	clock.Set(clock.MakeClock(*CLOCK, fps))
+	if *CLOCK == clock.OFFLINE {
+		// render as fast as we can
+		fps = 0
+	}
+
+	mainLoop(nPixels, pipeline, fps, float64(*SECONDS), float64(*FADE_OUT)/1000, float64(*ATTRACT_AFTER), remoteServer, oscEventChan, sceneBank, learner, savedState, saver)
 }
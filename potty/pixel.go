@@ -2,6 +2,7 @@ package potty
 
 import (
 	"math"
+	"math/rand"
 	"sort"
 
 	colorful "github.com/lucasb-eyer/go-colorful"
@@ -13,6 +14,8 @@ type PixelSpace struct {
 
 	Len int // Total number of pixels
 
+	Rand *rand.Rand // for the effects in this space, so each pattern's random values are the same every run
+
 	// Bounding Box
 	MaxX float64
 	MaxY float64
@@ -33,6 +36,7 @@ func NewPixelSpace(locations []float64) *PixelSpace {
 		Pixels: make([]*Pixel, len),
 		Strips: make([][]*Pixel, 0),
 		Len:    len,
+		Rand:   rand.New(rand.NewSource(9)),
 	}
 
 	stripMap := make(map[float64][]*Pixel) //helper for sorting pixels into strips
@@ -83,7 +87,7 @@ func NewPixelSpace(locations []float64) *PixelSpace {
 
 // Z coord for pixel in [0,1] space
 func (b *PixelSpace) RandomPixel() *Pixel {
-	i := int(math.Floor(RandGen.Float64() * float64(b.Len)))
+	i := int(math.Floor(b.Rand.Float64() * float64(b.Len)))
 	return b.Pixels[i]
 }
 
@@ -123,6 +127,22 @@ func (b *PixelSpace) ToBytes(bytes []byte) []byte {
 	return bytes
 }
 
+// SetFromFloats is like SetFromBytes but for float r, g, b values where 1 is full brightness
+func (b *PixelSpace) SetFromFloats(floats []float32) {
+	for i := 0; i < b.Len && i*3+2 < len(floats); i++ {
+		b.Pixels[i].Color = colorful.Color{R: float64(floats[i*3+0]), G: float64(floats[i*3+1]), B: float64(floats[i*3+2])}
+	}
+}
+
+// ToFloats writes the Pixels to the output buffer without clipping or rounding
+func (b *PixelSpace) ToFloats(floats []float32) []float32 {
+	for i := 0; i < b.Len && i*3+2 < len(floats); i++ {
+		c := b.Pixels[i].Color
+		floats[i*3+0], floats[i*3+1], floats[i*3+2] = float32(c.R), float32(c.G), float32(c.B)
+	}
+	return floats
+}
+
 type Pixel struct {
 	Color colorful.Color
 
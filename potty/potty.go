@@ -2,16 +2,11 @@
 package potty
 
 import (
-	"math/rand"
-	"time"
-
+	"github.com/longears/pixelslinger/clock"
 	"github.com/longears/pixelslinger/midi"
 	colorful "github.com/lucasb-eyer/go-colorful"
 )
 
-// make persistant random values
-var RandGen = rand.New(rand.NewSource(9))
-
 var (
 	White = colorful.LinearRgb(1, 1, 1)
 	Black = colorful.LinearRgb(0, 0, 0)
@@ -30,19 +25,40 @@ func MakeWaterPattern(locations []float64) func(bytesIn chan []byte, bytesOut ch
 	})
 }
 
-func MakeEffectFaderPattern(locations []float64) func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
-	space := NewPixelSpace(locations)
-
-	return makePattern(space, []Renderer{
+func newEffectFaderStack(space *PixelSpace) []Renderer {
+	return []Renderer{
 		NewColorDanceEffect(space), // banging colors to the midi beat
 		NewFlushEffect(space),      // flush masks off the shape
-	})
+	}
+}
+
+// An effect stack which works on float r, g, b slices, so it doesn't have to round
+// colors off to bytes
+type FloatEffect struct {
+	space       *PixelSpace
+	renderStack []Renderer
+}
+
+// NewEffectFaderFloats makes the color dance and flush effects for float r, g, b slices
+func NewEffectFaderFloats(locations []float64) *FloatEffect {
+	space := NewPixelSpace(locations)
+	return &FloatEffect{space, newEffectFaderStack(space)}
+}
+
+// Run the effects on floats for the frame at time t.  Returns floats, which may have
+// been reallocated.
+func (e *FloatEffect) Render(floats []float32, midiState *midi.MidiState, t float64) []float32 {
+	e.space.SetFromFloats(floats)
+	for _, r := range e.renderStack {
+		r.Render(midiState, t)
+	}
+	return e.space.ToFloats(floats)
 }
 
 func makePattern(space *PixelSpace, renderStack []Renderer) func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
 	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
 		for bytes := range bytesIn {
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := clock.Now()
 			space.SetFromBytes(bytes)
 
 			for _, r := range renderStack {
@@ -1,6 +1,8 @@
 package potty
 
 import (
+	"math/rand"
+
 	"github.com/longears/pixelslinger/midi"
 )
 
@@ -20,7 +22,9 @@ func NewBubbleEffect(space *PixelSpace) *BubbleEffect {
 	}
 
 	for _, p := range space.Pixels {
-		b.bubbles[p.XFlat] = NewBubble()
+		if b.bubbles[p.XFlat] == nil {
+			b.bubbles[p.XFlat] = NewBubble(space.Rand)
+		}
 	}
 	return b
 }
@@ -32,8 +36,9 @@ func (b *BubbleEffect) Render(midiState *midi.MidiState, t float64) {
 		p.Color = p.Color.BlendRgb(White, bubble.Strength(pZ)).Clamped()
 	}
 
-	for _, bubble := range b.bubbles {
-		bubble.Move()
+	// one bubble per strip, in order so the random numbers go to the same bubbles every run
+	for _, strip := range b.space.Strips {
+		b.bubbles[strip[0].XFlat].Move(b.space.Rand)
 	}
 }
 
@@ -42,18 +47,18 @@ type Bubble struct {
 	Z     float64
 }
 
-func NewBubble() *Bubble {
+func NewBubble(rng *rand.Rand) *Bubble {
 	return &Bubble{
-		Z:     RandGen.Float64()*BSpread - BSpread/2,
-		Speed: BSpeed + RandGen.Float64()*BSpeedVar,
+		Z:     rng.Float64()*BSpread - BSpread/2,
+		Speed: BSpeed + rng.Float64()*BSpeedVar,
 	}
 }
 
-func (b *Bubble) Move() {
+func (b *Bubble) Move(rng *rand.Rand) {
 	b.Z += b.Speed
 	if b.Z >= BSpread {
 		b.Z -= BSpread
-		b.Speed = BSpeed + RandGen.Float64()*BSpeedVar
+		b.Speed = BSpeed + rng.Float64()*BSpeedVar
 	}
 }
 
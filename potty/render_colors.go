@@ -4,7 +4,7 @@ import (
 	"math"
 	"math/rand"
 
-	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/controls"
 	"github.com/longears/pixelslinger/midi"
 	colorful "github.com/lucasb-eyer/go-colorful"
 )
@@ -13,49 +13,41 @@ const (
 	CSpeed    = 0.004 // How fast they go up
 	CSpeedVar = 0.004 // Speed variation each time a circle starts over
 	CLifeSpan = 0.75
-
-	CircleButton = config.BLINK_CIRCLE_PAD
 )
 
 type ColorDanceEffect struct {
 	space            *PixelSpace
-	circles          map[float64]*Circle
+	circles          []*Circle // oldest first, which is the order they're blended in
+	nextColorPicker  int
 	resetTime        float64
 	currentCLifeSpan float64
-	buttonPressed    bool
+	circlePresses    controls.TriggerState // for controls.BLINK_CIRCLE.Fired
 	fakeButtonPress  float64
 }
 
 func NewColorDanceEffect(space *PixelSpace) *ColorDanceEffect {
 	return &ColorDanceEffect{
-		space:   space,
-		circles: make(map[float64]*Circle),
+		space: space,
 	}
 }
 
 func (e *ColorDanceEffect) Render(midiState *midi.MidiState, t float64) {
+	alive := e.circles[:0]
 	for _, circle := range e.circles {
 		circle.Move(t)
-		if circle.Dead {
-			delete(e.circles, circle.ID())
+		if !circle.Dead {
+			alive = append(alive, circle)
 		}
 	}
+	e.circles = alive
 	/* fake button
 	if t > e.fakeButtonPress+0.5 {
 		e.fakeButtonPress = t
-		midiState.KeyVolumes[CircleButton] = 100
-	} else {
-		midiState.KeyVolumes[CircleButton] = 0
+		controls.BLINK_CIRCLE.Set(midiState, 1)
 	}
 	*/
-	if midiState.KeyVolumes[CircleButton] == 0 {
-		e.buttonPressed = false
-	}
-
-	if !e.buttonPressed && midiState.KeyVolumes[CircleButton] > 0 {
-		e.buttonPressed = true
-		circle := NewCircle(e.space, t)
-		e.circles[circle.ID()] = circle
+	if controls.BLINK_CIRCLE.Fired(midiState, &e.circlePresses) {
+		e.circles = append(e.circles, NewCircle(e.space, e.NextColorPicker(), t))
 	}
 
 	for _, pixel := range e.space.Pixels {
@@ -76,15 +68,14 @@ type Circle struct {
 	Dead     bool
 }
 
-func NewCircle(space *PixelSpace, t float64) *Circle {
+func NewCircle(space *PixelSpace, cp colorPicker, t float64) *Circle {
 	p := space.RandomPixel()
-	cp := NextColorPicker()
-	p.Color = cp()
+	p.Color = cp(space.Rand)
 	return &Circle{
 		space:       space,
 		colorPicker: cp,
 		Pixel:       *p,
-		Speed:       CSpeed + RandGen.Float64()*CSpeedVar,
+		Speed:       CSpeed + space.Rand.Float64()*CSpeedVar,
 		EndTime:     t + CLifeSpan,
 	}
 
@@ -116,7 +107,7 @@ func (c *Circle) Move(t float64) {
 	}
 }
 
-type colorPicker func() colorful.Color
+type colorPicker func(rng *rand.Rand) colorful.Color
 
 var colorPickers = []colorPicker{
 	//RandBlue,
@@ -124,28 +115,26 @@ var colorPickers = []colorPicker{
 	RandRed,
 }
 
-var nextColorPicker = 0
-
-func NextColorPicker() colorPicker {
-	nextColorPicker++
-	if nextColorPicker == len(colorPickers) {
-		nextColorPicker = 0
+func (e *ColorDanceEffect) NextColorPicker() colorPicker {
+	e.nextColorPicker++
+	if e.nextColorPicker == len(colorPickers) {
+		e.nextColorPicker = 0
 	}
-	return colorPickers[nextColorPicker]
+	return colorPickers[e.nextColorPicker]
 }
 
-func RandBlue() colorful.Color {
-	return colorful.Hsv(RandVal(340, 360), 1.0, 1.0)
+func RandBlue(rng *rand.Rand) colorful.Color {
+	return colorful.Hsv(RandVal(rng, 340, 360), 1.0, 1.0)
 }
 
-func RandGreen() colorful.Color {
-	return colorful.Hsv(RandVal(30, 40), 1.0, 1.0)
+func RandGreen(rng *rand.Rand) colorful.Color {
+	return colorful.Hsv(RandVal(rng, 30, 40), 1.0, 1.0)
 }
 
-func RandRed() colorful.Color {
-	return colorful.Hsv(RandVal(0, 20), 1.0, 1.0)
+func RandRed(rng *rand.Rand) colorful.Color {
+	return colorful.Hsv(RandVal(rng, 0, 20), 1.0, 1.0)
 }
 
-func RandVal(low, high float64) float64 {
-	return math.Floor(rand.Float64()*high) + low
+func RandVal(rng *rand.Rand, low, high float64) float64 {
+	return math.Floor(rng.Float64()*high) + low
 }
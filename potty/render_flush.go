@@ -4,7 +4,7 @@ import (
 	"math"
 
 	"github.com/longears/pixelslinger/colorutils"
-	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/controls"
 	"github.com/longears/pixelslinger/midi"
 )
 
@@ -16,8 +16,6 @@ const (
 
 	// Size of falling water streams when draining
 	FlushStreamerSize = 0.15
-
-	FlushControlPad = config.FLUSH_PAD
 )
 
 type FlushEffect struct {
@@ -34,14 +32,14 @@ func NewFlushEffect(space *PixelSpace) *FlushEffect {
 	}
 
 	for i := range f.random {
-		f.random[i] = math.Pow(RandGen.Float64(), 30.0)
+		f.random[i] = math.Pow(space.Rand.Float64(), 30.0)
 	}
 
 	return f
 }
 
 func (f *FlushEffect) SetFlushState(midiState *midi.MidiState, t float64) {
-	flushPad := midiState.KeyVolumes[FlushControlPad]
+	flushPad := controls.FLUSH.On(midiState)
 
 	switch {
 	/* Fake flush
@@ -49,7 +47,7 @@ func (f *FlushEffect) SetFlushState(midiState *midi.MidiState, t float64) {
 		f.isFlushing = true
 		f.startTime = t
 	*/
-	case !f.isFlushing && flushPad > 0:
+	case !f.isFlushing && flushPad:
 		f.isFlushing = true
 		f.startTime = t
 	case t > f.startTime+RefillComplete:
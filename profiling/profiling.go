@@ -0,0 +1,136 @@
+/*
+Package profiling turns on Go's profilers for pixelslinger in three ways:
+
+ Start:        profile the whole run (cpu, heap, block, mutex, or trace)
+ ServeHTTP:    serve net/http/pprof so "go tool pprof" can connect to a running instance
+ DumpOnSignal: write profiles from a running instance when it gets a signal, e.g. kill -USR1
+
+Profiles are written to files in a directory of your choosing.
+
+The pipeline's stages run with a "stage" pprof label (see opc.MakeLabeledThread), so
+CPU and goroutine profiles can be split up by stage, e.g. with
+"go tool pprof -tagfocus stage=source:fire".
+*/
+package profiling
+
+import (
+	"fmt"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/pprof"
+	"time"
+
+	"github.com/pkg/profile"
+)
+
+// Kinds of whole-run profiles
+const (
+	NONE  = "none"
+	CPU   = "cpu"
+	HEAP  = "heap"
+	BLOCK = "block"
+	MUTEX = "mutex"
+	TRACE = "trace"
+)
+
+var KINDS = []string{NONE, CPU, HEAP, BLOCK, MUTEX, TRACE}
+
+// Start profiling the whole run and return a function which stops profiling and
+// writes the profile into dir.  kind is one of KINDS.
+// Unlike plain profile.Start, this doesn't install its own ctrl-C handler,
+// so the caller has to make sure the stop function gets called.
+func Start(kind string, dir string) (stop func()) {
+	var mode func(*profile.Profile)
+	switch kind {
+	case CPU:
+		mode = profile.CPUProfile
+	case HEAP:
+		mode = profile.MemProfile
+	case BLOCK:
+		mode = profile.BlockProfile
+	case MUTEX:
+		mode = profile.MutexProfile
+	case TRACE:
+		mode = profile.TraceProfile
+	default:
+		return func() {}
+	}
+	fmt.Printf("[profiling] writing %s profile to %s when we quit\n", kind, dir)
+	return profile.Start(mode, profile.ProfilePath(dir), profile.NoShutdownHook).Stop
+}
+
+// Make a handler which serves the net/http/pprof handlers under /debug/pprof/, and nothing else.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index) // also serves the named profiles, like /debug/pprof/heap
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+	return mux
+}
+
+// Serve Handler at addr in its own goroutine.  This is the only server with the pprof
+// handlers.  (Importing net/http/pprof also puts them on http.DefaultServeMux, which is
+// why nothing in pixelslinger serves that.)
+func ServeHTTP(addr string) {
+	fmt.Printf("[profiling] serving /debug/pprof/ on %s\n", addr)
+	handler := Handler()
+	go func() {
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			fmt.Println("[profiling] HTTP server stopped:", err)
+		}
+	}()
+}
+
+// Every time the process gets sig, write heap and goroutine profiles to dir right away,
+// then record a CPU profile for cpuSeconds and write that too.
+// Signals that arrive while a CPU profile is being recorded only get the heap and goroutine profiles.
+func DumpOnSignal(sig os.Signal, dir string, cpuSeconds int) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, sig)
+	go func() {
+		for _ = range sigChan {
+			stamp := time.Now().Format("20060102-150405")
+			fmt.Printf("[profiling] got %v.  dumping profiles to %s\n", sig, dir)
+			writeProfile("heap", filepath.Join(dir, "heap-"+stamp+".pprof"))
+			writeProfile("goroutine", filepath.Join(dir, "goroutine-"+stamp+".pprof"))
+			go recordCpuProfile(filepath.Join(dir, "cpu-"+stamp+".pprof"), cpuSeconds)
+		}
+	}()
+}
+
+func writeProfile(name string, fn string) {
+	file, err := os.Create(fn)
+	if err != nil {
+		fmt.Println("[profiling]", err)
+		return
+	}
+	defer file.Close()
+	if err := pprof.Lookup(name).WriteTo(file, 0); err != nil {
+		fmt.Println("[profiling]", err)
+		return
+	}
+	fmt.Println("[profiling]    wrote", fn)
+}
+
+func recordCpuProfile(fn string, seconds int) {
+	file, err := os.Create(fn)
+	if err != nil {
+		fmt.Println("[profiling]", err)
+		return
+	}
+	defer file.Close()
+	if err := pprof.StartCPUProfile(file); err != nil {
+		// probably already running, either from an earlier signal or from Start
+		fmt.Println("[profiling] can't record CPU profile:", err)
+		os.Remove(fn)
+		return
+	}
+	time.Sleep(time.Duration(seconds) * time.Second)
+	pprof.StopCPUProfile()
+	fmt.Println("[profiling]    wrote", fn)
+}
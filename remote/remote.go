@@ -0,0 +1,518 @@
+/*
+Package remote serves a JSON API for controlling pixelslinger over HTTP, so it can
+be run from a phone instead of the MIDI controller.
+
+	GET  /api/patterns       list the pattern names
+	GET  /api/state          the current source, controls and blackout
+	GET  /api/events         the same state as Server-Sent Events, sent whenever it changes
+	POST /api/source         {"name": "fire"} switches to any source --source accepts, except OPC servers
+	POST /api/controls/NAME  {"value": 0.5} sets a control by name (see the controls package)
+	POST /api/knobs/N        {"value": 0.5} sets MIDI controller N as if a knob had turned
+	POST /api/pads/N         {"value": 1} holds MIDI key N down as if a pad was pressed; 0 releases it
+	POST /api/trigger/NAME   {"seconds": 0.5} fires a trigger control, or turns a control (or key
+	                         number) on and back off after a while
+	POST /api/blackout       {"on": true} turns all the lights off until {"on": false}
+	GET  /api/scenes         the saved scenes by program number (see the scenes package)
+	POST /api/scenes/N       {"transition_time": 2} recalls scene N; the body is optional
+	POST /api/scenes/N/save  {"name": "warm"} saves the live state as scene N; the body is optional
+	POST /api/learn          {"control": "hue"} binds the next knob or pad touched to a control (see
+	                         the learn package); without a control, it's picked on the controller.
+	                         {"cancel": true} leaves learn mode.
+
+Control values go from the control's Min to Max (0 to 1 for all of them so far); for
+bools and triggers anything above 0 is on.  Knob and pad values go from 0 to 1 and
+are scaled to MIDI's 0 to 127.  /api/knobs and /api/pads also take control names, like
+/api/controls.  If the server has a token, every request needs
+either an "Authorization: Bearer TOKEN" header or a "token=TOKEN" query parameter
+(browsers can't set headers for Server-Sent Events).
+
+The API never touches the MidiState directly.  Changes become controls.Events on
+Server.Events, which the main loop applies along with the real MIDI input, and the
+main loop calls Publish once per frame so readers see the new state.
+*/
+package remote
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/learn"
+	"github.com/longears/pixelslinger/midi"
+	"github.com/longears/pixelslinger/opc"
+	"github.com/longears/pixelslinger/scenes"
+)
+
+// How long /api/trigger holds a control on if the request doesn't say
+const DEFAULT_TRIGGER_SECONDS = 0.25
+
+// Shortest /api/trigger press, so the main loop sees the press and the release in different frames
+const MIN_TRIGGER_SECONDS = 0.05
+
+// How often to send a comment to event streams so phones and proxies don't hang up on them
+const KEEPALIVE_INTERVAL = 15 * time.Second
+
+//================================================================================
+// STATE
+
+// What /api/state returns.
+type State struct {
+	Source       string             `json:"source"`
+	Blackout     bool               `json:"blackout"`
+	Controls     map[string]float64 `json:"controls"`    // by name.  triggers are how many times they've fired.
+	Controllers  []float64          `json:"controllers"` // all 128 MIDI controllers by number, from 0 to 1
+	Keys         []float64          `json:"keys"`        // all 128 MIDI keys by number, from 0 to 1
+	Learning     bool               `json:"learning"`
+	LearnControl string             `json:"learn_control,omitempty"` // the control being learned, once it's picked
+}
+
+//================================================================================
+// SERVER
+
+// Handles the API requests.  Make one with New.
+type Server struct {
+	Token    string              // if not empty, requests must include this token
+	Switcher *opc.SourceSwitcher // used to change the source; may be nil
+	Events   chan controls.Event // control changes for the main loop to apply
+	Scenes   *scenes.Bank        // may be nil if there's no scenes file
+	Learner  *learn.Learner      // may be nil
+
+	mutex       sync.Mutex
+	midiState   midi.MidiState // as of the last Publish
+	blackout    bool
+	stateJson   []byte               // the last state sent to subscribers
+	subscribers map[chan []byte]bool // one per event stream
+}
+
+// Make a server which switches sources with the given switcher (which may be nil).
+// If token isn't empty, requests must include it.
+func New(token string, switcher *opc.SourceSwitcher) *Server {
+	return &Server{
+		Token:       token,
+		Switcher:    switcher,
+		Events:      make(chan controls.Event, 500),
+		subscribers: make(map[chan []byte]bool),
+	}
+}
+
+// Should the main loop black out the lights?
+func (s *Server) Blackout() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.blackout
+}
+
+// Tell the server what the MidiState looks like now.  Call this from the main loop
+// between frames.  If anything changed, the new state is sent to the event streams.
+func (s *Server) Publish(midiState *midi.MidiState) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.midiState.KeyVolumes = midiState.KeyVolumes
+	s.midiState.ControllerValues = midiState.ControllerValues
+	s.midiState.Controls = midiState.Controls
+	s.notify()
+}
+
+// Send the state to the event streams if it has changed.  Call with the mutex held.
+func (s *Server) notify() {
+	data, err := json.Marshal(s.state())
+	if err != nil || string(data) == string(s.stateJson) {
+		return
+	}
+	s.stateJson = data
+	for ch := range s.subscribers {
+		// only the newest state matters, so replace one that hasn't been sent yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- data
+	}
+}
+
+// Build the State.  Call with the mutex held.
+func (s *Server) state() *State {
+	st := &State{
+		Blackout:    s.blackout,
+		Controls:    make(map[string]float64),
+		Controllers: make([]float64, 128),
+		Keys:        make([]float64, 128),
+	}
+	if s.Switcher != nil {
+		st.Source = s.Switcher.Current()
+	}
+	for _, c := range controls.CONTROLS {
+		st.Controls[c.Name] = c.Get(&s.midiState)
+	}
+	for ii := range st.Controllers {
+		st.Controllers[ii] = fromMidi(s.midiState.ControllerValues[ii])
+		st.Keys[ii] = fromMidi(s.midiState.KeyVolumes[ii])
+	}
+	if s.Learner != nil {
+		var c *controls.Control
+		st.Learning, c = s.Learner.Status()
+		if c != nil {
+			st.LearnControl = c.Name
+		}
+	}
+	return st
+}
+
+func fromMidi(b byte) float64 {
+	return float64(b) / 127
+}
+
+func toMidi(x float64) byte {
+	return byte(math.Floor(math.Min(math.Max(x, 0), 1)*127 + 0.5))
+}
+
+// Queue an Event for the main loop.
+func (s *Server) send(ev controls.Event) error {
+	select {
+	case s.Events <- ev:
+		return nil
+	default:
+		return fmt.Errorf("too many messages waiting for the main loop")
+	}
+}
+
+//================================================================================
+// HTTP
+
+// Make a handler which serves the API under /api/, and nothing else.  Every handler
+// checks the token.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/patterns", s.auth("GET", s.handlePatterns))
+	mux.HandleFunc("/api/state", s.auth("GET", s.handleState))
+	mux.HandleFunc("/api/events", s.auth("GET", s.handleEvents))
+	mux.HandleFunc("/api/source", s.auth("POST", s.handleSource))
+	mux.HandleFunc("/api/controls/", s.auth("POST", s.handleValue("/api/controls/", 0)))
+	mux.HandleFunc("/api/knobs/", s.auth("POST", s.handleValue("/api/knobs/", midi.CONTROLLER)))
+	mux.HandleFunc("/api/pads/", s.auth("POST", s.handleValue("/api/pads/", midi.NOTE_ON)))
+	mux.HandleFunc("/api/trigger/", s.auth("POST", s.handleTrigger))
+	mux.HandleFunc("/api/blackout", s.auth("POST", s.handleBlackout))
+	mux.HandleFunc("/api/scenes", s.auth("GET", s.handleScenes))
+	mux.HandleFunc("/api/scenes/", s.auth("POST", s.handleScene))
+	mux.HandleFunc("/api/learn", s.auth("POST", s.handleLearn))
+	return mux
+}
+
+// Serve Handler at addr in its own goroutine.  This server has its own address: the
+// metrics and pprof handlers don't check the token, so they're never on it.
+func (s *Server) Serve(addr string) {
+	fmt.Println("[remote] serving /api/ on", addr)
+	handler := s.Handler()
+	go func() {
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			fmt.Println("[remote] HTTP server stopped:", err)
+		}
+	}()
+}
+
+// Wrap a handler so it only accepts the given method and checks the token.
+func (s *Server) auth(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Token != "" {
+			token := r.URL.Query().Get("token")
+			if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+				token = strings.TrimPrefix(header, "Bearer ")
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("bad or missing token"))
+				return
+			}
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use %s", method))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
+
+// Parse the JSON request body into v.  On failure, write an error and return false.
+func readJson(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("could not parse request: %v", err))
+		return false
+	}
+	return true
+}
+
+// Look up the last part of the URL path as a control name or, if numbers are allowed,
+// a MIDI controller or key number from 0 to 127.  Returns the control, or nil and the number.
+func lookupName(r *http.Request, prefix string, numbers bool) (*controls.Control, byte, error) {
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	if c := controls.Lookup(name); c != nil {
+		return c, 0, nil
+	}
+	if num, err := strconv.Atoi(name); numbers && err == nil && num >= 0 && num < 128 {
+		return nil, byte(num), nil
+	}
+	known := strings.Join(controls.Names(), ", ")
+	if numbers {
+		return nil, 0, fmt.Errorf("unknown name \"%s\" (should be a number from 0 to 127 or one of %s)", name, known)
+	}
+	return nil, 0, fmt.Errorf("unknown control \"%s\" (should be one of %s)", name, known)
+}
+
+// A MidiMessage as if a knob turned or a pad was pressed, with value from 0 to 1.
+func midiEvent(kind, key byte, value float64) controls.Event {
+	if kind == midi.NOTE_ON && toMidi(value) == 0 {
+		kind = midi.NOTE_OFF
+	}
+	return controls.Event{Midi: &midi.MidiMessage{Kind: kind, Channel: 0, Key: key, Value: toMidi(value)}}
+}
+
+//--------------------------------------------------------------------------------
+// HANDLERS
+
+func (s *Server) handlePatterns(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(opc.PATTERN_REGISTRY))
+	for name := range opc.PATTERN_REGISTRY {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeJson(w, http.StatusOK, names)
+}
+
+func (s *Server) handleState(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	st := s.state()
+	s.mutex.Unlock()
+	writeJson(w, http.StatusOK, st)
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming isn't supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// start with the current state
+	ch := make(chan []byte, 1)
+	s.mutex.Lock()
+	data, _ := json.Marshal(s.state())
+	s.subscribers[ch] = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.subscribers, ch)
+		s.mutex.Unlock()
+	}()
+
+	keepalive := time.NewTicker(KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	for {
+		if data != nil {
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+			data = nil
+		} else {
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+		flusher.Flush()
+		select {
+		case data = <-ch:
+		case <-keepalive.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) handleSource(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if !readJson(w, r, &req) {
+		return
+	}
+	if s.Switcher == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("the source can't be switched"))
+		return
+	}
+	if err := s.Switcher.SwitchTo(req.Name); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	fmt.Println("[remote] switching source to", req.Name)
+	s.handleState(w, r)
+}
+
+// Handle /api/controls, /api/knobs and /api/pads.  rawKind is the kind of MidiMessage
+// to send when the name is a number, or 0 if numbers aren't allowed.
+func (s *Server) handleValue(prefix string, rawKind byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, number, err := lookupName(r, prefix, rawKind != 0)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		var req struct {
+			Value float64 `json:"value"`
+		}
+		if !readJson(w, r, &req) {
+			return
+		}
+		if c == nil {
+			s.sendAndReply(w, midiEvent(rawKind, number, req.Value))
+		} else {
+			s.sendAndReply(w, controls.Event{Control: c, Value: req.Value})
+		}
+	}
+}
+
+func (s *Server) handleTrigger(w http.ResponseWriter, r *http.Request) {
+	c, key, err := lookupName(r, "/api/trigger/", true)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	req := struct {
+		Seconds float64 `json:"seconds"`
+	}{DEFAULT_TRIGGER_SECONDS}
+	if r.ContentLength != 0 && !readJson(w, r, &req) {
+		return
+	}
+	req.Seconds = math.Max(req.Seconds, MIN_TRIGGER_SECONDS)
+
+	on, off := midiEvent(midi.NOTE_ON, key, 1), midiEvent(midi.NOTE_ON, key, 0)
+	if c != nil {
+		on, off = controls.Event{Control: c, Value: c.Max}, controls.Event{Control: c, Value: c.Min}
+	}
+	if err := s.send(on); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	// a trigger has nothing to release
+	if c == nil || c.Kind != controls.TRIGGER {
+		time.AfterFunc(time.Duration(req.Seconds*float64(time.Second)), func() {
+			if err := s.send(off); err != nil {
+				fmt.Println("[remote] couldn't turn it back off:", err)
+			}
+		})
+	}
+	writeJson(w, http.StatusAccepted, map[string]bool{"ok": true})
+}
+
+func (s *Server) handleBlackout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		On bool `json:"on"`
+	}
+	if !readJson(w, r, &req) {
+		return
+	}
+	fmt.Println("[remote] blackout:", req.On)
+	s.mutex.Lock()
+	s.blackout = req.On
+	s.notify()
+	s.mutex.Unlock()
+	s.handleState(w, r)
+}
+
+func (s *Server) handleScenes(w http.ResponseWriter, r *http.Request) {
+	list := make(map[string]*scenes.Scene)
+	if s.Scenes != nil {
+		for _, program := range s.Scenes.Programs() {
+			list[strconv.Itoa(program)] = s.Scenes.Get(program)
+		}
+	}
+	writeJson(w, http.StatusOK, list)
+}
+
+// Handle /api/scenes/N and /api/scenes/N/save.
+func (s *Server) handleScene(w http.ResponseWriter, r *http.Request) {
+	if s.Scenes == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("there's no scenes file"))
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/scenes/")
+	save := strings.HasSuffix(path, "/save")
+	program, err := strconv.Atoi(strings.TrimSuffix(path, "/save"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("\"%s\" isn't a program number", path))
+		return
+	}
+	var req struct {
+		Name           string   `json:"name"`
+		TransitionTime *float64 `json:"transition_time"`
+	}
+	if r.ContentLength != 0 && !readJson(w, r, &req) {
+		return
+	}
+	if save {
+		err = s.Scenes.Save(program, req.Name)
+	} else if s.Scenes.Get(program) == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("there's no scene %v", program))
+		return
+	} else {
+		err = s.Scenes.Recall(program, req.TransitionTime)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJson(w, http.StatusAccepted, map[string]bool{"ok": true})
+}
+
+func (s *Server) handleLearn(w http.ResponseWriter, r *http.Request) {
+	if s.Learner == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("learn mode isn't available"))
+		return
+	}
+	var req struct {
+		Control string `json:"control"`
+		Cancel  bool   `json:"cancel"`
+	}
+	if r.ContentLength != 0 && !readJson(w, r, &req) {
+		return
+	}
+	var err error
+	if req.Cancel {
+		err = s.Learner.Cancel()
+	} else if req.Control == "" {
+		err = s.Learner.Start(nil)
+	} else if c := controls.Lookup(req.Control); c == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown control \"%s\" (should be one of %s)", req.Control, strings.Join(controls.Names(), ", ")))
+		return
+	} else {
+		err = s.Learner.Start(c)
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJson(w, http.StatusAccepted, map[string]bool{"ok": true})
+}
+
+// Queue an Event and reply with 202, since it won't take effect until the next frame.
+func (s *Server) sendAndReply(w http.ResponseWriter, ev controls.Event) {
+	if err := s.send(ev); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJson(w, http.StatusAccepted, map[string]bool{"ok": true})
+}
@@ -0,0 +1,306 @@
+package remote
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	_ "net/http/pprof"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/learn"
+	"github.com/longears/pixelslinger/midi"
+	"github.com/longears/pixelslinger/scenes"
+)
+
+func startTestServer(token string) (*Server, *httptest.Server) {
+	s := New(token, nil)
+	return s, httptest.NewServer(s.Handler())
+}
+
+func request(t *testing.T, method, url, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer sekrit")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+//================================================================================
+func TestAuth(t *testing.T) {
+	_, ts := startTestServer("sekrit")
+	defer ts.Close()
+
+	for _, url := range []string{"/api/state", "/api/state?token=wrong"} {
+		resp, err := http.Get(ts.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %v", url, resp.StatusCode)
+		}
+	}
+	resp, err := http.Get(ts.URL + "/api/state?token=sekrit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("token in query: expected 200, got %v", resp.StatusCode)
+	}
+	resp = request(t, "GET", ts.URL+"/api/state", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("token in header: expected 200, got %v", resp.StatusCode)
+	}
+
+	// nothing outside /api/ is served, even though net/http/pprof (imported here the way
+	// the main package imports it) and expvar put handlers on http.DefaultServeMux
+	for _, url := range []string{"/debug/pprof/", "/debug/vars", "/metrics"} {
+		resp := request(t, "GET", ts.URL+url, "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %v", url, resp.StatusCode)
+		}
+	}
+}
+
+func TestControlsKnobsAndPads(t *testing.T) {
+	s, ts := startTestServer("sekrit")
+	defer ts.Close()
+
+	tests := []struct {
+		url, body string
+		status    int
+		event     *controls.Event
+	}{
+		{"/api/controls/hue", `{"value": 0.5}`, http.StatusAccepted, &controls.Event{Control: controls.HUE, Value: 0.5}},
+		{"/api/controls/slowmo", `{"value": 1}`, http.StatusAccepted, &controls.Event{Control: controls.SLOWMO, Value: 1}},
+		{"/api/controls/20", `{"value": 1}`, http.StatusNotFound, nil},
+		{"/api/controls/nope", `{"value": 1}`, http.StatusNotFound, nil},
+		{"/api/knobs/hue", `{"value": 0.25}`, http.StatusAccepted, &controls.Event{Control: controls.HUE, Value: 0.25}},
+		{"/api/knobs/20", `{"value": 2}`, http.StatusAccepted, &controls.Event{Midi: &midi.MidiMessage{Kind: midi.CONTROLLER, Key: 20, Value: 127}}},
+		{"/api/knobs/nope", `{"value": 1}`, http.StatusNotFound, nil},
+		{"/api/knobs/128", `{"value": 1}`, http.StatusNotFound, nil},
+		{"/api/knobs/hue", `not json`, http.StatusBadRequest, nil},
+		{"/api/pads/40", `{"value": 1}`, http.StatusAccepted, &controls.Event{Midi: &midi.MidiMessage{Kind: midi.NOTE_ON, Key: 40, Value: 127}}},
+		{"/api/pads/40", `{"value": 0}`, http.StatusAccepted, &controls.Event{Midi: &midi.MidiMessage{Kind: midi.NOTE_OFF, Key: 40, Value: 0}}},
+	}
+	for _, test := range tests {
+		resp := request(t, "POST", ts.URL+test.url, test.body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s: expected %v, got %v", test.url, test.body, test.status, resp.StatusCode)
+		}
+		events := controls.GetAvailableEvents(s.Events)
+		if test.event == nil {
+			if len(events) != 0 {
+				t.Errorf("%s %s: expected no events, got %v", test.url, test.body, events)
+			}
+		} else if len(events) != 1 || !reflect.DeepEqual(events[0], *test.event) {
+			t.Errorf("%s %s: expected %v, got %v", test.url, test.body, test.event, events)
+		}
+	}
+
+	resp := request(t, "GET", ts.URL+"/api/knobs/hue", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET of a knob: expected 405, got %v", resp.StatusCode)
+	}
+}
+
+func TestTrigger(t *testing.T) {
+	s, ts := startTestServer("sekrit")
+	defer ts.Close()
+
+	nextEvent := func() controls.Event {
+		select {
+		case ev := <-s.Events:
+			return ev
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+		return controls.Event{}
+	}
+
+	// a float control turns on and back off
+	resp := request(t, "POST", ts.URL+"/api/trigger/twinkle", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %v", resp.StatusCode)
+	}
+	for _, value := range []float64{1, 0} {
+		if ev := nextEvent(); ev.Control != controls.TWINKLE || ev.Value != value {
+			t.Errorf("expected twinkle at %v, got %+v", value, ev)
+		}
+	}
+
+	// a trigger fires once
+	resp = request(t, "POST", ts.URL+"/api/trigger/blink-circle", `{"seconds": 0.05}`)
+	resp.Body.Close()
+	if ev := nextEvent(); ev.Control != controls.BLINK_CIRCLE || ev.Value != 1 {
+		t.Errorf("expected blink-circle to fire, got %+v", ev)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if events := controls.GetAvailableEvents(s.Events); len(events) != 0 {
+		t.Errorf("expected nothing after a trigger, got %v", events)
+	}
+
+	// a key number is pressed and released
+	request(t, "POST", ts.URL+"/api/trigger/40", "").Body.Close()
+	for _, kind := range []byte{midi.NOTE_ON, midi.NOTE_OFF} {
+		if ev := nextEvent(); ev.Midi == nil || ev.Midi.Kind != kind || ev.Midi.Key != 40 {
+			t.Errorf("expected kind %v for key 40, got %+v", kind, ev)
+		}
+	}
+}
+
+func TestScenes(t *testing.T) {
+	s, ts := startTestServer("sekrit")
+	defer ts.Close()
+
+	resp := request(t, "POST", ts.URL+"/api/scenes/1", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("without a scenes file: expected 503, got %v", resp.StatusCode)
+	}
+
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "scenes.json")
+	ioutil.WriteFile(fn, []byte(`{"scenes": {"1": {"name": "warm", "controls": {"hue": 0.1}}}}`), 0644)
+	s.Scenes, err = scenes.Load(fn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Scenes.Close()
+
+	resp = request(t, "GET", ts.URL+"/api/scenes", "")
+	var list map[string]*scenes.Scene
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || list["1"] == nil || list["1"].Name != "warm" {
+		t.Errorf("unexpected scenes: %v", list)
+	}
+
+	tests := []struct {
+		url, body string
+		status    int
+	}{
+		{"/api/scenes/1", "", http.StatusAccepted},
+		{"/api/scenes/1", `{"transition_time": 5}`, http.StatusAccepted},
+		{"/api/scenes/1", `{"transition_time": -5}`, http.StatusBadRequest},
+		{"/api/scenes/2", "", http.StatusNotFound},
+		{"/api/scenes/warm", "", http.StatusNotFound},
+		{"/api/scenes/2/save", `{"name": "cool"}`, http.StatusAccepted},
+		{"/api/scenes/200/save", "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		resp := request(t, "POST", ts.URL+test.url, test.body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s: expected %v, got %v", test.url, test.body, test.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestLearn(t *testing.T) {
+	s, ts := startTestServer("sekrit")
+	defer ts.Close()
+	s.Learner = learn.New()
+	defer s.Learner.Close()
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"control": "hue"}`, http.StatusAccepted},
+		{`{"control": "nope"}`, http.StatusNotFound},
+		{"", http.StatusAccepted},
+		{`{"cancel": true}`, http.StatusAccepted},
+	}
+	for _, test := range tests {
+		resp := request(t, "POST", ts.URL+"/api/learn", test.body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected %v, got %v", test.body, test.status, resp.StatusCode)
+		}
+	}
+
+	// the first request takes effect on the next frame
+	midiState := &midi.MidiState{}
+	s.Learner.Start(controls.HUE)
+	s.Learner.Update(midiState, 0)
+	s.Publish(midiState)
+	resp := request(t, "GET", ts.URL+"/api/state", "")
+	var st State
+	json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	if !st.Learning || st.LearnControl != "hue" {
+		t.Errorf("expected to be learning hue, got %v %v", st.Learning, st.LearnControl)
+	}
+}
+
+func TestStateAndEvents(t *testing.T) {
+	s, ts := startTestServer("sekrit")
+	defer ts.Close()
+
+	resp := request(t, "GET", ts.URL+"/api/events", "")
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %v", ct)
+	}
+	events := bufio.NewReader(resp.Body)
+	nextState := func() *State {
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(line, "data: ") {
+				st := &State{}
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), st); err != nil {
+					t.Fatal(err)
+				}
+				return st
+			}
+		}
+	}
+
+	if st := nextState(); st.Blackout || st.Controls["hue"] != 0 {
+		t.Errorf("unexpected initial state: %+v", st)
+	}
+
+	midiState := &midi.MidiState{}
+	controls.HUE.Set(midiState, 1)
+	midiState.ControllerValues[20] = 127
+	s.Publish(midiState)
+	if st := nextState(); st.Controls["hue"] != 1 || st.Controllers[20] != 1 {
+		t.Errorf("expected hue and controller 20 to be 1, got %+v", st)
+	}
+
+	resp2 := request(t, "POST", ts.URL+"/api/blackout", `{"on": true}`)
+	resp2.Body.Close()
+	if !s.Blackout() {
+		t.Errorf("blackout didn't turn on")
+	}
+	if st := nextState(); !st.Blackout {
+		t.Errorf("expected blackout in the event stream, got %+v", st)
+	}
+}
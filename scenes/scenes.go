@@ -0,0 +1,342 @@
+/*
+Package scenes saves looks (a source plus control values) and recalls them when the
+MIDI controller sends a program change, so the LPD8's PROG CHNG buttons can jump
+between looks prepared ahead of time.
+
+Scenes live in a JSON file, by program number from 0 to 127:
+
+	{
+	    "scenes": {
+	        "0": {"name": "warm", "source": "fire", "controls": {"gain": 0.8, "hue": 0.05}},
+	        "1": {"name": "chill", "source": "aqua", "controls": {"speed": 0.3}, "transition_time": 5}
+	    }
+	}
+
+A scene's source is switched to with the pipeline's SourceSwitcher, and a scene
+without one keeps the current source.  Controls the scene doesn't list keep their
+values.  Float controls glide to the scene's values over "transition_time" seconds
+(default the switcher's transition time, from --transition-time) while the source
+transitions; bools change right away.  Triggers can't be part of a scene.  Turning
+a knob during the glide stops that control's glide.
+
+Bank.Save stores the live state as a scene and rewrites the file atomically.  Recalls
+and saves from other goroutines (like the remote control API) are queued and carried
+out by Update in the main loop, since only the main loop may change the MidiState.
+*/
+package scenes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/longears/pixelslinger/colorutils"
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+	"github.com/longears/pixelslinger/opc"
+	"github.com/longears/pixelslinger/persist"
+)
+
+// Program numbers go from 0 to MAX_PROGRAM
+const MAX_PROGRAM = 127
+
+//================================================================================
+// TYPES
+
+// One scene.
+type Scene struct {
+	Name           string             `json:"name,omitempty"`            // just for people
+	Source         string             `json:"source,omitempty"`          // anything --source accepts except an OPC server, or "" to keep the current one
+	Controls       map[string]float64 `json:"controls,omitempty"`        // by name, without the triggers
+	TransitionTime *float64           `json:"transition_time,omitempty"` // seconds, default the switcher's transition time
+}
+
+// The contents of a scenes file.
+type SceneFile struct {
+	Scenes map[string]*Scene `json:"scenes"` // by program number, as a string since that's what JSON allows
+}
+
+// A set of scenes and the file they're saved in.  Make one with Load.
+type Bank struct {
+	Fn       string
+	Switcher *opc.SourceSwitcher // may be nil, in which case scenes don't change the source
+
+	mutex    sync.Mutex
+	scenes   map[int]*Scene
+	requests chan request // recalls and saves for Update to carry out
+	writes   chan []byte  // holds at most one file which hasn't been written yet
+	done     chan bool
+
+	glides map[*controls.Control]*glide // only touched by Update
+}
+
+type request struct {
+	program int
+	save    bool
+	name    string   // for saves
+	seconds *float64 // for recalls, overrides the scene's transition time
+}
+
+// A control on its way to a scene's value.
+type glide struct {
+	from, to  float64
+	startTime float64
+	duration  float64
+}
+
+//================================================================================
+// LOADING AND SAVING
+
+// Read and check a scenes file.  A missing file is an empty bank, which Save will create.
+// If switcher isn't nil, the scenes' sources are checked against it.
+func Load(fn string, switcher *opc.SourceSwitcher) (*Bank, error) {
+	b := &Bank{
+		Fn:       fn,
+		Switcher: switcher,
+		scenes:   make(map[int]*Scene),
+		requests: make(chan request, 100),
+		writes:   make(chan []byte, 1),
+		done:     make(chan bool),
+		glides:   make(map[*controls.Control]*glide),
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read scenes file %s: %v", fn, err)
+	}
+	if err == nil {
+		sf := &SceneFile{}
+		if err := json.Unmarshal(data, sf); err != nil {
+			return nil, fmt.Errorf("could not parse scenes file %s: %v", fn, err)
+		}
+		for key, scene := range sf.Scenes {
+			program, err := strconv.Atoi(key)
+			if err != nil || program < 0 || program > MAX_PROGRAM {
+				return nil, fmt.Errorf("bad scenes file %s: \"%s\" should be a program number from 0 to %v", fn, key, MAX_PROGRAM)
+			}
+			if err := scene.check(switcher); err != nil {
+				return nil, fmt.Errorf("bad scenes file %s: scene %v: %v", fn, program, err)
+			}
+			b.scenes[program] = scene
+		}
+	}
+	go b.writerThread()
+	return b, nil
+}
+
+func (scene *Scene) check(switcher *opc.SourceSwitcher) error {
+	if scene == nil {
+		return fmt.Errorf("empty scene")
+	}
+	if scene.Source != "" && switcher != nil {
+		if err := switcher.Check(scene.Source); err != nil {
+			return err
+		}
+	}
+	for name, value := range scene.Controls {
+		c := controls.Lookup(name)
+		if c == nil || c.Kind == controls.TRIGGER {
+			return fmt.Errorf("unknown control \"%s\" (should be one of %s)", name, strings.Join(controls.Names(controls.FLOAT, controls.BOOL), ", "))
+		}
+		if value < c.Min || value > c.Max {
+			return fmt.Errorf("%s should be between %v and %v, got %v", name, c.Min, c.Max, value)
+		}
+	}
+	if scene.TransitionTime != nil && *scene.TransitionTime < 0 {
+		return fmt.Errorf("transition_time can't be negative")
+	}
+	return nil
+}
+
+// Wait for the last save to be written to the file.  Don't use the Bank afterwards.
+func (b *Bank) Close() {
+	close(b.writes)
+	<-b.done
+}
+
+func (b *Bank) writerThread() {
+	for data := range b.writes {
+		if err := persist.WriteFileAtomic(b.Fn, data); err != nil {
+			fmt.Println("[scenes]", err)
+		}
+	}
+	close(b.done)
+}
+
+// Queue the whole bank to be written.  Call with the mutex held.
+func (b *Bank) write() {
+	sf := &SceneFile{Scenes: make(map[string]*Scene)}
+	for program, scene := range b.scenes {
+		sf.Scenes[strconv.Itoa(program)] = scene
+	}
+	data, err := json.MarshalIndent(sf, "", "    ")
+	if err != nil {
+		fmt.Println("[scenes]", err)
+		return
+	}
+	// only the newest version of the file matters, so replace one that hasn't been written yet
+	select {
+	case <-b.writes:
+	default:
+	}
+	b.writes <- append(data, '\n')
+}
+
+//================================================================================
+// REQUESTS FROM ANY GOROUTINE
+
+// The program numbers which have scenes, in order.
+func (b *Bank) Programs() []int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	programs := make([]int, 0, len(b.scenes))
+	for program := range b.scenes {
+		programs = append(programs, program)
+	}
+	sort.Ints(programs)
+	return programs
+}
+
+// The scene for a program number, or nil.  Don't modify it.
+func (b *Bank) Get(program int) *Scene {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.scenes[program]
+}
+
+// Recall a scene on the next frame, as if its program change had arrived.
+// If seconds isn't nil it overrides the scene's transition time.
+func (b *Bank) Recall(program int, seconds *float64) error {
+	if b.Get(program) == nil {
+		return fmt.Errorf("there's no scene %v", program)
+	}
+	if seconds != nil && *seconds < 0 {
+		return fmt.Errorf("transition time can't be negative")
+	}
+	return b.queue(request{program: program, seconds: seconds})
+}
+
+// Save the live state as a scene on the next frame, replacing any scene with that program
+// number.  If name is "", an existing scene's name is kept.
+func (b *Bank) Save(program int, name string) error {
+	if program < 0 || program > MAX_PROGRAM {
+		return fmt.Errorf("program number should be from 0 to %v", MAX_PROGRAM)
+	}
+	return b.queue(request{program: program, save: true, name: name})
+}
+
+func (b *Bank) queue(req request) error {
+	select {
+	case b.requests <- req:
+		return nil
+	default:
+		return fmt.Errorf("too many scene requests waiting for the main loop")
+	}
+}
+
+//================================================================================
+// MAIN LOOP
+
+// Call this once per frame from the main loop, after controls.Update, with the controls
+// it changed.  Recalls scenes for program changes in midiState.RecentMidiMessages,
+// carries out queued requests, and moves gliding controls along.  t is the frame time.
+// Returns the controls this changed.
+func (b *Bank) Update(midiState *midi.MidiState, changed []*controls.Control, t float64) []*controls.Control {
+	// a human moving a control takes it over
+	for _, c := range changed {
+		delete(b.glides, c)
+	}
+
+	var result []*controls.Control
+	for _, m := range midiState.RecentMidiMessages {
+		if m.Kind == midi.PROGRAM_CHANGE {
+			result = append(result, b.recall(midiState, int(m.Key), nil, t)...)
+		}
+	}
+	for len(b.requests) > 0 {
+		req := <-b.requests
+		if req.save {
+			b.save(midiState, req.program, req.name)
+		} else {
+			result = append(result, b.recall(midiState, req.program, req.seconds, t)...)
+		}
+	}
+
+	for c, g := range b.glides {
+		pct := 1.0
+		if g.duration > 0 {
+			pct = colorutils.Clamp((t-g.startTime)/g.duration, 0, 1)
+		}
+		c.Set(midiState, g.from+(g.to-g.from)*pct)
+		result = append(result, c)
+		if pct >= 1 {
+			delete(b.glides, c)
+		}
+	}
+	return result
+}
+
+// Start changing to a scene.  Returns the controls which changed right away.
+func (b *Bank) recall(midiState *midi.MidiState, program int, seconds *float64, t float64) []*controls.Control {
+	scene := b.Get(program)
+	if scene == nil {
+		fmt.Println("[scenes] no scene for program", program)
+		return nil
+	}
+	fmt.Printf("[scenes] recalling scene %v %s\n", program, scene.Name)
+	duration := opc.DEFAULT_TRANSITION_TIME
+	if b.Switcher != nil {
+		duration = b.Switcher.Transition().Duration
+	}
+	if seconds != nil {
+		duration = *seconds
+	} else if scene.TransitionTime != nil {
+		duration = *scene.TransitionTime
+	}
+
+	if scene.Source != "" && b.Switcher != nil && scene.Source != b.Switcher.Current() {
+		if err := b.Switcher.SwitchToOver(scene.Source, duration); err != nil {
+			fmt.Println("[scenes] couldn't switch source:", err)
+		}
+	}
+
+	var result []*controls.Control
+	for name, value := range scene.Controls {
+		c := controls.Lookup(name)
+		if c.Kind == controls.FLOAT && duration > 0 {
+			b.glides[c] = &glide{from: c.Get(midiState), to: value, startTime: t, duration: duration}
+			continue
+		}
+		delete(b.glides, c)
+		c.Set(midiState, value)
+		result = append(result, c)
+	}
+	return result
+}
+
+// Store the live state as a scene and queue the file to be written.
+func (b *Bank) save(midiState *midi.MidiState, program int, name string) {
+	// a scene can't switch to an OPC server, so leave the source out if that's what's playing
+	source := ""
+	if b.Switcher != nil && b.Switcher.Check(b.Switcher.Current()) == nil {
+		source = b.Switcher.Current()
+	}
+	st := persist.Capture(midiState, source, "")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	scene := &Scene{Name: name, Source: st.Source, Controls: st.Controls}
+	if old := b.scenes[program]; old != nil {
+		if name == "" {
+			scene.Name = old.Name
+		}
+		scene.TransitionTime = old.TransitionTime
+	}
+	b.scenes[program] = scene
+	fmt.Printf("[scenes] saved scene %v %s\n", program, scene.Name)
+	b.write()
+}
@@ -0,0 +1,123 @@
+package scenes
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/longears/pixelslinger/controls"
+	"github.com/longears/pixelslinger/midi"
+)
+
+func programChange(program byte) []*midi.MidiMessage {
+	return []*midi.MidiMessage{{Kind: midi.PROGRAM_CHANGE, Key: program}}
+}
+
+//================================================================================
+func TestSaveAndRecall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scenes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "scenes.json")
+
+	b, err := Load(fn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	midiState := &midi.MidiState{}
+	controls.Reset(midiState)
+	controls.HUE.Set(midiState, 0.5)
+	controls.SLOWMO.Set(midiState, 1)
+	if err := b.Save(3, "purple"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Save(200, ""); err == nil {
+		t.Errorf("expected an error for program 200")
+	}
+	b.Update(midiState, nil, 0)
+	b.Close()
+
+	// load it back and recall it with a program change
+	b, err = Load(fn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if scene := b.Get(3); scene == nil || scene.Name != "purple" || scene.Controls["hue"] != 0.5 {
+		t.Fatalf("scene wasn't saved: %+v", scene)
+	}
+	controls.HUE.Set(midiState, 0)
+	controls.GAIN.Set(midiState, 0)
+	controls.SLOWMO.Set(midiState, 0)
+	two := 2.0
+	if err := b.Recall(3, &two); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Recall(4, nil); err == nil {
+		t.Errorf("expected an error for a missing scene")
+	}
+
+	midiState.UpdateStateFromSlice(nil)
+	changed := b.Update(midiState, nil, 10)
+	if !controls.SLOWMO.On(midiState) || len(changed) == 0 {
+		t.Errorf("bools should change right away")
+	}
+	if controls.HUE.Get(midiState) != 0 {
+		t.Errorf("hue should start gliding from 0, got %v", controls.HUE.Get(midiState))
+	}
+	b.Update(midiState, nil, 11)
+	if math.Abs(controls.HUE.Get(midiState)-0.25) > 1e-9 || math.Abs(controls.GAIN.Get(midiState)-0.5) > 1e-9 {
+		t.Errorf("expected hue and gain halfway, got %v %v", controls.HUE.Get(midiState), controls.GAIN.Get(midiState))
+	}
+
+	// turning a knob takes it out of the glide
+	controls.GAIN.Set(midiState, 0.1)
+	b.Update(midiState, []*controls.Control{controls.GAIN}, 13)
+	if controls.HUE.Get(midiState) != 0.5 || controls.GAIN.Get(midiState) != 0.1 {
+		t.Errorf("expected hue at 0.5 and gain left alone, got %v %v", controls.HUE.Get(midiState), controls.GAIN.Get(midiState))
+	}
+
+	// a program change from the controller recalls too
+	controls.HUE.Set(midiState, 0)
+	midiState.UpdateStateFromSlice(programChange(3))
+	b.Update(midiState, nil, 20)
+	midiState.UpdateStateFromSlice(nil)
+	b.Update(midiState, nil, 30)
+	if controls.HUE.Get(midiState) != 0.5 {
+		t.Errorf("program change didn't recall the scene: hue is %v", controls.HUE.Get(midiState))
+	}
+	midiState.UpdateStateFromSlice(programChange(9))
+	if changed := b.Update(midiState, nil, 40); len(changed) != 0 {
+		t.Errorf("a program change without a scene shouldn't change anything, got %v", changed)
+	}
+}
+
+func TestBadFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scenes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "scenes.json")
+
+	bad := []string{
+		`{"scenes": {"x": {}}}`,
+		`{"scenes": {"128": {}}}`,
+		`{"scenes": {"1": null}}`,
+		`{"scenes": {"1": {"controls": {"nope": 1}}}}`,
+		`{"scenes": {"1": {"controls": {"blink-circle": 1}}}}`,
+		`{"scenes": {"1": {"controls": {"hue": 2}}}}`,
+		`{"scenes": {"1": {"transition_time": -1}}}`,
+		`not json`,
+	}
+	for _, data := range bad {
+		ioutil.WriteFile(fn, []byte(data), 0644)
+		if _, err := Load(fn, nil); err == nil {
+			t.Errorf("expected an error for %s", data)
+		}
+	}
+}